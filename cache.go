@@ -0,0 +1,144 @@
+package mfs
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// NodeCacheStats are the statistics of the node cache of a `Root` (see
+// `WithNodeCache`).
+type NodeCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Number of nodes currently cached.
+	Len int
+}
+
+// cachedDAGService keeps the last `maxNodes` nodes read from the wrapped
+// DAG service in memory (evicting the least recently used ones). Nodes are
+// immutable (addressed by their CID) so cached nodes are never stale, only
+// removals need to drop them.
+type cachedDAGService struct {
+	ipld.DAGService
+	maxNodes int
+
+	lk     sync.Mutex
+	lru    *list.List
+	nodes  map[cid.Cid]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+func newCachedDAGService(ds ipld.DAGService, maxNodes int) *cachedDAGService {
+	return &cachedDAGService{
+		DAGService: ds,
+		maxNodes:   maxNodes,
+		lru:        list.New(),
+		nodes:      make(map[cid.Cid]*list.Element),
+	}
+}
+
+// lookup returns the cached node `c` (if any) updating the statistics.
+func (cd *cachedDAGService) lookup(c cid.Cid) (ipld.Node, bool) {
+	cd.lk.Lock()
+	defer cd.lk.Unlock()
+	e, ok := cd.nodes[c]
+	if !ok {
+		cd.misses++
+		return nil, false
+	}
+	cd.hits++
+	cd.lru.MoveToFront(e)
+	return e.Value.(ipld.Node), true
+}
+
+func (cd *cachedDAGService) insert(nd ipld.Node) {
+	cd.lk.Lock()
+	defer cd.lk.Unlock()
+	if e, ok := cd.nodes[nd.Cid()]; ok {
+		cd.lru.MoveToFront(e)
+		return
+	}
+	cd.nodes[nd.Cid()] = cd.lru.PushFront(nd)
+	if cd.lru.Len() > cd.maxNodes {
+		oldest := cd.lru.Back()
+		cd.lru.Remove(oldest)
+		delete(cd.nodes, oldest.Value.(ipld.Node).Cid())
+	}
+}
+
+func (cd *cachedDAGService) evict(c cid.Cid) {
+	cd.lk.Lock()
+	defer cd.lk.Unlock()
+	if e, ok := cd.nodes[c]; ok {
+		cd.lru.Remove(e)
+		delete(cd.nodes, c)
+	}
+}
+
+func (cd *cachedDAGService) stats() NodeCacheStats {
+	cd.lk.Lock()
+	defer cd.lk.Unlock()
+	return NodeCacheStats{Hits: cd.hits, Misses: cd.misses, Len: cd.lru.Len()}
+}
+
+func (cd *cachedDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if nd, ok := cd.lookup(c); ok {
+		return nd, nil
+	}
+	nd, err := cd.DAGService.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	cd.insert(nd)
+	return nd, nil
+}
+
+// GetMany returns the cached nodes right away and fetches the rest from
+// the wrapped service.
+func (cd *cachedDAGService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	var missing []cid.Cid
+	for _, c := range cids {
+		if nd, ok := cd.lookup(c); ok {
+			out <- &ipld.NodeOption{Node: nd}
+		} else {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		close(out)
+		return out
+	}
+
+	go func() {
+		defer close(out)
+		for opt := range cd.DAGService.GetMany(ctx, missing) {
+			if opt.Err == nil {
+				cd.insert(opt.Node)
+			}
+			select {
+			case out <- opt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (cd *cachedDAGService) Remove(ctx context.Context, c cid.Cid) error {
+	cd.evict(c)
+	return cd.DAGService.Remove(ctx, c)
+}
+
+func (cd *cachedDAGService) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		cd.evict(c)
+	}
+	return cd.DAGService.RemoveMany(ctx, cids)
+}
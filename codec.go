@@ -0,0 +1,237 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// FileCodec reads and writes the contents of files stored in a layout
+// other than (or on top of) the UnixFS file nodes, see `RegisterFileCodec`.
+type FileCodec interface {
+	// Match reports if `nd` is the root node of a file in the layout of
+	// the codec.
+	Match(nd ipld.Node) bool
+	// Open returns a descriptor on the file with the root node `nd`,
+	// storing the nodes it writes in `ds`.
+	Open(ctx context.Context, ds ipld.DAGService, nd ipld.Node, flags Flags) (CodecDescriptor, error)
+}
+
+// CodecDescriptor is the descriptor returned by `FileCodec.Open`, which
+// MFS wraps in a `FileDescriptor` handling the locking of the file and
+// the propagation of its new nodes to the directory.
+type CodecDescriptor interface {
+	io.Reader
+	io.Writer
+	io.WriterAt
+	io.Seeker
+
+	Truncate(int64) error
+	Size() (int64, error)
+	// Node returns the current root node of the file, storing the
+	// pending writes (and the node itself) in the DAG service.
+	Node() (ipld.Node, error)
+	Close() error
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     []namedCodec
+)
+
+type namedCodec struct {
+	name  string
+	codec FileCodec
+}
+
+// RegisterFileCodec registers `c` under `name`, replacing the codec
+// previously registered with that name (if any). The UnixFS format has no
+// field to record the codec of a file so it's selected from the root node
+// of the file alone: codecs are asked (with `Match`) from the most
+// recently registered to the first one, and the first one to match is
+// used. A codec must then be able to recognize its files by their root
+// node, for example by their IPLD codec (the one of their CID) or by a
+// distinct header in their data. The entries matched by a codec are
+// `File`s of the directories (instead of `Opaque` entries) and are opened
+// through the codec. The files no codec matches are opened with the
+// built-in UnixFS descriptor (supporting all the `OpenOption`s), so a
+// codec matching UnixFS file nodes takes them over.
+func RegisterFileCodec(name string, c FileCodec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	for i := range codecs {
+		if codecs[i].name == name {
+			codecs[i].codec = c
+			return
+		}
+	}
+	codecs = append(codecs, namedCodec{name, c})
+}
+
+// customFileCodec returns the registered codec that matches `nd`, if any.
+func customFileCodec(nd ipld.Node) FileCodec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for i := len(codecs) - 1; i >= 0; i-- {
+		if codecs[i].codec.Match(nd) {
+			return codecs[i].codec
+		}
+	}
+	return nil
+}
+
+// openCodec is `Open` for the files of the codec `c` (called with the
+// `desclock` taken as `flags` require).
+func (fi *File) openCodec(c FileCodec, nd ipld.Node, flags Flags) (FileDescriptor, error) {
+	cd, err := c.Open(context.TODO(), fi.dagService, nd, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &codecDescriptor{inode: fi, cd: cd, flags: flags}, nil
+}
+
+// codecDescriptor is the `FileDescriptor` of the files opened through a
+// `FileCodec`.
+type codecDescriptor struct {
+	inode  *File
+	cd     CodecDescriptor
+	flags  Flags
+	closed bool
+}
+
+func (fd *codecDescriptor) check(write bool) error {
+	if fd.closed {
+		return ErrClosed
+	}
+	if write && !fd.flags.Write {
+		return fmt.Errorf("file is read-only")
+	}
+	if !write && !fd.flags.Read {
+		return fmt.Errorf("file is write-only")
+	}
+	return nil
+}
+
+func (fd *codecDescriptor) Read(b []byte) (int, error) {
+	if err := fd.check(false); err != nil {
+		return 0, fmt.Errorf("read failed: %s", err)
+	}
+	return fd.cd.Read(b)
+}
+
+func (fd *codecDescriptor) CtxReadFull(ctx context.Context, b []byte) (int, error) {
+	var read int
+	for read < len(b) {
+		if err := ctx.Err(); err != nil {
+			return read, err
+		}
+		n, err := fd.Read(b[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// ReadWithBlocks isn't supported by codecs (which may not have leaf
+// blocks), it returns `ErrNotYetImplemented`.
+func (fd *codecDescriptor) ReadWithBlocks(b []byte) (int, cid.Cid, error) {
+	return 0, cid.Undef, ErrNotYetImplemented
+}
+
+func (fd *codecDescriptor) Write(b []byte) (int, error) {
+	if err := fd.check(true); err != nil {
+		return 0, fmt.Errorf("write failed: %s", err)
+	}
+	return fd.cd.Write(b)
+}
+
+func (fd *codecDescriptor) WriteAt(b []byte, offset int64) (int, error) {
+	if err := fd.check(true); err != nil {
+		return 0, fmt.Errorf("write-at failed: %s", err)
+	}
+	return fd.cd.WriteAt(b, offset)
+}
+
+func (fd *codecDescriptor) Seek(offset int64, whence int) (int64, error) {
+	if fd.closed {
+		return 0, fmt.Errorf("seek failed: %s", ErrClosed)
+	}
+	return fd.cd.Seek(offset, whence)
+}
+
+func (fd *codecDescriptor) Truncate(size int64) error {
+	if err := fd.check(true); err != nil {
+		return fmt.Errorf("truncate failed: %s", err)
+	}
+	return fd.cd.Truncate(size)
+}
+
+func (fd *codecDescriptor) Size() (int64, error) {
+	if fd.closed {
+		return 0, ErrClosed
+	}
+	return fd.cd.Size()
+}
+
+// Flush stores the current node of the file and updates the entry in the
+// parent directory (propagating the update to the root).
+func (fd *codecDescriptor) Flush() error {
+	if fd.closed {
+		return ErrClosed
+	}
+	return fd.flushUp(true)
+}
+
+func (fd *codecDescriptor) flushUp(fullSync bool) error {
+	if !fd.flags.Write {
+		return nil
+	}
+	nd, err := fd.cd.Node()
+	if err != nil {
+		return err
+	}
+
+	fd.inode.nodeLock.Lock()
+	fd.inode.node = nd
+	parent := fd.inode.parent
+	name := fd.inode.name
+	fd.inode.nodeLock.Unlock()
+
+	if dir, ok := parent.(*Directory); ok {
+		dir.recordOp(OpWrite, name, nd.Cid())
+	}
+
+	if fullSync && parent != nil {
+		if err := parent.updateChildEntry(child{name, nd, fd.inode}); err != nil {
+			return err
+		}
+		fd.inode.setLinked(nd.Cid())
+	}
+	return nil
+}
+
+func (fd *codecDescriptor) Close() error {
+	if fd.closed {
+		return ErrClosed
+	}
+	if fd.flags.Write {
+		defer fd.inode.desclock.Unlock()
+		if r := rootOf(fd.inode.parent); r != nil {
+			defer r.removeWriter(fd.inode)
+		}
+	} else if fd.flags.Read {
+		defer fd.inode.desclock.RUnlock()
+	}
+	fd.closed = true
+	err := fd.flushUp(fd.flags.Sync)
+	if cerr := fd.cd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
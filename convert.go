@@ -0,0 +1,229 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+
+	dag "github.com/ipfs/go-merkledag"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ToV1 flushes the tree and re-encodes all of its nodes (file nodes
+// included) with CIDv1, keeping the hash function of each node, and makes
+// the converted tree the content of the root directory, returning its
+// new CID. The contents of the files and the directory entries are
+// unchanged, but any `File` or `Directory` obtained from the tree before
+// the conversion must not be used afterwards. (The cumulative sizes in
+// the links are updated for the longer CIDs.) New directories are also
+// created with CIDv1.
+func (kr *Root) ToV1(ctx context.Context) (cid.Cid, error) {
+	return kr.convertCidVersion(ctx, 1)
+}
+
+// ToV0 is the counterpart of `ToV1` converting the tree back to CIDv0,
+// which is only possible for trees made exclusively of dag-pb nodes
+// hashed with SHA2-256 (e.g., without raw leaves).
+func (kr *Root) ToV0(ctx context.Context) (cid.Cid, error) {
+	return kr.convertCidVersion(ctx, 0)
+}
+
+func (kr *Root) convertCidVersion(ctx context.Context, version uint64) (cid.Cid, error) {
+	dir := kr.GetDirectory()
+	nd, err := flushedNode(dir)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	conv := &cidConverter{
+		ds:      dir.dagService,
+		version: version,
+		done:    make(map[cid.Cid]convertedNode),
+	}
+	c, _, err := conv.convert(ctx, nd.Cid(), 0)
+	if err != nil {
+		return cid.Undef, err
+	}
+	newRoot, err := conv.ds.Get(ctx, c)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err := dir.replaceNode(newRoot, cid.Undef); err != nil {
+		return cid.Undef, err
+	}
+	if err := kr.Flush(); err != nil {
+		return cid.Undef, err
+	}
+	return c, nil
+}
+
+// cidConverter re-encodes DAGs with a given CID version.
+type cidConverter struct {
+	ds      ipld.DAGService
+	version uint64
+	// Converted CIDs, the same blocks are usually referenced many times
+	// (e.g., the leaves of files with repeated data).
+	done map[cid.Cid]convertedNode
+}
+
+type convertedNode struct {
+	cid cid.Cid
+	// Cumulative size, for the links to it.
+	size uint64
+}
+
+// convert returns the converted CID of `c` and the cumulative size of its
+// converted DAG (`size` is the one of the original DAG).
+func (cc *cidConverter) convert(ctx context.Context, c cid.Cid, size uint64) (cid.Cid, uint64, error) {
+	if cn, ok := cc.done[c]; ok {
+		return cn.cid, cn.size, nil
+	}
+
+	prefix := c.Prefix()
+	switch {
+	case prefix.Codec == cid.Raw && cc.version == 1:
+		// Raw blocks are always CIDv1 and have no links.
+		return c, size, nil
+	case prefix.Codec != cid.DagProtobuf:
+		return cid.Undef, 0, fmt.Errorf("%s: CIDv%d not supported for codec %d", c, cc.version, prefix.Codec)
+	case cc.version == 0 && prefix.MhType != dag.V0CidPrefix().MhType:
+		return cid.Undef, 0, fmt.Errorf("%s: CIDv0 only supports SHA2-256", c)
+	}
+
+	nd, err := cc.ds.Get(ctx, c)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return cid.Undef, 0, dag.ErrNotProtobuf
+	}
+
+	cpy := pbnd.Copy().(*dag.ProtoNode)
+	links := make([]*ipld.Link, len(pbnd.Links()))
+	for i, l := range pbnd.Links() {
+		lc, lsize, err := cc.convert(ctx, l.Cid, l.Size)
+		if err != nil {
+			return cid.Undef, 0, err
+		}
+		nl := *l
+		nl.Cid = lc
+		nl.Size = lsize
+		links[i] = &nl
+	}
+	cpy.SetLinks(links)
+
+	if cc.version == 0 {
+		cpy.SetCidBuilder(dag.V0CidPrefix())
+	} else {
+		cpy.SetCidBuilder(cid.V1Builder{
+			Codec:    cid.DagProtobuf,
+			MhType:   prefix.MhType,
+			MhLength: prefix.MhLength,
+		})
+	}
+	if err := cc.ds.Add(ctx, cpy); err != nil {
+		return cid.Undef, 0, err
+	}
+	csize, err := cpy.Size()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	cc.done[c] = convertedNode{cpy.Cid(), csize}
+	return cpy.Cid(), csize, nil
+}
+
+// leafConverter re-encodes the leaves of file DAGs with the builder set
+// with `WithLeafCidBuilder`, the structural nodes keep their builder (only
+// their links are updated).
+type leafConverter struct {
+	ds      ipld.DAGService
+	builder cid.Builder
+	// Prefixes of the converted raw and dag-pb leaves, to recognize the
+	// ones already converted by a previous flush.
+	rawPrefix cid.Prefix
+	pbPrefix  cid.Prefix
+}
+
+func newLeafConverter(ds ipld.DAGService, b cid.Builder) (*leafConverter, error) {
+	raw, err := b.WithCodec(cid.Raw).Sum(nil)
+	if err != nil {
+		return nil, err
+	}
+	pb, err := b.WithCodec(cid.DagProtobuf).Sum(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &leafConverter{
+		ds:        ds,
+		builder:   b,
+		rawPrefix: raw.Prefix(),
+		pbPrefix:  pb.Prefix(),
+	}, nil
+}
+
+// convert returns `nd` with its leaves converted (which is `nd` itself if
+// there was nothing to convert). The new nodes are added to the DAG
+// service.
+func (lc *leafConverter) convert(ctx context.Context, nd ipld.Node) (ipld.Node, error) {
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		if nd.Cid().Prefix() == lc.rawPrefix {
+			return nd, nil
+		}
+		cnd, err := dag.NewRawNodeWPrefix(nd.RawData(), lc.builder)
+		if err != nil {
+			return nil, err
+		}
+		return cnd, lc.ds.Add(ctx, cnd)
+	case *dag.ProtoNode:
+		if len(nd.Links()) == 0 {
+			if nd.Cid().Prefix() == lc.pbPrefix {
+				return nd, nil
+			}
+			cpy := nd.Copy().(*dag.ProtoNode)
+			cpy.SetCidBuilder(lc.builder)
+			return cpy, lc.ds.Add(ctx, cpy)
+		}
+
+		links := make([]*ipld.Link, len(nd.Links()))
+		changed := false
+		for i, l := range nd.Links() {
+			nl := *l
+			links[i] = &nl
+			// Converted raw leaves don't need to be fetched.
+			if l.Cid.Prefix() == lc.rawPrefix {
+				continue
+			}
+			child, err := l.GetNode(ctx, lc.ds)
+			if err != nil {
+				return nil, err
+			}
+			cchild, err := lc.convert(ctx, child)
+			if err != nil {
+				return nil, err
+			}
+			if cchild.Cid().Equals(l.Cid) {
+				continue
+			}
+			size, err := cchild.Size()
+			if err != nil {
+				return nil, err
+			}
+			nl.Cid = cchild.Cid()
+			nl.Size = size
+			changed = true
+		}
+		if !changed {
+			return nd, nil
+		}
+		cpy := nd.Copy().(*dag.ProtoNode)
+		cpy.SetLinks(links)
+		return cpy, lc.ds.Add(ctx, cpy)
+	default:
+		return nil, fmt.Errorf("unexpected node type in file: %T", nd)
+	}
+}
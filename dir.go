@@ -2,15 +2,20 @@ package mfs
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
 	uio "github.com/ipfs/go-unixfs/io"
 
 	cid "github.com/ipfs/go-cid"
@@ -20,6 +25,15 @@ import (
 var ErrNotYetImplemented = errors.New("not yet implemented")
 var ErrInvalidChild = errors.New("invalid child node")
 var ErrDirExists = errors.New("directory already has entry by that name")
+var ErrDuplicateLink = errors.New("directory has more than one entry by the same name")
+
+// ErrNotFlushed is returned by `GetNodeNoFlush` when the directory has
+// changes that haven't been flushed.
+var ErrNotFlushed = errors.New("directory has unflushed changes")
+
+// ErrTreeTooDeep is returned when adding an entry deeper than the maximum
+// depth of the tree (see `WithMaxTreeDepth`).
+var ErrTreeTooDeep = errors.New("tree too deep")
 
 // TODO: There's too much functionality associated with this structure,
 // let's organize it (and if possible extract part of it elsewhere)
@@ -41,6 +55,25 @@ type Directory struct {
 	unixfsDir uio.Directory
 
 	modTime time.Time
+
+	// Number of conversions between the basic and HAMT representations.
+	conversions int
+	// Whether the representation is fixed (see `Root.SetRootSharded`).
+	shardPinned bool
+	// Number of entries and sharding metric (for the modes other than
+	// `ShardingByCount`, see `linkMetric`), only tracked once counted (see
+	// `countEntriesUnsync`).
+	entries        int
+	metric         int
+	entriesCounted bool
+
+	// Whether the directory changed since its node was last stored in the
+	// DAG service, and the CID and size of that node (see `EstimateFlush`).
+	dirty      bool
+	stored     cid.Cid
+	storedSize int
+	// Names of the entries added or replaced since then (see `WalkDirty`).
+	changed map[string]struct{}
 }
 
 // NewDirectory constructs a new MFS directory.
@@ -48,12 +81,24 @@ type Directory struct {
 // You probably don't want to call this directly. Instead, construct a new root
 // using NewRoot.
 func NewDirectory(ctx context.Context, name string, node ipld.Node, parent parent, dserv ipld.DAGService) (*Directory, error) {
+	dserv = skipLinkNodes(dserv)
+	orig := node
+	node, err := applyDuplicateLinkPolicy(node, optionsOf(parent).dupLinkPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := uio.NewDirectoryFromNode(dserv, node)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Directory{
+	var modTime time.Time
+	if !optionsOf(parent).deterministic {
+		modTime = time.Now()
+	}
+
+	d := &Directory{
 		inode: inode{
 			name:       name,
 			parent:     parent,
@@ -62,8 +107,138 @@ func NewDirectory(ctx context.Context, name string, node ipld.Node, parent paren
 		ctx:          ctx,
 		unixfsDir:    db,
 		entriesCache: make(map[string]FSNode),
-		modTime:      time.Now(),
-	}, nil
+		modTime:      modTime,
+	}
+	d.setStored(orig)
+	d.dirty = node != orig
+	return d, nil
+}
+
+// setStored records `nd` as the last node of the directory stored in the
+// DAG service.
+func (d *Directory) setStored(nd ipld.Node) {
+	d.dirty = false
+	d.changed = nil
+	d.stored = nd.Cid()
+	d.storedSize = len(nd.RawData())
+}
+
+// storedCid returns the CID of the last node of the directory stored in
+// the DAG service (or loaded from it) and whether the directory changed
+// since.
+func (d *Directory) storedCid() (cid.Cid, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.stored, d.dirty
+}
+
+// applyDuplicateLinkPolicy checks a basic directory node for links with
+// the same name and, depending on the policy, rejects it or returns a
+// copy with only one link per name. HAMT shards are left untouched as
+// their names are spread across their internal nodes.
+func applyDuplicateLinkPolicy(node ipld.Node, policy DuplicateLinkPolicy) (ipld.Node, error) {
+	pbnd, ok := node.(*dag.ProtoNode)
+	if policy == 0 || !ok {
+		return node, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil || fsn.Type() != ft.TDirectory {
+		// Leave the error reporting to `NewDirectoryFromNode`.
+		return node, nil
+	}
+
+	links := pbnd.Links()
+	seen := make(map[string]struct{}, len(links))
+	deduped := make([]*ipld.Link, 0, len(links))
+	for i := range links {
+		l := links[i]
+		if policy == DuplicateLinkLast {
+			l = links[len(links)-1-i]
+		}
+		if _, ok := seen[l.Name]; ok {
+			if policy == DuplicateLinkError {
+				return nil, fmt.Errorf("%w: %q", ErrDuplicateLink, l.Name)
+			}
+			continue
+		}
+		seen[l.Name] = struct{}{}
+		deduped = append(deduped, l)
+	}
+	if len(deduped) == len(links) {
+		return node, nil
+	}
+
+	if policy == DuplicateLinkLast {
+		for i, j := 0, len(deduped)-1; i < j; i, j = i+1, j-1 {
+			deduped[i], deduped[j] = deduped[j], deduped[i]
+		}
+	}
+	cpy := pbnd.Copy().(*dag.ProtoNode)
+	cpy.SetLinks(deduped)
+	return cpy, nil
+}
+
+// replaceNode replaces the whole content of this directory with the
+// (already stored) directory node `nd`, dropping the cached entries. If
+// `base` is defined the directory is only replaced if its current node
+// (synced under the same lock) is still `base`, `ErrBaseConflict` is
+// returned otherwise.
+func (d *Directory) replaceNode(nd ipld.Node, base cid.Cid) error {
+	nd, err := applyDuplicateLinkPolicy(nd, optionsOf(d.parent).dupLinkPolicy)
+	if err != nil {
+		return err
+	}
+	db, err := uio.NewDirectoryFromNode(d.dagService, nd)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if base.Defined() {
+		if err := d.sync(); err != nil {
+			return err
+		}
+		cur, err := d.unixfsDir.GetNode()
+		if err != nil {
+			return err
+		}
+		if !cur.Cid().Equals(base) {
+			return ErrBaseConflict
+		}
+	}
+	d.unixfsDir = db
+	d.entriesCache = make(map[string]FSNode)
+	d.entriesCounted = false
+	d.shardPinned = false
+	d.setStored(nd)
+	d.touch()
+	return nil
+}
+
+// reattach caches `child` (a directory of a previous tree, see
+// `Root.Rebase`) as the entry `name` of this directory if the entry links
+// to the same CID `c`, making this directory its parent.
+func (d *Directory) reattach(name string, child *Directory, c cid.Cid) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	linked, err := d.linkCidUnsync(name)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !linked.Equals(c) {
+		return nil
+	}
+
+	child.lock.Lock()
+	child.parent = d
+	child.lock.Unlock()
+	d.entriesCache[name] = child
+	return nil
 }
 
 // GetCidBuilder gets the CID builder of the root node
@@ -73,7 +248,10 @@ func (d *Directory) GetCidBuilder() cid.Builder {
 
 // SetCidBuilder sets the CID builder
 func (d *Directory) SetCidBuilder(b cid.Builder) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.unixfsDir.SetCidBuilder(b)
+	d.dirty = true
 }
 
 // This method implements the `parent` interface. It first does the local
@@ -89,7 +267,7 @@ func (d *Directory) updateChildEntry(c child) error {
 
 	// Continue to propagate the update process upwards
 	// (all the way up to the root).
-	return d.parent.updateChildEntry(child{d.name, newDirNode})
+	return d.parent.updateChildEntry(child{d.name, newDirNode, d})
 }
 
 // This method implements the part of `updateChildEntry` that needs
@@ -100,7 +278,12 @@ func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	err := d.updateChild(c)
+	c, err := d.resolveConflict(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.updateChild(c)
 	if err != nil {
 		return nil, err
 	}
@@ -121,23 +304,257 @@ func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.setStored(nd)
 
 	return pbnd.Copy().(*dag.ProtoNode), nil
 	// TODO: Why do we need a copy?
 }
 
+// resolveConflict checks, when the root has a conflict resolver (see
+// `WithFlushConflictResolver`), if the update comes from a child that is
+// no longer the one cached under its name, meaning the entry was replaced
+// (or reloaded) by another operation since the child was loaded. If so
+// (and the entry still exists) it returns the update with the node merged
+// by the resolver, evicting the cached entry (if any) which no longer
+// reflects it.
+func (d *Directory) resolveConflict(c child) (child, error) {
+	resolve := optionsOf(d).flushConflictResolver
+	if resolve == nil || c.Source == nil {
+		return c, nil
+	}
+	if entry, ok := d.entriesCache[c.Name]; ok && entry == c.Source {
+		return c, nil
+	}
+
+	current, err := d.childFromDag(c.Name)
+	if err == os.ErrNotExist {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if current.Cid().Equals(c.Node.Cid()) {
+		return c, nil
+	}
+
+	resolved, err := resolve(path.Join(d.Path(), c.Name), current, c.Node)
+	if err != nil {
+		return c, err
+	}
+	if err := d.dagService.Add(d.ctx, resolved); err != nil {
+		return c, err
+	}
+	delete(d.entriesCache, c.Name)
+	c.Node = resolved
+	return c, nil
+}
+
 // Update child entry in the underlying UnixFS directory.
 func (d *Directory) updateChild(c child) error {
-	err := d.unixfsDir.AddChild(d.ctx, c.Name, c.Node)
+	err := d.unixfsAddChild(c.Name, c.Node)
+	if err != nil {
+		return err
+	}
+
+	d.touch()
+
+	return nil
+}
+
+// validateName checks a name for a new entry against the maximum length
+// and with the validator of the root (see `WithMaxNameLength` and
+// `WithNameValidator`), and that the entry wouldn't be deeper than the
+// maximum tree depth (see `WithMaxTreeDepth`).
+func (d *Directory) validateName(name string) error {
+	opts := optionsOf(d)
+	if opts.maxTreeDepth > 0 && d.depth()+1 > opts.maxTreeDepth {
+		return ErrTreeTooDeep
+	}
+	if opts.maxNameLength > 0 && len(name) > opts.maxNameLength {
+		return ErrNameTooLong
+	}
+	if v := opts.nameValidator; v != nil {
+		return v(name)
+	}
+	return nil
+}
+
+// validateSubtree checks that the entries under `nd`, if it's a directory
+// added as an entry of this one, don't go below the maximum depth of the
+// tree (see `WithMaxTreeDepth`).
+func (d *Directory) validateSubtree(nd ipld.Node) error {
+	max := optionsOf(d).maxTreeDepth
+	if max == 0 {
+		return nil
+	}
+	return checkSubtreeDepth(d.ctx, d.dagService, nd, max-d.depth()-1)
+}
+
+// checkSubtreeDepth returns `ErrTreeTooDeep` if the UnixFS directory `nd`
+// has entries more than `levels` levels below it, fetching its
+// subdirectories down to that depth. Nodes missing from `ds` (dangling
+// links) aren't inspected.
+func checkSubtreeDepth(ctx context.Context, ds ipld.DAGService, nd ipld.Node, levels int) error {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil || !fsn.IsDir() {
+		return nil
+	}
+	dir, err := uio.NewDirectoryFromNode(ds, nd)
 	if err != nil {
 		return err
 	}
+	return dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if levels <= 0 {
+			return ErrTreeTooDeep
+		}
+		child, err := ds.Get(ctx, l.Cid)
+		if err == ipld.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return checkSubtreeDepth(ctx, ds, child, levels-1)
+	})
+}
+
+// preload loads (caching them) the subdirectories of this directory,
+// fetching up to `budget` entries (decremented for each one fetched), and
+// returns them (see `NewRootEager`).
+func (d *Directory) preload(ctx context.Context, budget *int) ([]*Directory, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var links []*ipld.Link
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Name < links[j].Name })
+
+	var dirs []*Directory
+	for _, l := range links {
+		if entry, ok := d.entriesCache[l.Name]; ok {
+			if dir, ok := entry.(*Directory); ok {
+				dirs = append(dirs, dir)
+			}
+			continue
+		}
+		if l.Cid.Type() == cid.Raw {
+			// A file.
+			continue
+		}
+		if *budget <= 0 {
+			break
+		}
+		nd, err := d.dagService.Get(ctx, l.Cid)
+		if err != nil {
+			return nil, err
+		}
+		*budget--
+
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			continue
+		}
+		fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+		if err != nil || !fsn.IsDir() {
+			continue
+		}
+		entry, err := d.cacheNode(l.Name, nd)
+		if err != nil {
+			return nil, err
+		}
+		if dir, ok := entry.(*Directory); ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// compactCache drops the cached entries of the directory (and of its
+// cached subdirectories) that don't need to stay in memory, see
+// `Root.FlushAndCompactCache`.
+func (d *Directory) compactCache(ctx context.Context) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for name, entry := range d.entriesCache {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	d.modTime = time.Now()
+		nd, err := flushedNode(entry)
+		if err != nil {
+			return err
+		}
+		linked, err := d.linkCidUnsync(name)
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if !linked.Equals(nd.Cid()) {
+			// Changed since the flush, not synced yet.
+			continue
+		}
 
+		switch entry := entry.(type) {
+		case *Directory:
+			if err := entry.compactCache(ctx); err != nil {
+				return err
+			}
+		case *File:
+			// Not open if no descriptor holds the lock.
+			if entry.desclock.TryLock() {
+				entry.desclock.Unlock()
+				delete(d.entriesCache, name)
+			}
+		default:
+			delete(d.entriesCache, name)
+		}
+	}
 	return nil
 }
 
+// cachedNodeCount returns the number of entries cached under the
+// directory.
+func (d *Directory) cachedNodeCount() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := len(d.entriesCache)
+	for _, entry := range d.entriesCache {
+		if dir, ok := entry.(*Directory); ok {
+			n += dir.cachedNodeCount()
+		}
+	}
+	return n
+}
+
+// depth returns the number of directories between this one and the root
+// directory (zero for the root directory itself).
+func (d *Directory) depth() int {
+	n := 0
+	for p, ok := d.parent.(*Directory); ok; p, ok = p.parent.(*Directory) {
+		n++
+	}
+	return n
+}
+
+// touch updates the modification time of the directory (unless the root
+// is deterministic, see `WithDeterministic`).
+func (d *Directory) touch() {
+	if !optionsOf(d.parent).deterministic {
+		d.modTime = time.Now()
+	}
+}
+
 func (d *Directory) Type() NodeType {
 	return TDir
 }
@@ -155,11 +572,23 @@ func (d *Directory) childNode(name string) (FSNode, error) {
 
 // cacheNode caches a node into d.childDirs or d.files and returns the FSNode.
 func (d *Directory) cacheNode(name string, nd ipld.Node) (FSNode, error) {
+	if customFileCodec(nd) != nil {
+		nfi, err := NewFile(name, nd, d, d.dagService)
+		if err != nil {
+			return nil, err
+		}
+		d.entriesCache[name] = nfi
+		return nfi, nil
+	}
+
 	switch nd := nd.(type) {
 	case *dag.ProtoNode:
 		fsn, err := ft.FSNodeFromBytes(nd.Data())
 		if err != nil {
-			return nil, err
+			// Not UnixFS.
+			op := &Opaque{name: name, node: nd}
+			d.entriesCache[name] = op
+			return op, nil
 		}
 
 		switch fsn.Type() {
@@ -191,7 +620,9 @@ func (d *Directory) cacheNode(name string, nd ipld.Node) (FSNode, error) {
 		d.entriesCache[name] = nfi
 		return nfi, nil
 	default:
-		return nil, fmt.Errorf("unrecognized node type in cache node")
+		op := &Opaque{name: name, node: nd}
+		d.entriesCache[name] = op
+		return op, nil
 	}
 }
 
@@ -202,6 +633,62 @@ func (d *Directory) Child(name string) (FSNode, error) {
 	return d.childUnsync(name)
 }
 
+// Preload fetches all the (not yet cached) children of this directory,
+// using up to `concurrency` parallel requests to the DAG service, and
+// caches them so subsequent calls to `Child` don't need to hit the DAG.
+// It only loads this directory's entries, it doesn't descend into its
+// subdirectories.
+func (d *Directory) Preload(ctx context.Context, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var links []*ipld.Link
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if _, ok := d.entriesCache[l.Name]; !ok {
+			links = append(links, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]ipld.Node, len(links))
+	errs := make(chan error, len(links))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, l := range links {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, l *ipld.Link) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			nd, err := l.GetNode(ctx, d.dagService)
+			if err != nil {
+				errs <- fmt.Errorf("preloading %s: %s", l.Name, err)
+				return
+			}
+			nodes[i] = nd
+		}(i, l)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	for i, l := range links {
+		if _, err := d.cacheNode(l.Name, nodes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Directory) Uncache(name string) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -232,6 +719,12 @@ type NodeListing struct {
 	Hash string
 }
 
+// ListNames returns the names of the entries of the directory, in the
+// order of the links of basic directories. In HAMT shards entries are in
+// the order of the (murmur3) hash of their names: each bucket holds a
+// single entry (names hashed to the same bucket are split into a shard
+// below it), so the order only depends on the names, not on how (nor in
+// which order) they were added.
 func (d *Directory) ListNames(ctx context.Context) ([]string, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -248,137 +741,1551 @@ func (d *Directory) ListNames(ctx context.Context) ([]string, error) {
 	return out, nil
 }
 
-func (d *Directory) List(ctx context.Context) ([]NodeListing, error) {
-	var out []NodeListing
-	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
-		out = append(out, nl)
-		return nil
-	})
-	return out, err
+// Len returns the number of entries of the directory. They are counted
+// (listing all of them, which for HAMT shards means loading all the shard
+// nodes) on the first call, then the count is updated by each operation
+// adding or removing entries, so later calls (and conversions between the
+// basic and HAMT representations, which keep the same entries) don't list
+// them again.
+func (d *Directory) Len(ctx context.Context) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.countEntriesUnsync(ctx); err != nil {
+		return 0, err
+	}
+	return d.entries, nil
 }
 
-func (d *Directory) ForEachEntry(ctx context.Context, f func(NodeListing) error) error {
+// LongestName returns the longest name (in bytes) of the entries of this
+// directory, or an empty string if it has none.
+func (d *Directory) LongestName() (string, error) {
+	names, err := d.ListNames(d.ctx)
+	if err != nil {
+		return "", err
+	}
+	var longest string
+	for _, name := range names {
+		if len(name) > len(longest) {
+			longest = name
+		}
+	}
+	return longest, nil
+}
+
+// ListByType returns the names of the entries of this directory whose
+// type is `t` (`TFile` or `TDir`). Entries not yet cached are classified
+// from their link (raw leaves are files) or by fetching only their top
+// node, no file data is read and nothing gets cached.
+func (d *Directory) ListByType(ctx context.Context, t NodeType) ([]string, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
-		c, err := d.childUnsync(l.Name)
-		if err != nil {
-			return err
-		}
 
-		nd, err := c.GetNode()
+	var out []string
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		lt, err := d.linkTypeUnsync(ctx, l)
 		if err != nil {
 			return err
 		}
-
-		child := NodeListing{
-			Name: l.Name,
-			Type: int(c.Type()),
-			Hash: nd.Cid().String(),
-		}
-
-		if c, ok := c.(*File); ok {
-			size, err := c.Size()
-			if err != nil {
-				return err
-			}
-			child.Size = size
+		if lt == t {
+			out = append(out, l.Name)
 		}
-
-		return f(child)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-func (d *Directory) Mkdir(name string) (*Directory, error) {
+// IndexedEntry is an entry returned by `ListWithIndex`.
+type IndexedEntry struct {
+	Name string
+	Type NodeType
+	// Position of the link of the entry in the directory node.
+	Index int
+}
+
+// ListWithIndex returns the entries of this directory in the order of their
+// links in the (flushed) directory node, along with their positions. For
+// HAMT shards the index is the position in the traversal of the shard
+// nodes (in the order of their links).
+func (d *Directory) ListWithIndex(ctx context.Context) ([]IndexedEntry, error) {
+	if _, err := flushedNode(d); err != nil {
+		return nil, err
+	}
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	fsn, err := d.childUnsync(name)
-	if err == nil {
-		switch fsn := fsn.(type) {
-		case *Directory:
-			return fsn, os.ErrExist
-		case *File:
+	var out []IndexedEntry
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		t, err := d.linkTypeUnsync(ctx, l)
+		if err != nil {
+			return err
+		}
+		out = append(out, IndexedEntry{
+			Name:  l.Name,
+			Type:  t,
+			Index: len(out),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// errStopWalk stops an iteration of the links of a directory early.
+var errStopWalk = errors.New("stop walk")
+
+// GetLink returns the link of the entry `name` as stored in the directory
+// node (its CID and cumulative size), without fetching its node nor
+// creating a `File` or `Directory` for it, or `os.ErrNotExist`. HAMT shards
+// are iterated until the link is found (their internal nodes are fetched,
+// but not the entries). Changes of the entry not yet flushed to this
+// directory aren't reflected.
+func (d *Directory) GetLink(name string) (*ipld.Link, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if basic, ok := d.innerDir().(*uio.BasicDirectory); ok {
+		nd, err := basic.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return nil, dag.ErrNotProtobuf
+		}
+		l, err := pbnd.GetNodeLink(name)
+		if err == dag.ErrLinkNotFound {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Don't expose the link of the node.
+		cpy := *l
+		return &cpy, nil
+	}
+
+	var found *ipld.Link
+	err := d.unixfsDir.ForEachLink(d.ctx, func(l *ipld.Link) error {
+		if l.Name == name {
+			found = l
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+	if found == nil {
+		return nil, os.ErrNotExist
+	}
+	return found, nil
+}
+
+// linkTypeUnsync returns the type of the entry pointed to by `l`.
+func (d *Directory) linkTypeUnsync(ctx context.Context, l *ipld.Link) (NodeType, error) {
+	if entry, ok := d.entriesCache[l.Name]; ok {
+		return entry.Type(), nil
+	}
+	if l.Cid.Type() == cid.Raw {
+		return TFile, nil
+	}
+
+	nd, err := d.dagService.Get(ctx, l.Cid)
+	if err != nil {
+		return 0, err
+	}
+	if customFileCodec(nd) != nil {
+		return TFile, nil
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		if _, ok := nd.(*dag.RawNode); ok {
+			return TFile, nil
+		}
+		return TRaw, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return TRaw, nil
+	}
+	switch fsn.Type() {
+	case ft.TDirectory, ft.THAMTShard:
+		return TDir, nil
+	case ft.TFile, ft.TRaw, ft.TSymlink:
+		return TFile, nil
+	case ft.TMetadata:
+		return 0, ErrNotYetImplemented
+	default:
+		return 0, ErrInvalidChild
+	}
+}
+
+func (d *Directory) List(ctx context.Context) ([]NodeListing, error) {
+	var out []NodeListing
+	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
+		out = append(out, nl)
+		return nil
+	})
+	return out, err
+}
+
+// ForEachEntry calls `f` for each entry of the directory, in the order of
+// `ListNames`.
+func (d *Directory) ForEachEntry(ctx context.Context, f func(NodeListing) error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		c, err := d.childUnsync(l.Name)
+		if err != nil {
+			return err
+		}
+
+		child, err := nodeListing(l.Name, c)
+		if err != nil {
+			return err
+		}
+
+		return f(child)
+	})
+}
+
+// ListRecursiveOpts is used by ListRecursive
+type ListRecursiveOpts struct {
+	// Leave out directories from the listing (only report files).
+	FilesOnly bool
+}
+
+// ListRecursive lists all the files and directories under this one (see
+// `Walk`). The `Name` of each entry is its path relative to this directory
+// and the listing is sorted by it.
+func (d *Directory) ListRecursive(ctx context.Context, opts ListRecursiveOpts) ([]NodeListing, error) {
+	var out []NodeListing
+	err := Walk(ctx, d, func(path string, nd FSNode) error {
+		if opts.FilesOnly && nd.Type() == TDir {
+			return nil
+		}
+
+		entry, err := nodeListing(path, nd)
+		if err != nil {
+			return err
+		}
+		out = append(out, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// nodeListing builds the `NodeListing` of an FSNode under the given name.
+func nodeListing(name string, c FSNode) (NodeListing, error) {
+	nd, err := flushedNode(c)
+	if err != nil {
+		return NodeListing{}, err
+	}
+
+	child := NodeListing{
+		Name: name,
+		Type: int(c.Type()),
+		Hash: nd.Cid().String(),
+	}
+
+	if c, ok := c.(*File); ok {
+		size, err := c.Size()
+		if err != nil {
+			return NodeListing{}, err
+		}
+		child.Size = size
+	}
+
+	return child, nil
+}
+
+// StructuralHash returns a (SHA2-256) hash of the tree under this
+// directory that only depends on the names, types and contents of its
+// entries: it hashes the sorted (name, type, content hash) tuples of its
+// entries, where the content hash is the multihash of the file node for
+// files and the `StructuralHash` for subdirectories. Unlike the CID of the
+// directory it doesn't depend on the directory representation (basic or
+// HAMT shard) nor its CID builder.
+func (d *Directory) StructuralHash(ctx context.Context) ([]byte, error) {
+	ancestors := make(ancestorSet)
+	leave, _, err := ancestors.enter(d)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return d.structuralHash(ctx, ancestors)
+}
+
+// structuralHash is `StructuralHash` with the directories from the one
+// hashed to this one in `ancestors` (see `Walk`).
+func (d *Directory) structuralHash(ctx context.Context, ancestors ancestorSet) ([]byte, error) {
+	names, err := d.ListNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeField := func(b []byte) {
+		n := binary.PutUvarint(buf, uint64(len(b)))
+		h.Write(buf[:n])
+		h.Write(b)
+	}
+	for _, name := range names {
+		c, err := d.Child(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var contentHash []byte
+		switch c := c.(type) {
+		case *Directory:
+			leave, skip, err := ancestors.enter(c)
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				continue
+			}
+			contentHash, err = c.structuralHash(ctx, ancestors)
+			leave()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			nd, err := flushedNode(c)
+			if err != nil {
+				return nil, err
+			}
+			contentHash = nd.Cid().Hash()
+		}
+
+		writeField([]byte(name))
+		writeField([]byte{byte(c.Type())})
+		writeField(contentHash)
+	}
+	return h.Sum(nil), nil
+}
+
+func (d *Directory) Mkdir(name string) (*Directory, error) {
+	if err := d.validateName(name); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	fsn, err := d.childUnsync(name)
+	if err == nil {
+		switch fsn := fsn.(type) {
+		case *Directory:
+			return fsn, os.ErrExist
+		case *File, *Opaque:
 			return nil, os.ErrExist
 		default:
 			return nil, fmt.Errorf("unrecognized type: %#v", fsn)
 		}
 	}
 
-	ndir := ft.EmptyDirNode()
-	ndir.SetCidBuilder(d.GetCidBuilder())
+	ndir := ft.EmptyDirNode()
+	ndir.SetCidBuilder(d.GetCidBuilder())
+
+	err = d.dagService.Add(d.ctx, ndir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.unixfsAddChild(name, ndir)
+	if err != nil {
+		return nil, err
+	}
+	d.recordOp(OpMkdir, name, ndir.Cid())
+
+	dirobj, err := NewDirectory(d.ctx, name, ndir, d, d.dagService)
+	if err != nil {
+		return nil, err
+	}
+
+	d.entriesCache[name] = dirobj
+	return dirobj, nil
+}
+
+func (d *Directory) Unlink(name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.entriesCache, name)
+
+	if err := d.unixfsRemoveChild(name); err != nil {
+		return err
+	}
+	d.recordOp(OpUnlink, name, cid.Undef)
+	return nil
+}
+
+// UnlinkIfExists removes the entry `name` like `Unlink` but a missing entry
+// isn't an error, allowing idempotent deletes without a racy check first.
+// It returns whether the entry existed (and was removed).
+func (d *Directory) UnlinkIfExists(name string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	exists, err := d.hasEntryUnsync(name)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	delete(d.entriesCache, name)
+
+	if err := d.unixfsRemoveChild(name); err != nil {
+		return false, err
+	}
+	d.recordOp(OpUnlink, name, cid.Undef)
+	return true, nil
+}
+
+// UnlinkReturn removes the entry `name` like `Unlink` but also returns
+// the node it pointed to, which can be used to add it back later (e.g.,
+// to implement an undo).
+func (d *Directory) UnlinkReturn(name string) (ipld.Node, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, err := d.childUnsync(name)
+	if err != nil {
+		return nil, err
+	}
+
+	nd, err := flushedNode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(d.entriesCache, name)
+
+	err = d.unixfsRemoveChild(name)
+	if err != nil {
+		return nil, err
+	}
+	d.recordOp(OpUnlink, name, cid.Undef)
+
+	return nd, nil
+}
+
+// UnlinkMany removes all the given entries from this directory in one
+// operation, returning the names that weren't found. If the directory is a
+// HAMT shard the conversion to a basic directory (if the remaining entries
+// fall below the sharding threshold) is evaluated only once at the end.
+func (d *Directory) UnlinkMany(names []string) ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	hysteresis := optionsOf(d).manualSharding()
+	if hysteresis {
+		if err := d.countEntriesUnsync(d.ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Remove the entries directly from the directory wrapped by the
+	// `DynamicDirectory` to avoid evaluating a conversion for each name.
+	dir := d.innerDir()
+	var missing []string
+	removed := false
+	for _, name := range names {
+		delete(d.entriesCache, name)
+		delete(d.changed, name)
+
+		var oldMetric int
+		if d.entriesCounted {
+			var err error
+			if _, oldMetric, err = d.entryMetricUnsync(name); err != nil {
+				return missing, err
+			}
+		}
+		err := dir.RemoveChild(d.ctx, name)
+		if err == os.ErrNotExist {
+			missing = append(missing, name)
+			continue
+		}
+		if err != nil {
+			return missing, err
+		}
+		removed = true
+		d.dirty = true
+		d.entries--
+		d.metric -= oldMetric
+		d.recordOp(OpUnlink, name, cid.Undef)
+	}
+	if !removed {
+		return missing, nil
+	}
+
+	d.touch()
+	if hysteresis {
+		return missing, d.applyShardHysteresis()
+	}
+	if _, _, err := d.unshardUnsync(d.ctx); err != nil {
+		return missing, err
+	}
+	return missing, nil
+}
+
+// PruneEmpty recursively removes the subdirectories of this directory that
+// don't (transitively) contain any file, that is, empty directories and
+// directories that only contain other empty directories, returning the
+// number of directories removed. This directory itself is never removed.
+//
+// The UnixFS format currently supported has no metadata (mode or
+// modification time) so there is no option to keep directories with
+// metadata set: all the empty ones are pruned.
+func (d *Directory) PruneEmpty(ctx context.Context) (int, error) {
+	names, err := d.ListByType(ctx, TDir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		c, err := d.Child(name)
+		if err != nil {
+			return removed, err
+		}
+		child, ok := c.(*Directory)
+		if !ok {
+			continue
+		}
+
+		n, err := child.PruneEmpty(ctx)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+
+		left, err := child.ListNames(ctx)
+		if err != nil {
+			return removed, err
+		}
+		if len(left) > 0 {
+			continue
+		}
+		if err := d.Unlink(name); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (d *Directory) Flush() error {
+	nd, err := d.flushNode()
+	if err != nil {
+		return err
+	}
+
+	return d.parent.updateChildEntry(child{d.name, nd, d})
+}
+
+// AddChild adds the node 'nd' under this directory giving it the name 'name'
+func (d *Directory) AddChild(name string, nd ipld.Node) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.addChildUnsync(name, nd)
+}
+
+// emptyFileNode returns a node for an empty file, encoded with the
+// `EmptyFileMode` of the root and the CID builder of the directory.
+func (d *Directory) emptyFileNode() (ipld.Node, error) {
+	builder := d.GetCidBuilder()
+	if optionsOf(d).emptyFileMode == EmptyFileRaw {
+		// Raw blocks are always CIDv1, only keep the hash function.
+		prefix := dag.V0CidPrefix()
+		if builder != nil {
+			c, err := builder.Sum(nil)
+			if err != nil {
+				return nil, err
+			}
+			prefix = c.Prefix()
+		}
+		return dag.NewRawNodeWPrefix(nil, cid.V1Builder{
+			Codec:    cid.Raw,
+			MhType:   prefix.MhType,
+			MhLength: prefix.MhLength,
+		})
+	}
+
+	nd := ft.EmptyFileNode()
+	if builder != nil {
+		nd.SetCidBuilder(builder)
+	}
+	return nd, nil
+}
+
+// AddRawChild adds the node 'nd' under this directory giving it the
+// name 'name' as `AddChild`, documenting that `nd` can be any IPLD node:
+// if it isn't UnixFS the entry is returned by `Child` (and `Lookup`) as an
+// `Opaque` node instead of being interpreted as a file or directory.
+func (d *Directory) AddRawChild(name string, nd ipld.Node) error {
+	return d.AddChild(name, nd)
+}
+
+// AddChildCid adds an entry `name` linking to the CID `c` with the
+// cumulative size `size`, without fetching (nor decoding) the node, which
+// doesn't even need to be in the DAG service yet (e.g., when assembling a
+// tree from blocks still being received). The node isn't validated: if it
+// never arrives the link is dangling, which `Root.FindDangling` reports.
+// The type of the entry is only known when it's first accessed. While the
+// node is missing from the DAG service the directory can't be converted
+// from a basic directory to a HAMT shard (which needs the nodes of all its
+// entries), so an addition that would shard it fails.
+func (d *Directory) AddChildCid(name string, c cid.Cid, size uint64) error {
+	if err := d.validateName(name); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	exists, err := d.hasEntryUnsync(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrDirExists
+	}
+
+	if err := d.unixfsAddChild(name, &linkNode{c: c, size: size}); err != nil {
+		return err
+	}
+	d.touch()
+	d.recordOp(OpAdd, name, c)
+	return nil
+}
+
+// linkNode stands for a node only known by its CID and cumulative size
+// (see `AddChildCid`): it's only used to create the link to it. It has no
+// data nor links and the methods of `ipld.Node` that need the contents of
+// the node return `ErrNotYetImplemented`.
+type linkNode struct {
+	c    cid.Cid
+	size uint64
+}
+
+func (n *linkNode) Cid() cid.Cid          { return n.c }
+func (n *linkNode) Size() (uint64, error) { return n.size, nil }
+func (n *linkNode) String() string        { return n.c.String() }
+func (n *linkNode) Links() []*ipld.Link   { return nil }
+func (n *linkNode) RawData() []byte       { return nil }
+func (n *linkNode) Copy() ipld.Node       { return &linkNode{c: n.c, size: n.size} }
+
+func (n *linkNode) Loggable() map[string]interface{} {
+	return map[string]interface{}{"node": n.c.String()}
+}
+
+func (n *linkNode) Resolve(path []string) (interface{}, []string, error) {
+	return nil, nil, ErrNotYetImplemented
+}
+
+func (n *linkNode) ResolveLink(path []string) (*ipld.Link, []string, error) {
+	return nil, nil, ErrNotYetImplemented
+}
+
+func (n *linkNode) Tree(path string, depth int) []string { return nil }
+
+func (n *linkNode) Stat() (*ipld.NodeStat, error) {
+	return nil, ErrNotYetImplemented
+}
+
+// linkSkippingDAGService ignores the `linkNode`s added (HAMT shards add the
+// nodes linked from them), the nodes they stand for are added by other
+// means.
+type linkSkippingDAGService struct {
+	ipld.DAGService
+}
+
+// skipLinkNodes wraps `ds` (if not already wrapped) to ignore `linkNode`s.
+func skipLinkNodes(ds ipld.DAGService) ipld.DAGService {
+	if _, ok := ds.(*linkSkippingDAGService); ok || ds == nil {
+		return ds
+	}
+	return &linkSkippingDAGService{ds}
+}
+
+func (ds *linkSkippingDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	if _, ok := nd.(*linkNode); ok {
+		return nil
+	}
+	return ds.DAGService.Add(ctx, nd)
+}
+
+func (ds *linkSkippingDAGService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	filtered := nds[:0:0]
+	for _, nd := range nds {
+		if _, ok := nd.(*linkNode); !ok {
+			filtered = append(filtered, nd)
+		}
+	}
+	return ds.DAGService.AddMany(ctx, filtered)
+}
+
+// NamedNode is an entry to add with `AddChildrenTx`.
+type NamedNode struct {
+	Name string
+	Node ipld.Node
+}
+
+// AddChildrenError is returned by `AddChildrenTx` when some of the entries
+// are invalid, with the error of each of them by name.
+type AddChildrenError struct {
+	Errs map[string]error
+}
+
+func (e *AddChildrenError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%q: %s", name, e.Errs[name])
+	}
+	return fmt.Sprintf("%d invalid entries: %s", len(names), strings.Join(msgs, "; "))
+}
+
+// AddChildrenTx adds all the `entries` to this directory or none of
+// them: every entry is validated first (its name, which must be unique in
+// `entries` and not already present in the directory, and its node, which
+// must be a UnixFS file or directory) and if any of them is invalid an
+// `*AddChildrenError` with all the failures is returned and the directory
+// is left untouched. If adding an entry fails afterwards (e.g., writing to
+// the DAG service) the entries already added are removed again.
+func (d *Directory) AddChildrenTx(entries []NamedNode) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	errs := make(map[string]error)
+	seen := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		if _, ok := seen[e.Name]; ok {
+			errs[e.Name] = ErrDuplicateLink
+			continue
+		}
+		seen[e.Name] = struct{}{}
+
+		if err := d.validateName(e.Name); err != nil {
+			errs[e.Name] = err
+			continue
+		}
+		if e.Node == nil {
+			errs[e.Name] = ErrInvalidChild
+			continue
+		}
+		if t, _ := unixfsKind(e.Node); t == TRaw {
+			errs[e.Name] = ErrInvalidChild
+			continue
+		}
+		if err := d.validateSubtree(e.Node); err != nil {
+			errs[e.Name] = err
+			continue
+		}
+		exists, err := d.hasEntryUnsync(e.Name)
+		if err != nil {
+			errs[e.Name] = err
+		} else if exists {
+			errs[e.Name] = ErrDirExists
+		}
+	}
+	if len(errs) > 0 {
+		return &AddChildrenError{Errs: errs}
+	}
+
+	for i, e := range entries {
+		err := d.dagService.Add(d.ctx, e.Node)
+		if err == nil {
+			err = d.unixfsAddChild(e.Name, e.Node)
+		}
+		if err != nil {
+			for _, added := range entries[:i] {
+				if rerr := d.unixfsRemoveChild(added.Name); rerr != nil {
+					log.Errorf("rolling back the addition of %q: %s", added.Name, rerr)
+				}
+			}
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		d.touch()
+	}
+	for _, e := range entries {
+		d.recordOp(OpAdd, e.Name, e.Node.Cid())
+	}
+	return nil
+}
+
+// TryAddChild is a best-effort, non-blocking version of `AddChild`: if the
+// directory lock is currently held it returns `false` without adding the
+// entry (the caller may retry or defer the write), otherwise it adds it as
+// `AddChild` and returns `true`. A successful attempt only means the lock
+// was free at that moment, the write itself may still block in the DAG
+// service.
+func (d *Directory) TryAddChild(name string, nd ipld.Node) (bool, error) {
+	if !d.lock.TryLock() {
+		return false, nil
+	}
+	defer d.lock.Unlock()
+	return true, d.addChildUnsync(name, nd)
+}
+
+// CopyChild adds the node of the entry `existingName` under `newName` as
+// well. Nodes are content-addressed so this only adds a link to the same
+// node (nothing is copied nor re-encoded), later changes to either entry
+// don't affect the other. It returns `os.ErrNotExist` if `existingName`
+// doesn't exist and `ErrDirExists` if `newName` already does (unless
+// `WithOverwrite` is passed, in which case it's replaced).
+func (d *Directory) CopyChild(existingName, newName string, opts ...CopyOption) error {
+	var copyOpts copyOptions
+	for _, opt := range opts {
+		opt(&copyOpts)
+	}
+
+	if err := d.validateName(newName); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, err := d.childUnsync(existingName)
+	if err != nil {
+		return err
+	}
+	nd, err := flushedNode(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.childUnsync(newName); err == nil {
+		if !copyOpts.overwrite {
+			return ErrDirExists
+		}
+		if newName == existingName {
+			return nil
+		}
+		delete(d.entriesCache, newName)
+	} else if err != os.ErrNotExist {
+		return err
+	}
+
+	if err := d.dagService.Add(d.ctx, nd); err != nil {
+		return err
+	}
+	if err := d.unixfsAddChild(newName, nd); err != nil {
+		return err
+	}
+
+	d.touch()
+	d.recordOp(OpAdd, newName, nd.Cid())
+	return nil
+}
+
+// SwapChildren exchanges the nodes of the entries `nameA` and `nameB`
+// under one lock, so no other operation sees the directory with only one
+// of them replaced. Both entries must exist (otherwise nothing changes).
+// The `File` and `Directory` objects previously obtained for them are
+// bound to their former name and must not be used afterwards.
+func (d *Directory) SwapChildren(nameA, nameB string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	a, err := d.childUnsync(nameA)
+	if err != nil {
+		return err
+	}
+	b, err := d.childUnsync(nameB)
+	if err != nil {
+		return err
+	}
+	if nameA == nameB {
+		return nil
+	}
+	ndA, err := flushedNode(a)
+	if err != nil {
+		return err
+	}
+	ndB, err := flushedNode(b)
+	if err != nil {
+		return err
+	}
+
+	delete(d.entriesCache, nameA)
+	delete(d.entriesCache, nameB)
+	if err := d.unixfsAddChild(nameA, ndB); err != nil {
+		return err
+	}
+	if err := d.unixfsAddChild(nameB, ndA); err != nil {
+		if rerr := d.unixfsAddChild(nameA, ndA); rerr != nil {
+			log.Errorf("failed to restore %q after a failed swap: %s", nameA, rerr)
+		}
+		return err
+	}
+
+	d.touch()
+	d.recordOp(OpAdd, nameA, ndB.Cid())
+	d.recordOp(OpAdd, nameB, ndA.Cid())
+	return nil
+}
+
+// MoveChild moves the entry `name` into the directory at `destRelPath`
+// (relative to this one), keeping its name. Both directories are locked
+// while the entry is added to the destination and then removed from here,
+// so it's never missing from both (nor seen in both by other operations
+// on them). It returns `ErrDirExists` if the destination already has an
+// entry with that name and `ErrNotDir` if the destination path isn't a
+// directory, missing directories are created only with
+// `WithMoveMkparents`. The path is cleaned first (resolving `.` and `..`)
+// and one that would leave this directory returns `ErrInvalidName`
+// (wrapped). An entry can't be moved into itself.
+func (d *Directory) MoveChild(name, destRelPath string, opts ...MoveOption) error {
+	var moveOpts moveOptions
+	for _, opt := range opts {
+		opt(&moveOpts)
+	}
+
+	clean := path.Clean(destRelPath)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("%w: %q is outside of the directory", ErrInvalidName, destRelPath)
+	}
+	parts := strings.FieldsFunc(clean, func(r rune) bool { return r == '/' })
+	if len(parts) == 1 && parts[0] == "." {
+		parts = nil
+	}
+	if len(parts) > 0 && parts[0] == name {
+		return fmt.Errorf("cannot move %q into itself", name)
+	}
+	if _, err := d.Child(name); err != nil {
+		return err
+	}
+
+	dest := d
+	for _, p := range parts {
+		fsn, err := dest.Child(p)
+		if err == os.ErrNotExist && moveOpts.mkparents {
+			fsn, err = dest.Mkdir(p)
+			if err == os.ErrExist && fsn != nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		next, ok := fsn.(*Directory)
+		if !ok {
+			return ErrNotDir
+		}
+		dest = next
+	}
+	if dest == d {
+		return nil
+	}
+
+	// Lock the ancestor first as when syncing entries.
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	dest.lock.Lock()
+	defer dest.lock.Unlock()
+
+	c, err := d.childUnsync(name)
+	if err != nil {
+		return err
+	}
+	nd, err := flushedNode(c)
+	if err != nil {
+		return err
+	}
+	if err := dest.addChildUnsync(name, nd); err != nil {
+		return err
+	}
+
+	delete(d.entriesCache, name)
+	if err := d.unixfsRemoveChild(name); err != nil {
+		return err
+	}
+	d.touch()
+	d.recordOp(OpUnlink, name, cid.Undef)
+	return nil
+}
+
+// addChildUnsync is the non-locking version of `AddChild`.
+func (d *Directory) addChildUnsync(name string, nd ipld.Node) error {
+	if err := d.validateName(name); err != nil {
+		return err
+	}
+	if err := d.validateSubtree(nd); err != nil {
+		return err
+	}
+
+	_, err := d.childUnsync(name)
+	if err == nil {
+		return ErrDirExists
+	}
+
+	err = d.dagService.Add(d.ctx, nd)
+	if err != nil {
+		return err
+	}
+
+	err = d.unixfsAddChild(name, nd)
+	if err != nil {
+		return err
+	}
+
+	d.touch()
+	d.recordOp(OpAdd, name, nd.Cid())
+	return nil
+}
+
+// unshard converts this directory into a basic (single node) directory if
+// it is currently a HAMT shard whose entries no longer reach the sharding
+// threshold (`uio.HAMTShardingSize`). It reports if the directory was
+// converted and the difference in bytes between the blocks of the shard
+// and the new basic directory node.
+func (d *Directory) unshard(ctx context.Context) (bool, int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.unshardUnsync(ctx)
+}
+
+// unshardUnsync is the non-locking version of `unshard`.
+func (d *Directory) unshardUnsync(ctx context.Context) (bool, int64, error) {
+	if uio.HAMTShardingSize == 0 || d.shardPinned {
+		// Sharding is not automatic so any shard was created on purpose.
+		return false, 0, nil
+	}
+
+	err := d.sync()
+	if err != nil {
+		return false, 0, err
+	}
 
-	err = d.dagService.Add(d.ctx, ndir)
+	nd, err := d.unixfsDir.GetNode()
 	if err != nil {
-		return nil, err
+		return false, 0, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return false, 0, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return false, 0, err
+	}
+	if fsn.Type() != ft.THAMTShard {
+		return false, 0, nil
 	}
 
-	err = d.unixfsDir.AddChild(d.ctx, name, ndir)
+	basic := ft.EmptyDirNode()
+	basic.SetCidBuilder(d.unixfsDir.GetCidBuilder())
+	estimatedSize := 0
+	err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		estimatedSize += len(l.Name) + l.Cid.ByteLen()
+		if estimatedSize >= uio.HAMTShardingSize {
+			return errShardAboveThreshold
+		}
+		return basic.AddRawLink(l.Name, l)
+	})
+	if err == errShardAboveThreshold {
+		return false, 0, nil
+	}
 	if err != nil {
-		return nil, err
+		return false, 0, err
 	}
 
-	dirobj, err := NewDirectory(d.ctx, name, ndir, d, d.dagService)
+	shardSize, err := shardBlocksSize(ctx, d.dagService, pbnd, fsn.Fanout())
 	if err != nil {
-		return nil, err
+		return false, 0, err
 	}
 
-	d.entriesCache[name] = dirobj
-	return dirobj, nil
+	err = d.dagService.Add(ctx, basic)
+	if err != nil {
+		return false, 0, err
+	}
+	db, err := uio.NewDirectoryFromNode(d.dagService, basic)
+	if err != nil {
+		return false, 0, err
+	}
+	d.unixfsDir = db
+	d.conversions++
+	d.setStored(basic)
+	d.touch()
+
+	return true, int64(shardSize) - int64(len(basic.RawData())), nil
 }
 
-func (d *Directory) Unlink(name string) error {
+var errShardAboveThreshold = errors.New("shard above sharding threshold")
+
+// ConversionCount returns the number of times this directory (since it
+// was loaded) was converted between the basic and HAMT shard
+// representations, a count growing with the number of operations signals
+// it's thrashing around the sharding threshold (see `WithShardHysteresis`).
+func (d *Directory) ConversionCount() int {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	return d.conversions
+}
 
-	delete(d.entriesCache, name)
+// innerDir returns the UnixFS directory wrapped by the `DynamicDirectory`,
+// which doesn't convert itself between the basic and HAMT representations.
+func (d *Directory) innerDir() uio.Directory {
+	if dyn, ok := d.unixfsDir.(*uio.DynamicDirectory); ok {
+		return dyn.Directory
+	}
+	return d.unixfsDir
+}
 
-	return d.unixfsDir.RemoveChild(d.ctx, name)
+func (d *Directory) isShardedUnsync() bool {
+	_, ok := d.innerDir().(*uio.HAMTDirectory)
+	return ok
 }
 
-func (d *Directory) Flush() error {
-	nd, err := d.GetNode()
+// unixfsAddChild adds (or replaces) the entry `name` in the UnixFS
+// directory, converting it to a HAMT shard (or back) as needed.
+func (d *Directory) unixfsAddChild(name string, nd ipld.Node) error {
+	d.dirty = true
+	if d.changed == nil {
+		d.changed = make(map[string]struct{})
+	}
+	d.changed[name] = struct{}{}
+	hysteresis := optionsOf(d).manualSharding()
+	if hysteresis {
+		if err := d.countEntriesUnsync(d.ctx); err != nil {
+			return err
+		}
+	}
+	// The entries are only tracked once counted.
+	exists := true
+	var oldMetric int
+	if d.entriesCounted {
+		var err error
+		exists, oldMetric, err = d.entryMetricUnsync(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hysteresis && !d.shardPinned {
+		sharded := d.isShardedUnsync()
+		err := d.unixfsDir.AddChild(d.ctx, name, nd)
+		if d.isShardedUnsync() != sharded {
+			d.conversions++
+		}
+		if err != nil {
+			return err
+		}
+		return d.trackAddUnsync(name, nd, exists, oldMetric)
+	}
+
+	if err := d.innerDir().AddChild(d.ctx, name, nd); err != nil {
+		return err
+	}
+	if err := d.trackAddUnsync(name, nd, exists, oldMetric); err != nil {
+		return err
+	}
+	return d.applyShardHysteresis()
+}
+
+// trackAddUnsync updates the tracked entries and sharding metric (if
+// counted) after adding the entry `name`, which replaced an entry with
+// the metric `oldMetric` if it `existed`.
+func (d *Directory) trackAddUnsync(name string, nd ipld.Node, existed bool, oldMetric int) error {
+	if !d.entriesCounted {
+		return nil
+	}
+	if !existed {
+		d.entries++
+	}
+	mode := optionsOf(d).shardingMode
+	if mode == ShardingByCount {
+		return nil
+	}
+	l, err := ipld.MakeLink(nd)
 	if err != nil {
 		return err
 	}
+	l.Name = name
+	d.metric += linkMetric(mode, l) - oldMetric
+	return nil
+}
+
+// unixfsRemoveChild is the `unixfsAddChild` counterpart for removals.
+func (d *Directory) unixfsRemoveChild(name string) error {
+	d.dirty = true
+	delete(d.changed, name)
+	hysteresis := optionsOf(d).manualSharding()
+	if hysteresis {
+		if err := d.countEntriesUnsync(d.ctx); err != nil {
+			return err
+		}
+	}
+	var oldMetric int
+	if d.entriesCounted {
+		var err error
+		if _, oldMetric, err = d.entryMetricUnsync(name); err != nil {
+			return err
+		}
+	}
+
+	if !hysteresis && !d.shardPinned {
+		sharded := d.isShardedUnsync()
+		err := d.unixfsDir.RemoveChild(d.ctx, name)
+		if d.isShardedUnsync() != sharded {
+			d.conversions++
+		}
+		if err == nil && d.entriesCounted {
+			d.entries--
+			d.metric -= oldMetric
+		}
+		return err
+	}
 
-	return d.parent.updateChildEntry(child{d.name, nd})
+	if err := d.innerDir().RemoveChild(d.ctx, name); err != nil {
+		return err
+	}
+	if d.entriesCounted {
+		d.entries--
+		d.metric -= oldMetric
+	}
+	return d.applyShardHysteresis()
 }
 
-// AddChild adds the node 'nd' under this directory giving it the name 'name'
-func (d *Directory) AddChild(name string, nd ipld.Node) error {
+// hasEntryUnsync reports if the directory has an entry `name`.
+func (d *Directory) hasEntryUnsync(name string) (bool, error) {
+	if _, ok := d.entriesCache[name]; ok {
+		return true, nil
+	}
+	_, err := d.linkCidUnsync(name)
+	switch err {
+	case os.ErrNotExist:
+		return false, nil
+	case ipld.ErrNotFound:
+		// HAMT shards fetch the node of the entry, which isn't in the
+		// DAG service (e.g., see `AddChildCid`).
+		return true, nil
+	}
+	return err == nil, err
+}
+
+// entryMetricUnsync reports if the directory has an entry `name` and its
+// contribution to the sharding metric (see `linkMetric`), which is unknown
+// (zero) for the entries of HAMT shards whose node isn't in the DAG
+// service.
+func (d *Directory) entryMetricUnsync(name string) (bool, int, error) {
+	mode := optionsOf(d).shardingMode
+	if mode == ShardingByCount {
+		exists, err := d.hasEntryUnsync(name)
+		return exists, 0, err
+	}
+
+	var l *ipld.Link
+	if basic, ok := d.innerDir().(*uio.BasicDirectory); ok {
+		nd, err := basic.GetNode()
+		if err != nil {
+			return false, 0, err
+		}
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return false, 0, dag.ErrNotProtobuf
+		}
+		l, err = pbnd.GetNodeLink(name)
+		if err == dag.ErrLinkNotFound {
+			return false, 0, nil
+		}
+		if err != nil {
+			return false, 0, err
+		}
+	} else {
+		nd, err := d.unixfsDir.Find(d.ctx, name)
+		switch err {
+		case nil:
+		case os.ErrNotExist:
+			return false, 0, nil
+		case ipld.ErrNotFound:
+			return true, 0, nil
+		default:
+			return false, 0, err
+		}
+		if l, err = ipld.MakeLink(nd); err != nil {
+			return false, 0, err
+		}
+		l.Name = name
+	}
+	return true, linkMetric(mode, l), nil
+}
+
+// basicDirSize is the size of a serialized basic directory node without
+// entries.
+var basicDirSize = len(ft.EmptyDirNode().RawData())
+
+// linkMetric returns the contribution of the link of an entry to the
+// sharding metric `mode` (other than `ShardingByCount`): the size of the
+// encoded link for `ShardingBySize` or the lengths of its name and CID
+// for `ShardingDefault`.
+func linkMetric(mode ShardingMode, l *ipld.Link) int {
+	if mode != ShardingBySize {
+		return len(l.Name) + l.Cid.ByteLen()
+	}
+	// Fields (tag, length and bytes) of the hash, name and size in the
+	// link, itself a field of the node.
+	field := func(n int) int { return 1 + uvarintSize(uint64(n)) + n }
+	return field(field(l.Cid.ByteLen()) + field(len(l.Name)) + 1 + uvarintSize(l.Size))
+}
+
+// uvarintSize returns the length of the varint encoding of `v`.
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// countEntriesUnsync counts the entries of the directory and computes its
+// sharding metric (once, from then on both are updated by each operation
+// until the node is replaced).
+func (d *Directory) countEntriesUnsync(ctx context.Context) error {
+	if d.entriesCounted {
+		return nil
+	}
+	mode := optionsOf(d).shardingMode
+	d.entries = 0
+	d.metric = 0
+	if mode == ShardingBySize {
+		d.metric = basicDirSize
+	}
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		d.entries++
+		if mode != ShardingByCount {
+			d.metric += linkMetric(mode, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.entriesCounted = true
+	return nil
+}
+
+// ShardingMetric returns the current value of the metric compared against
+// the sharding threshold to decide the representation of this directory
+// (see `WithShardingMode`).
+func (d *Directory) ShardingMetric() (int, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	return d.shardingMetricUnsync()
+}
 
-	_, err := d.childUnsync(name)
-	if err == nil {
-		return ErrDirExists
+// shardingMetricUnsync is the non-locking version of `ShardingMetric`.
+// The metric is computed once and then updated with each operation.
+func (d *Directory) shardingMetricUnsync() (int, error) {
+	if err := d.countEntriesUnsync(d.ctx); err != nil {
+		return 0, err
 	}
+	if optionsOf(d).shardingMode == ShardingByCount {
+		return d.entries, nil
+	}
+	return d.metric, nil
+}
 
-	err = d.dagService.Add(d.ctx, nd)
+// basicNodeUnsync returns a basic directory node with the entries of the
+// directory.
+func (d *Directory) basicNodeUnsync() (*dag.ProtoNode, error) {
+	basic := ft.EmptyDirNode()
+	basic.SetCidBuilder(d.unixfsDir.GetCidBuilder())
+	err := d.unixfsDir.ForEachLink(d.ctx, func(l *ipld.Link) error {
+		return basic.AddRawLink(l.Name, l)
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return basic, nil
+}
+
+// applyShardHysteresis converts the directory to a HAMT shard when it
+// reaches the shard-up number of entries and back to a basic directory
+// when it falls below the shard-down one (see `WithShardHysteresis`).
+// Without hysteresis the sharding metric is compared against the
+// threshold of `WithShardingMode` instead.
+func (d *Directory) applyShardHysteresis() error {
+	if d.shardPinned {
+		return nil
+	}
+	opts := optionsOf(d)
+	sharded := d.isShardedUnsync()
+	if opts.shardUp > 0 {
+		if !sharded && d.entries < opts.shardUp || sharded && d.entries >= opts.shardDown {
+			return nil
+		}
+	} else {
+		threshold := opts.shardingThreshold
+		if threshold == 0 {
+			threshold = uio.HAMTShardingSize
+		}
+		if threshold == 0 {
+			return nil
+		}
+		metric, err := d.shardingMetricUnsync()
+		if err != nil {
+			return err
+		}
+		if !sharded && metric < threshold || sharded && metric >= threshold {
+			return nil
+		}
+	}
+	return d.convertUnsync(d.ctx, !sharded)
+}
+
+// convertUnsync converts the directory to a HAMT shard (`toShard`) or to a
+// basic directory, storing the new node.
+func (d *Directory) convertUnsync(ctx context.Context, toShard bool) error {
+	var nd ipld.Node
+	if !toShard {
+		basic, err := d.basicNodeUnsync()
+		if err != nil {
+			return err
+		}
+		if err := d.dagService.Add(ctx, basic); err != nil {
+			return err
+		}
+		nd = basic
+	} else {
+		shard, err := hamt.NewShard(d.dagService, uio.DefaultShardWidth)
+		if err != nil {
+			return err
+		}
+		shard.SetCidBuilder(d.unixfsDir.GetCidBuilder())
+		// The shard (like the `DynamicDirectory`) needs the nodes of the
+		// entries to add them.
+		err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+			child, err := d.dagService.Get(ctx, l.Cid)
+			if err != nil {
+				return err
+			}
+			return shard.Set(ctx, l.Name, child)
+		})
+		if err != nil {
+			return err
+		}
+		// `Node` stores the shard nodes.
+		nd, err = shard.Node()
+		if err != nil {
+			return err
+		}
 	}
 
-	err = d.unixfsDir.AddChild(d.ctx, name, nd)
+	db, err := uio.NewDirectoryFromNode(d.dagService, nd)
 	if err != nil {
 		return err
 	}
-
-	d.modTime = time.Now()
+	d.unixfsDir = db
+	d.conversions++
+	d.setStored(nd)
 	return nil
 }
 
+// setSharded converts the directory to a HAMT shard (`sharded`) or to a
+// basic directory if it isn't one already and fixes that representation
+// (see `Root.SetRootSharded`). It reports if the directory was converted.
+func (d *Directory) setSharded(ctx context.Context, sharded bool) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.isShardedUnsync() == sharded {
+		d.shardPinned = true
+		return false, nil
+	}
+	if err := d.sync(); err != nil {
+		return false, err
+	}
+	if err := d.convertUnsync(ctx, sharded); err != nil {
+		return false, err
+	}
+	d.shardPinned = true
+	d.touch()
+	return true, nil
+}
+
+// shardBlocksSize returns the total size of the blocks that make up the
+// HAMT shard `nd` (not including the entries it points to).
+func shardBlocksSize(ctx context.Context, ds ipld.DAGService, nd *dag.ProtoNode, fanout uint64) (uint64, error) {
+	// Links to other shard nodes only carry the (fixed length) hex prefix
+	// of the bucket, entries have the prefix followed by the name.
+	prefixLen := len(fmt.Sprintf("%X", fanout-1))
+
+	size := uint64(len(nd.RawData()))
+	for _, l := range nd.Links() {
+		if len(l.Name) != prefixLen {
+			continue
+		}
+		child, err := l.GetNode(ctx, ds)
+		if err != nil {
+			return 0, err
+		}
+		pbchild, ok := child.(*dag.ProtoNode)
+		if !ok {
+			return 0, dag.ErrNotProtobuf
+		}
+		childSize, err := shardBlocksSize(ctx, ds, pbchild, fanout)
+		if err != nil {
+			return 0, err
+		}
+		size += childSize
+	}
+	return size, nil
+}
+
 func (d *Directory) sync() error {
+	return d.syncWith(d.dagService)
+}
+
+// syncWith is `sync` storing the nodes of the cached child directories
+// through `add`.
+func (d *Directory) syncWith(add ipld.NodeAdder) error {
 	for name, entry := range d.entriesCache {
-		nd, err := entry.GetNode()
+		var nd ipld.Node
+		var err error
+		if dir, ok := entry.(*Directory); ok {
+			nd, err = dir.getNode(add)
+		} else {
+			nd, err = flushedNode(entry)
+		}
 		if err != nil {
 			return err
 		}
 
-		err = d.updateChild(child{name, nd})
-		if err != nil {
-			return err
+		// Only the entries linking to another node changed (the linked
+		// CID can't always be read, e.g. from a shard whose entries aren't
+		// in the DAG service, then the entry is updated anyway).
+		if linked, err := d.linkCidUnsync(name); err != nil || !linked.Equals(nd.Cid()) {
+			if err := d.updateChild(child{name, nd, nil}); err != nil {
+				return err
+			}
+		}
+		if fi, ok := entry.(*File); ok {
+			fi.setLinked(nd.Cid())
 		}
 	}
 
@@ -404,11 +2311,65 @@ func (d *Directory) Path() string {
 	return out
 }
 
+// GetNode returns the node of the directory, syncing its cached entries
+// and storing it in the DAG service first (a flush of the directory that
+// doesn't update its parent). On a root created
+// `WithGetNodeFlush(false)` it behaves like `GetNodeNoFlush` instead.
 func (d *Directory) GetNode() (ipld.Node, error) {
+	if optionsOf(d).getNodeNoFlush {
+		return d.GetNodeNoFlush()
+	}
+	return d.getNode(d.dagService)
+}
+
+// GetNodeNoFlush returns the node of the directory as it was last stored,
+// without modifying the directory or the DAG service. It returns
+// `ErrNotFlushed` if the directory (or anything under it, including files
+// open for writing) has changed since.
+func (d *Directory) GetNodeNoFlush() (ipld.Node, error) {
+	if r := rootOf(d.parent); r != nil && r.HasOpenWriterUnder(d.Path()) {
+		return nil, ErrNotFlushed
+	}
+	dirty, stored, err := d.estimateFlush(&FlushEstimate{})
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, ErrNotFlushed
+	}
+
+	// The node of a basic directory is at hand (and may not have been added
+	// to the DAG service, e.g., the node of `NewRoot`), shards are fetched.
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if basic, ok := d.innerDir().(*uio.BasicDirectory); ok {
+		nd, err := basic.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		if nd.Cid().Equals(stored) {
+			return nd.Copy(), nil
+		}
+	}
+	return d.dagService.Get(d.ctx, stored)
+}
 
-	err := d.sync()
+// flushedNode returns the node of `fsn`, syncing it first if it's a
+// directory regardless of `WithGetNodeFlush`.
+func flushedNode(fsn FSNode) (ipld.Node, error) {
+	if d, ok := fsn.(*Directory); ok {
+		return d.getNode(d.dagService)
+	}
+	return fsn.GetNode()
+}
+
+// getNode is `GetNode` storing the nodes of the directory (and of its
+// cached child directories) through `add`.
+func (d *Directory) getNode(add ipld.NodeAdder) (ipld.Node, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := d.syncWith(add)
 	if err != nil {
 		return nil, err
 	}
@@ -418,10 +2379,117 @@ func (d *Directory) GetNode() (ipld.Node, error) {
 		return nil, err
 	}
 
-	err = d.dagService.Add(d.ctx, nd)
+	err = add.Add(d.ctx, nd)
 	if err != nil {
 		return nil, err
 	}
+	d.setStored(nd)
 
 	return nd.Copy(), err
 }
+
+// estimateFlush adds to `est` the directories under this one (included)
+// that need to be stored to flush it, which are the ones that changed
+// since they were last stored and their parents, as the entries of the
+// parent need to link to the new nodes. It returns if this directory needs
+// to be stored and the CID of its last stored node.
+func (d *Directory) estimateFlush(est *FlushEstimate) (bool, cid.Cid, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dirty := d.dirty
+	for name, entry := range d.entriesCache {
+		var stored cid.Cid
+		switch entry := entry.(type) {
+		case *Directory:
+			childDirty, c, err := entry.estimateFlush(est)
+			if err != nil {
+				return false, cid.Undef, err
+			}
+			if childDirty {
+				dirty = true
+				continue
+			}
+			stored = c
+		default:
+			nd, err := flushedNode(entry)
+			if err != nil {
+				return false, cid.Undef, err
+			}
+			stored = nd.Cid()
+		}
+		if dirty {
+			continue
+		}
+
+		linked, err := d.linkCidUnsync(name)
+		if err != nil && err != os.ErrNotExist {
+			return false, cid.Undef, err
+		}
+		dirty = !linked.Equals(stored)
+	}
+
+	if dirty {
+		size := d.storedSize
+		if basic, ok := d.innerDir().(*uio.BasicDirectory); ok {
+			nd, err := basic.GetNode()
+			if err != nil {
+				return false, cid.Undef, err
+			}
+			size = len(nd.RawData())
+		}
+		est.DirtyNodes++
+		est.EstimatedBytes += uint64(size)
+	}
+	return dirty, d.stored, nil
+}
+
+// linkCidUnsync returns the CID linked under `name` in the UnixFS
+// directory, reading it from the node of basic directories (without
+// fetching the entry as `Find` does).
+func (d *Directory) linkCidUnsync(name string) (cid.Cid, error) {
+	if basic, ok := d.innerDir().(*uio.BasicDirectory); ok {
+		nd, err := basic.GetNode()
+		if err != nil {
+			return cid.Undef, err
+		}
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return cid.Undef, dag.ErrNotProtobuf
+		}
+		l, err := pbnd.GetNodeLink(name)
+		if err == dag.ErrLinkNotFound {
+			return cid.Undef, os.ErrNotExist
+		}
+		if err != nil {
+			return cid.Undef, err
+		}
+		return l.Cid, nil
+	}
+
+	nd, err := d.unixfsDir.Find(d.ctx, name)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// flushNode is `GetNode` storing all the nodes of the flushed tree in
+// batches when configured with `WithFlushBatchSize`, the returned node is
+// the same either way.
+func (d *Directory) flushNode() (ipld.Node, error) {
+	size := optionsOf(d).flushBatchSize
+	if size <= 0 {
+		return flushedNode(d)
+	}
+
+	b := ipld.NewBatch(d.ctx, d.dagService, ipld.MaxNodesBatchOption(size))
+	nd, err := d.getNode(b)
+	if cerr := b.Commit(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
@@ -0,0 +1,208 @@
+package mfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// DumpOption configures optional behavior of `Root.DumpJSON`.
+type DumpOption func(*dumpOptions)
+
+type dumpOptions struct {
+	maxDepth int
+}
+
+// WithDumpMaxDepth limits the dump to `depth` levels of directories below
+// the root (1 only lists the entries of the root): the directories at the
+// limit are dumped without their `children`. Zero (the default) dumps the
+// whole tree.
+func WithDumpMaxDepth(depth int) DumpOption {
+	return func(o *dumpOptions) {
+		o.maxDepth = depth
+	}
+}
+
+// dumpEntry is the JSON object of a node written by `DumpJSON`, without
+// its children (which are streamed after it).
+type dumpEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Cid  string `json:"cid"`
+	Size uint64 `json:"size"`
+}
+
+// newDumpEntry returns the entry of the node `fsn` named `name`.
+func newDumpEntry(name string, fsn FSNode) (dumpEntry, error) {
+	nd, err := flushedNode(fsn)
+	if err != nil {
+		return dumpEntry{}, err
+	}
+	entry := dumpEntry{
+		Name: name,
+		Type: dumpType(fsn.Type()),
+		Cid:  nd.Cid().String(),
+	}
+	if fi, ok := fsn.(*File); ok {
+		var size int64
+		size, err = fi.Size()
+		entry.Size = uint64(size)
+	} else {
+		entry.Size, err = nd.Size()
+	}
+	return entry, err
+}
+
+// dumpType returns the `type` of the JSON entries of the nodes of type `t`.
+func dumpType(t NodeType) string {
+	switch t {
+	case TDir:
+		return "directory"
+	case TFile:
+		return "file"
+	default:
+		return "raw"
+	}
+}
+
+// DumpJSON writes to `w` a nested JSON object describing the tree: every
+// node has its `name`, `type` ("file", "directory" or "raw" for `Opaque`
+// nodes), `cid` and `size` (the size of the contents for files and of the
+// whole DAG for directories and opaque nodes) and directories have the
+// list of their `children`, sorted by name. The JSON is encoded while
+// walking the tree, without building it in memory first.
+func (kr *Root) DumpJSON(ctx context.Context, w io.Writer, opts ...DumpOption) error {
+	var o dumpOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ancestors := make(ancestorSet)
+	leave, _, err := ancestors.enter(kr.GetDirectory())
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	bw := bufio.NewWriter(w)
+	if err := dumpNode(ctx, bw, "/", kr.GetDirectory(), 0, o.maxDepth, ancestors); err != nil {
+		return err
+	}
+	if err := bw.WriteByte('\n'); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func dumpNode(ctx context.Context, w *bufio.Writer, name string, fsn FSNode, depth, maxDepth int, ancestors ancestorSet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entry, err := newDumpEntry(name, fsn)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	dir, ok := fsn.(*Directory)
+	if !ok || (maxDepth > 0 && depth >= maxDepth) {
+		_, err := w.Write(b)
+		return err
+	}
+
+	// Reopen the object to append the children to it.
+	w.Write(b[:len(b)-1])
+	w.WriteString(`,"children":[`)
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	first := true
+	for _, name := range names {
+		child, err := dir.Child(name)
+		if err != nil {
+			return err
+		}
+		leave := func() {}
+		if childDir, ok := child.(*Directory); ok {
+			var skip bool
+			leave, skip, err = ancestors.enter(childDir)
+			if err != nil {
+				return err
+			}
+			if skip {
+				continue
+			}
+		}
+
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		err = dumpNode(ctx, w, name, child, depth+1, maxDepth, ancestors)
+		leave()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.WriteString("]}")
+	return err
+}
+
+// StreamListJSON writes to `w` the entries of the directory as
+// newline-delimited JSON, one object per entry with the same fields as
+// `Root.DumpJSON` (without children), in the order of `ListNames`. Each
+// entry is written as soon as it's read so consumers can process the
+// listing of large (e.g., sharded) directories while it's produced; the
+// entries aren't kept in memory (the nodes of the entries not already
+// cached aren't cached either). The directory is locked until the listing
+// is complete, so `w` shouldn't block indefinitely.
+func (d *Directory) StreamListJSON(ctx context.Context, w io.Writer) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	enc := json.NewEncoder(w)
+	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var entry dumpEntry
+		if fsn, ok := d.entriesCache[l.Name]; ok {
+			var err error
+			entry, err = newDumpEntry(l.Name, fsn)
+			if err != nil {
+				return err
+			}
+		} else {
+			nd, err := d.dagService.Get(ctx, l.Cid)
+			if err != nil {
+				return err
+			}
+			t, size := unixfsKind(nd)
+			if t != TFile {
+				size, err = nd.Size()
+				if err != nil {
+					return err
+				}
+			}
+			entry = dumpEntry{
+				Name: l.Name,
+				Type: dumpType(t),
+				Cid:  l.Cid.String(),
+				Size: size,
+			}
+		}
+		return enc.Encode(entry)
+	})
+}
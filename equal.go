@@ -0,0 +1,183 @@
+package mfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Equal reports whether the trees with roots `a` and `b` have the same
+// logical content: the same directories and files at the same paths, with
+// the same bytes in each file. The representation isn't compared (whether
+// directories are sharded, how files are chunked, CID versions and hash
+// functions). Subtrees with the same CID are equal without being traversed
+// and file contents are only read when their sizes match. Symlinks are
+// equal if they have the same target. Nodes that aren't UnixFS (see
+// `Opaque`) and UnixFS metadata nodes are only equal if they have the same
+// CID.
+// A directory linking to one of its ancestors returns `ErrCycleDetected`.
+func Equal(ctx context.Context, ds ipld.DAGService, a, b cid.Cid) (bool, error) {
+	return equal(ctx, ds, a, b, make(map[cid.Cid]struct{}), make(map[cid.Cid]struct{}))
+}
+
+// equal is `Equal` with the CIDs of the directories from the roots to `a`
+// and `b` in `ancA` and `ancB`, to detect cycles by (see `walkDAG`).
+func equal(ctx context.Context, ds ipld.DAGService, a, b cid.Cid, ancA, ancB map[cid.Cid]struct{}) (bool, error) {
+	if a.Equals(b) {
+		return true, nil
+	}
+
+	na, err := ds.Get(ctx, a)
+	if err != nil {
+		return false, err
+	}
+	nb, err := ds.Get(ctx, b)
+	if err != nil {
+		return false, err
+	}
+
+	if la, ok := unixfsSymlink(na); ok {
+		lb, ok := unixfsSymlink(nb)
+		return ok && la == lb, nil
+	}
+	ta, sizeA := unixfsKind(na)
+	tb, sizeB := unixfsKind(nb)
+	if ta != tb || ta == TRaw {
+		return false, nil
+	}
+	if ta == TFile {
+		if sizeA != sizeB {
+			return false, nil
+		}
+		return equalFiles(ctx, ds, na, nb)
+	}
+	if _, err := ancestorBlock(ancA, a, false); err != nil {
+		return false, err
+	}
+	if _, err := ancestorBlock(ancB, b, false); err != nil {
+		return false, err
+	}
+	ancA[a] = struct{}{}
+	ancB[b] = struct{}{}
+	defer delete(ancA, a)
+	defer delete(ancB, b)
+	return equalDirs(ctx, ds, na, nb, ancA, ancB)
+}
+
+// unixfsKind returns the type of `nd` and, for files, its size (with
+// `TRaw` for nodes that aren't UnixFS).
+func unixfsKind(nd ipld.Node) (NodeType, uint64) {
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		return TFile, uint64(len(nd.RawData()))
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return TRaw, 0
+		}
+		switch fsn.Type() {
+		case ft.TDirectory, ft.THAMTShard:
+			return TDir, 0
+		case ft.TFile, ft.TRaw:
+			return TFile, fsn.FileSize()
+		}
+	}
+	return TRaw, 0
+}
+
+// unixfsSymlink returns the target of `nd` if it's a UnixFS symlink.
+func unixfsSymlink(nd ipld.Node) (string, bool) {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return "", false
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil || fsn.Type() != ft.TSymlink {
+		return "", false
+	}
+	return string(fsn.Data()), true
+}
+
+func equalDirs(ctx context.Context, ds ipld.DAGService, na, nb ipld.Node, ancA, ancB map[cid.Cid]struct{}) (bool, error) {
+	linksA, err := dirLinks(ctx, ds, na)
+	if err != nil {
+		return false, err
+	}
+	linksB, err := dirLinks(ctx, ds, nb)
+	if err != nil {
+		return false, err
+	}
+	if len(linksA) != len(linksB) {
+		return false, nil
+	}
+	for name, ca := range linksA {
+		cb, ok := linksB[name]
+		if !ok {
+			return false, nil
+		}
+		eq, err := equal(ctx, ds, ca, cb, ancA, ancB)
+		if err != nil || !eq {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// dirLinks returns the CIDs of the entries of the directory `nd` by name.
+func dirLinks(ctx context.Context, ds ipld.DAGService, nd ipld.Node) (map[string]cid.Cid, error) {
+	dir, err := uio.NewDirectoryFromNode(ds, nd)
+	if err != nil {
+		return nil, err
+	}
+	links := make(map[string]cid.Cid)
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links[l.Name] = l.Cid
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// equalFiles compares the contents of the files `na` and `nb` (of the same
+// size), stopping at the first difference.
+func equalFiles(ctx context.Context, ds ipld.DAGService, na, nb ipld.Node) (bool, error) {
+	ra, err := uio.NewDagReader(ctx, na, ds)
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+	rb, err := uio.NewDagReader(ctx, nb, ds)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		n, errA := io.ReadFull(ra, bufA)
+		_, errB := io.ReadFull(rb, bufB[:n])
+		if errB != nil && errB != io.ErrUnexpectedEOF && errB != io.EOF {
+			return false, errB
+		}
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+		switch errA {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return true, nil
+		default:
+			return false, errA
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package mfs
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+// ExportZip writes a zip archive of the contents of `d` to `w`, with the
+// paths of the entries relative to `d`. The archive is streamed: each file
+// is read (through a read descriptor) and compressed as it's written, its
+// sizes and checksum going in the data descriptor following it (so `w`
+// doesn't need to support seeking). Symlinks are stored as entries with the
+// symlink mode and their target as contents (as done by `zip -y`). The
+// UnixFS format currently supported has no modification times nor modes so
+// neither is set for the other entries. Entries that aren't UnixFS files or
+// directories (see `Opaque`) return `ErrInvalidChild`, like in
+// `ExportToOS`.
+func ExportZip(ctx context.Context, d *Directory, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	err := Walk(ctx, d, func(path string, nd FSNode) error {
+		switch nd := nd.(type) {
+		case *Directory:
+			_, err := zw.CreateHeader(&zip.FileHeader{
+				Name:   path + "/",
+				Method: zip.Store,
+			})
+			return err
+		case *File:
+			target, ok, err := symlinkTarget(nd)
+			if err != nil {
+				return err
+			}
+			if ok {
+				hdr := &zip.FileHeader{
+					Name:   path,
+					Method: zip.Store,
+				}
+				hdr.SetMode(os.ModeSymlink | 0777)
+				fw, err := zw.CreateHeader(hdr)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(fw, target)
+				return err
+			}
+			fw, err := zw.CreateHeader(&zip.FileHeader{
+				Name:   path,
+				Method: zip.Deflate,
+			})
+			if err != nil {
+				return err
+			}
+			return exportFileContents(nd, fw)
+		default:
+			return ErrInvalidChild
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportFileContents copies the contents of `fi` to `w`.
+func exportFileContents(fi *File, w io.Writer) error {
+	fd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	_, err = io.Copy(w, fd)
+	return err
+}
+
+// ExportOpt configures `ExportToOS`.
+type ExportOpt func(*exportOptions)
+
+type exportOptions struct {
+	overwrite bool
+	filePerm  os.FileMode
+	dirPerm   os.FileMode
+}
+
+// ExportOverwrite makes `ExportToOS` replace the files (and symlinks)
+// already present in the local filesystem instead of failing.
+func ExportOverwrite() ExportOpt {
+	return func(o *exportOptions) {
+		o.overwrite = true
+	}
+}
+
+// ExportPerm sets the permissions of the files and directories created by
+// `ExportToOS` (before the umask), `0644` and `0755` by default.
+func ExportPerm(file, dir os.FileMode) ExportOpt {
+	return func(o *exportOptions) {
+		o.filePerm = file.Perm()
+		o.dirPerm = dir.Perm()
+	}
+}
+
+// ExportToOS writes the file or directory at `mfsPath` to `localPath` in
+// the local filesystem: a file is streamed to `localPath` (through a read
+// descriptor, without loading it in memory) and a directory is created
+// there with its subtree written recursively. Symlinks are recreated with
+// their target. The UnixFS format currently supported has no modes nor
+// modification times so these can't be restored from the nodes: files and
+// directories get the permissions of `ExportPerm` and the current time.
+// Existing directories are reused but existing files are only replaced with
+// `ExportOverwrite`. Entries that aren't UnixFS files or directories (see
+// `Opaque`) return `ErrInvalidChild`, entries whose name would be written
+// outside of `localPath` (e.g., `..` or containing a path separator)
+// return `ErrInvalidName`.
+func ExportToOS(ctx context.Context, r *Root, mfsPath, localPath string, opts ...ExportOpt) error {
+	o := exportOptions{filePerm: 0644, dirPerm: 0755}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	nd, err := Lookup(r, mfsPath)
+	if err != nil {
+		return err
+	}
+	if err := exportNode(nd, localPath, &o); err != nil {
+		return err
+	}
+	dir, ok := nd.(*Directory)
+	if !ok {
+		return nil
+	}
+	return Walk(ctx, dir, func(path string, nd FSNode) error {
+		dst, err := exportPath(localPath, path, entryName(nd))
+		if err != nil {
+			return err
+		}
+		return exportNode(nd, dst, &o)
+	})
+}
+
+// exportPath returns the local path of the entry `name` at `path` (relative
+// to the exported directory) under `localPath`. The names come from the DAG
+// (possibly an untrusted one) so the ones that would resolve elsewhere are
+// rejected.
+func exportPath(localPath, path, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) ||
+		strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("%w: %q can't be exported", ErrInvalidName, name)
+	}
+	dst := filepath.Join(localPath, filepath.FromSlash(path))
+	rel, err := filepath.Rel(localPath, dst)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is outside of %s", ErrInvalidName, dst, localPath)
+	}
+	return dst, nil
+}
+
+// entryName returns the name of `nd` in its parent directory.
+func entryName(nd FSNode) string {
+	switch nd := nd.(type) {
+	case *Directory:
+		nd.lock.Lock()
+		defer nd.lock.Unlock()
+		return nd.name
+	case *File:
+		nd.nodeLock.RLock()
+		defer nd.nodeLock.RUnlock()
+		return nd.name
+	case *Opaque:
+		return nd.name
+	default:
+		return ""
+	}
+}
+
+// exportNode writes the single node `nd` (not the contents of a
+// directory) to `localPath`.
+func exportNode(nd FSNode, localPath string, o *exportOptions) error {
+	switch nd := nd.(type) {
+	case *Directory:
+		err := os.Mkdir(localPath, o.dirPerm)
+		if os.IsExist(err) {
+			var fi os.FileInfo
+			if fi, err = os.Stat(localPath); err == nil && !fi.IsDir() {
+				err = fmt.Errorf("%s exists and is not a directory", localPath)
+			}
+		}
+		return err
+	case *File:
+		target, ok, err := symlinkTarget(nd)
+		if err != nil {
+			return err
+		}
+		if o.overwrite {
+			if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if ok {
+			return os.Symlink(target, localPath)
+		}
+		return exportFile(nd, localPath, o)
+	default:
+		return ErrInvalidChild
+	}
+}
+
+// exportFile streams the contents of `fi` to a new file at `localPath`.
+func exportFile(fi *File, localPath string, o *exportOptions) error {
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, o.filePerm)
+	if err != nil {
+		return err
+	}
+	if err := exportFileContents(fi, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// symlinkTarget returns the target of `fi` if it's a UnixFS symlink.
+func symlinkTarget(fi *File) (string, bool, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return "", false, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return "", false, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return "", false, err
+	}
+	if fsn.Type() != ft.TSymlink {
+		return "", false, nil
+	}
+	return string(fsn.Data()), true, nil
+}
@@ -3,11 +3,16 @@ package mfs
 import (
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
 	mod "github.com/ipfs/go-unixfs/mod"
 
 	context "context"
 
+	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
@@ -29,6 +34,13 @@ const (
 type FileDescriptor interface {
 	io.Reader
 	CtxReadFull(context.Context, []byte) (int, error)
+	// ReadWithBlocks reads like `Read` but only from the leaf block of
+	// the file at the current offset (reading less if the block ends
+	// before `p` is filled), and returns the CID of that block. Like
+	// `Read`, on a descriptor open for writing it first stores the
+	// pending writes in the DAG service (the leaf blocks only exist once
+	// stored).
+	ReadWithBlocks(p []byte) (n int, c cid.Cid, err error)
 
 	io.Writer
 	io.WriterAt
@@ -47,6 +59,86 @@ type fileDescriptor struct {
 	flags Flags
 
 	state state
+
+	// Maximum number of bytes written with `Write` kept in the `DagModifier`
+	// buffer (zero for no limit) and the current write offset, used to
+	// flush that buffer at offsets that are multiples of the limit.
+	bufferLimit int64
+	offset      int64
+
+	// Whether the file is still stored in a single leaf holding data,
+	// which the `DagModifier` can't extend (see `expandLeaf`), and how
+	// to build a new `DagModifier` configured like `mod`.
+	leaf   bool
+	newMod func(ipld.Node) (*mod.DagModifier, error)
+}
+
+// isDataLeaf returns whether the file node is a single block (without
+// links) holding data.
+func isDataLeaf(nd ipld.Node) bool {
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		return len(nd.RawData()) > 0
+	case *dag.ProtoNode:
+		if len(nd.Links()) > 0 {
+			return false
+		}
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		return err == nil && len(fsn.Data()) > 0
+	}
+	return false
+}
+
+// expandLeaf prepares a file stored in a single data leaf for an operation
+// that makes it reach `end`. The `DagModifier` loses the data of the leaf
+// when it extends it, so once the file grows it's rewritten from an empty
+// UnixFS file (which the `DagModifier` extends with links) and then kept
+// at the current offset.
+func (fi *fileDescriptor) expandLeaf(end int64) error {
+	if !fi.leaf {
+		return nil
+	}
+	size, err := fi.mod.Size()
+	if err != nil {
+		return err
+	}
+	if end <= size {
+		return nil
+	}
+
+	offset, err := fi.mod.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	nd, err := fi.mod.GetNode()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		data = nd.RawData()
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return err
+		}
+		data = fsn.Data()
+	}
+
+	dmod, err := fi.newMod(ft.EmptyFileNode())
+	if err != nil {
+		return err
+	}
+	if _, err := dmod.Write(data); err != nil {
+		return err
+	}
+	if _, err := dmod.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	fi.mod = dmod
+	fi.leaf = false
+	return nil
 }
 
 func (fi *fileDescriptor) checkWrite() error {
@@ -79,6 +171,9 @@ func (fi *fileDescriptor) Truncate(size int64) error {
 	if err := fi.checkWrite(); err != nil {
 		return fmt.Errorf("truncate failed: %s", err)
 	}
+	if err := fi.expandLeaf(size); err != nil {
+		return err
+	}
 	fi.state = stateDirty
 	return fi.mod.Truncate(size)
 }
@@ -88,8 +183,42 @@ func (fi *fileDescriptor) Write(b []byte) (int, error) {
 	if err := fi.checkWrite(); err != nil {
 		return 0, fmt.Errorf("write failed: %s", err)
 	}
+	if fi.leaf {
+		offset, err := fi.mod.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if err := fi.expandLeaf(offset + int64(len(b))); err != nil {
+			return 0, err
+		}
+	}
 	fi.state = stateDirty
-	return fi.mod.Write(b)
+	if fi.bufferLimit <= 0 {
+		return fi.mod.Write(b)
+	}
+
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if room := fi.bufferLimit - fi.offset%fi.bufferLimit; int64(n) > room {
+			n = int(room)
+		}
+		wn, err := fi.mod.Write(b[:n])
+		written += wn
+		fi.offset += int64(wn)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+
+		if fi.offset%fi.bufferLimit == 0 {
+			// Store the buffered blocks in the DAG service to release them.
+			if err := fi.mod.Sync(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
 }
 
 // Read reads into the given buffer from the current offset
@@ -108,6 +237,77 @@ func (fi *fileDescriptor) CtxReadFull(ctx context.Context, b []byte) (int, error
 	return fi.mod.CtxReadFull(ctx, b)
 }
 
+// ReadWithBlocks implements `FileDescriptor`.
+func (fi *fileDescriptor) ReadWithBlocks(b []byte) (int, cid.Cid, error) {
+	if err := fi.checkRead(); err != nil {
+		return 0, cid.Undef, fmt.Errorf("read failed: %s", err)
+	}
+	offset, err := fi.mod.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	// This syncs the pending writes, which `Read` would do anyway.
+	nd, err := fi.mod.GetNode()
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	c, left, err := leafAt(context.TODO(), fi.inode.dagService, nd, uint64(offset))
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	if uint64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := fi.mod.Read(b)
+	return n, c, err
+}
+
+// leafAt returns the CID of the leaf block of the file DAG `nd` with the
+// data at `offset` and the number of bytes of the block from there
+// (`io.EOF` if `offset` is past the end of the file).
+func leafAt(ctx context.Context, ds ipld.NodeGetter, nd ipld.Node, offset uint64) (cid.Cid, uint64, error) {
+	for {
+		switch n := nd.(type) {
+		case *dag.RawNode:
+			if offset >= uint64(len(n.RawData())) {
+				return cid.Undef, 0, io.EOF
+			}
+			return n.Cid(), uint64(len(n.RawData())) - offset, nil
+		case *dag.ProtoNode:
+			fsn, err := ft.FSNodeFromBytes(n.Data())
+			if err != nil {
+				return cid.Undef, 0, err
+			}
+			data := uint64(len(fsn.Data()))
+			if offset < data {
+				return n.Cid(), data - offset, nil
+			}
+			offset -= data
+			if fsn.NumChildren() != len(n.Links()) {
+				return cid.Undef, 0, ft.ErrUnrecognizedType
+			}
+			next := -1
+			for i := 0; i < fsn.NumChildren(); i++ {
+				size := fsn.BlockSize(i)
+				if offset < size {
+					next = i
+					break
+				}
+				offset -= size
+			}
+			if next < 0 {
+				return cid.Undef, 0, io.EOF
+			}
+			nd, err = n.Links()[next].GetNode(ctx, ds)
+			if err != nil {
+				return cid.Undef, 0, err
+			}
+		default:
+			return cid.Undef, 0, dag.ErrNotProtobuf
+		}
+	}
+}
+
 // Close flushes, then propogates the modified dag node up the directory structure
 // and signals a republish to occur
 func (fi *fileDescriptor) Close() error {
@@ -116,6 +316,9 @@ func (fi *fileDescriptor) Close() error {
 	}
 	if fi.flags.Write {
 		defer fi.inode.desclock.Unlock()
+		if r := rootOf(fi.inode.parent); r != nil {
+			defer r.removeWriter(fi.inode)
+		}
 	} else if fi.flags.Read {
 		defer fi.inode.desclock.RUnlock()
 	}
@@ -149,6 +352,16 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 		if err != nil {
 			return err
 		}
+		if b := optionsOf(fi.inode.parent).leafCidBuilder; b != nil {
+			lc, err := newLeafConverter(fi.inode.dagService, b)
+			if err != nil {
+				return err
+			}
+			nd, err = lc.convert(context.TODO(), nd)
+			if err != nil {
+				return err
+			}
+		}
 
 		// TODO: Very similar logic to the update process in
 		// `Directory`, the logic should be unified, both structures
@@ -163,11 +376,17 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 		name := fi.inode.name
 		fi.inode.nodeLock.Unlock()
 
-		// Bubble up the update's to the parent, only if fullSync is set to true.
-		if fullSync {
-			if err := parent.updateChildEntry(child{name, nd}); err != nil {
+		if dir, ok := parent.(*Directory); ok {
+			dir.recordOp(OpWrite, name, nd.Cid())
+		}
+
+		// Bubble up the update's to the parent, only if fullSync is set to true
+		// (and the file is attached to one, see `OpenFileNode`).
+		if fullSync && parent != nil {
+			if err := parent.updateChildEntry(child{name, nd, fi.inode}); err != nil {
 				return err
 			}
+			fi.inode.setLinked(nd.Cid())
 		}
 
 		fi.state = stateFlushed
@@ -184,7 +403,26 @@ func (fi *fileDescriptor) Seek(offset int64, whence int) (int64, error) {
 	if fi.state == stateClosed {
 		return 0, fmt.Errorf("seek failed: %s", ErrClosed)
 	}
-	return fi.mod.Seek(offset, whence)
+	if fi.leaf && whence != io.SeekEnd {
+		// Seeking past the end extends the file with zeros.
+		end := offset
+		if whence == io.SeekCurrent {
+			cur, err := fi.mod.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return 0, err
+			}
+			end += cur
+		}
+		if err := fi.expandLeaf(end); err != nil {
+			return 0, err
+		}
+	}
+	off, err := fi.mod.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	fi.offset = off
+	return off, nil
 }
 
 // Write At writes the given bytes at the offset 'at'
@@ -192,6 +430,437 @@ func (fi *fileDescriptor) WriteAt(b []byte, at int64) (int, error) {
 	if err := fi.checkWrite(); err != nil {
 		return 0, fmt.Errorf("write-at failed: %s", err)
 	}
+	if err := fi.expandLeaf(at + int64(len(b))); err != nil {
+		return 0, err
+	}
 	fi.state = stateDirty
-	return fi.mod.WriteAt(b, at)
+	n, err := fi.mod.WriteAt(b, at)
+	// The `DagModifier` keeps writing after the written data.
+	fi.offset = at + int64(n)
+	return n, err
+}
+
+// autoFlushDescriptor wraps a `fileDescriptor` flushing it periodically
+// from a background goroutine, all operations are serialized so the
+// flushes always capture the result of complete writes.
+type autoFlushDescriptor struct {
+	lock sync.Mutex
+	fd   *fileDescriptor
+
+	// Last error returned by a background flush (reported on `Close`).
+	flushErr error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newAutoFlushDescriptor(fd *fileDescriptor, interval time.Duration) *autoFlushDescriptor {
+	afd := &autoFlushDescriptor{
+		fd:   fd,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go afd.flushLoop(interval)
+	return afd
+}
+
+func (afd *autoFlushDescriptor) flushLoop(interval time.Duration) {
+	defer close(afd.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-afd.stop:
+			return
+		case <-ticker.C:
+			afd.lock.Lock()
+			if afd.fd.state == stateDirty {
+				if err := afd.fd.Flush(); err != nil {
+					log.Errorf("auto-flush of %s failed: %s", afd.fd.inode.name, err)
+					afd.flushErr = err
+				}
+			}
+			afd.lock.Unlock()
+		}
+	}
+}
+
+func (afd *autoFlushDescriptor) Read(b []byte) (int, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.Read(b)
+}
+
+func (afd *autoFlushDescriptor) CtxReadFull(ctx context.Context, b []byte) (int, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.CtxReadFull(ctx, b)
+}
+
+func (afd *autoFlushDescriptor) ReadWithBlocks(b []byte) (int, cid.Cid, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.ReadWithBlocks(b)
+}
+
+func (afd *autoFlushDescriptor) Write(b []byte) (int, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.Write(b)
+}
+
+func (afd *autoFlushDescriptor) WriteAt(b []byte, at int64) (int, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.WriteAt(b, at)
+}
+
+func (afd *autoFlushDescriptor) Seek(offset int64, whence int) (int64, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.Seek(offset, whence)
+}
+
+func (afd *autoFlushDescriptor) Truncate(size int64) error {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.Truncate(size)
+}
+
+func (afd *autoFlushDescriptor) Size() (int64, error) {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.Size()
+}
+
+func (afd *autoFlushDescriptor) Flush() error {
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	return afd.fd.Flush()
+}
+
+// Close stops the background flushes and closes the descriptor.
+func (afd *autoFlushDescriptor) Close() error {
+	afd.stopOnce.Do(func() { close(afd.stop) })
+	<-afd.done
+
+	afd.lock.Lock()
+	defer afd.lock.Unlock()
+	if err := afd.fd.Close(); err != nil {
+		return err
+	}
+	return afd.flushErr
+}
+
+// readAheadDescriptor wraps a read-only `fileDescriptor` reading the file
+// through a `leafPrefetcher` (instead of its `DagModifier`) started from
+// the current offset.
+type readAheadDescriptor struct {
+	*fileDescriptor
+
+	node   ipld.Node
+	blocks int
+
+	offset int64
+	// Started on the first read after opening or seeking.
+	pf *leafPrefetcher
+}
+
+func (rd *readAheadDescriptor) Read(b []byte) (int, error) {
+	return rd.read(context.TODO(), b)
+}
+
+func (rd *readAheadDescriptor) CtxReadFull(ctx context.Context, b []byte) (int, error) {
+	var read int
+	for read < len(b) {
+		n, err := rd.read(ctx, b[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (rd *readAheadDescriptor) ReadWithBlocks(b []byte) (int, cid.Cid, error) {
+	if err := rd.checkRead(); err != nil {
+		return 0, cid.Undef, fmt.Errorf("read failed: %s", err)
+	}
+	c, left, err := leafAt(context.TODO(), rd.inode.dagService, rd.node, uint64(rd.offset))
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	if uint64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := rd.read(context.TODO(), b)
+	return n, c, err
+}
+
+func (rd *readAheadDescriptor) read(ctx context.Context, b []byte) (int, error) {
+	if err := rd.checkRead(); err != nil {
+		return 0, fmt.Errorf("read failed: %s", err)
+	}
+	if rd.pf == nil {
+		rd.pf = newLeafPrefetcher(rd.inode.dagService, rd.node, uint64(rd.offset), rd.blocks)
+	}
+	n, err := rd.pf.read(ctx, b)
+	rd.offset += int64(n)
+	if err != nil && err != io.EOF {
+		// Don't leave the prefetching running when the caller gives up.
+		rd.pf.stop()
+		rd.pf = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (rd *readAheadDescriptor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rd.offset
+	case io.SeekEnd:
+		size, err := rd.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+
+	if offset != rd.offset && rd.pf != nil {
+		rd.pf.stop()
+		rd.pf = nil
+	}
+	rd.offset = offset
+	return offset, nil
+}
+
+// Close stops the prefetching and closes the descriptor.
+func (rd *readAheadDescriptor) Close() error {
+	if rd.pf != nil {
+		rd.pf.stop()
+		rd.pf = nil
+	}
+	return rd.fileDescriptor.Close()
+}
+
+// leafPrefetcher reads the contents of a UnixFS file DAG from an offset,
+// fetching the children of each node (up to `blocks` of them at a time)
+// ahead of the reads from a background goroutine.
+type leafPrefetcher struct {
+	ds     ipld.NodeGetter
+	blocks int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Contents sent in order by the background walk, closed at the end
+	// (after setting `err`).
+	out  chan []byte
+	err  error
+	done chan struct{}
+
+	// Contents received and not yet read.
+	cur []byte
+}
+
+func newLeafPrefetcher(ds ipld.NodeGetter, root ipld.Node, offset uint64, blocks int) *leafPrefetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &leafPrefetcher{
+		ds:     ds,
+		blocks: blocks,
+		ctx:    ctx,
+		cancel: cancel,
+		out:    make(chan []byte, blocks),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		p.err = p.walk(root, offset)
+		close(p.out)
+	}()
+	return p
+}
+
+func (p *leafPrefetcher) read(ctx context.Context, b []byte) (int, error) {
+	for len(p.cur) == 0 {
+		select {
+		case data, ok := <-p.out:
+			if !ok {
+				if p.err != nil {
+					return 0, p.err
+				}
+				return 0, io.EOF
+			}
+			p.cur = data
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// stop cancels the background walk and waits for it to finish.
+func (p *leafPrefetcher) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// walk sends the contents of the DAG under `nd` past `skip` bytes.
+func (p *leafPrefetcher) walk(nd ipld.Node, skip uint64) error {
+	var data []byte
+	var fsn *ft.FSNode
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		data = nd.RawData()
+	case *dag.ProtoNode:
+		var err error
+		fsn, err = ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return err
+		}
+		data = fsn.Data()
+	default:
+		return dag.ErrNotProtobuf
+	}
+
+	if skip < uint64(len(data)) {
+		if err := p.send(data[skip:]); err != nil {
+			return err
+		}
+		skip = 0
+	} else {
+		skip -= uint64(len(data))
+	}
+
+	links := nd.Links()
+	if len(links) == 0 {
+		return nil
+	}
+	if fsn.NumChildren() != len(links) {
+		return fmt.Errorf("%s has %d links but %d block sizes", nd.Cid(), len(links), fsn.NumChildren())
+	}
+	first := 0
+	for ; first < len(links) && skip >= fsn.BlockSize(first); first++ {
+		skip -= fsn.BlockSize(first)
+	}
+	links = links[first:]
+
+	type fetched struct {
+		nd  ipld.Node
+		err error
+	}
+	pending := make([]chan fetched, len(links))
+	fetch := func(i int) {
+		pending[i] = make(chan fetched, 1)
+		go func() {
+			nd, err := links[i].GetNode(p.ctx, p.ds)
+			pending[i] <- fetched{nd, err}
+		}()
+	}
+	for i := 0; i < p.blocks && i < len(links); i++ {
+		fetch(i)
+	}
+	for i := range links {
+		var f fetched
+		select {
+		case f = <-pending[i]:
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		if f.err != nil {
+			return f.err
+		}
+		if next := i + p.blocks; next < len(links) {
+			fetch(next)
+		}
+		if err := p.walk(f.nd, skip); err != nil {
+			return err
+		}
+		skip = 0
+	}
+	return nil
+}
+
+func (p *leafPrefetcher) send(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	select {
+	case p.out <- data:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// dedupDAGService wraps the DAG service of a `DagModifier` skipping the
+// addition of leaves already added through it (see `WithLeafDedup`).
+type dedupDAGService struct {
+	ipld.DAGService
+
+	lock sync.Mutex
+	seen map[cid.Cid]struct{}
+}
+
+func newDedupDAGService(ds ipld.DAGService) *dedupDAGService {
+	return &dedupDAGService{
+		DAGService: ds,
+		seen:       make(map[cid.Cid]struct{}),
+	}
+}
+
+// added reports if `nd` is a leaf already added.
+func (ds *dedupDAGService) added(nd ipld.Node) bool {
+	if len(nd.Links()) > 0 {
+		return false
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	_, ok := ds.seen[nd.Cid()]
+	return ok
+}
+
+// record records the leaves of `nds`, once added.
+func (ds *dedupDAGService) record(nds ...ipld.Node) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for _, nd := range nds {
+		if len(nd.Links()) == 0 {
+			ds.seen[nd.Cid()] = struct{}{}
+		}
+	}
+}
+
+func (ds *dedupDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	if ds.added(nd) {
+		return nil
+	}
+	if err := ds.DAGService.Add(ctx, nd); err != nil {
+		return err
+	}
+	ds.record(nd)
+	return nil
+}
+
+func (ds *dedupDAGService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	add := make([]ipld.Node, 0, len(nds))
+	for _, nd := range nds {
+		if !ds.added(nd) {
+			add = append(add, nd)
+		}
+	}
+	if err := ds.DAGService.AddMany(ctx, add); err != nil {
+		return err
+	}
+	ds.record(add...)
+	return nil
 }
@@ -2,17 +2,28 @@ package mfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"path"
 	"sync"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	h "github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
 	mod "github.com/ipfs/go-unixfs/mod"
 
+	cid "github.com/ipfs/go-cid"
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
+// ErrCidMismatch is returned by `WriteExpecting` when the written content
+// doesn't have the expected CID.
+var ErrCidMismatch = errors.New("content doesn't match the expected CID")
+
 // File represents a file in the MFS, its logic its mainly targeted
 // to coordinating (potentially many) `FileDescriptor`s pointing to
 // it.
@@ -32,6 +43,14 @@ type File struct {
 	// there may be many `FileDescriptor`s operating on this `File`.
 	nodeLock sync.RWMutex
 
+	// CID builder for the nodes created when writing to the file (if not
+	// set they inherit the prefix of `node`). Protected by `nodeLock`.
+	cidBuilder cid.Builder
+
+	// CID of the node last linked in the parent directory (see
+	// `WalkDirty`). Protected by `nodeLock`.
+	linked cid.Cid
+
 	RawLeaves bool
 }
 
@@ -44,7 +63,8 @@ func NewFile(name string, node ipld.Node, parent parent, dserv ipld.DAGService)
 			parent:     parent,
 			dagService: dserv,
 		},
-		node: node,
+		node:   node,
+		linked: node.Cid(),
 	}
 	if node.Cid().Prefix().Version > 0 {
 		fi.RawLeaves = true
@@ -52,12 +72,80 @@ func NewFile(name string, node ipld.Node, parent parent, dserv ipld.DAGService)
 	return fi, nil
 }
 
-func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
+// NewDetachedFile returns a new empty `File` not attached to any
+// directory (and stored in `ds`), which can be opened and written to like
+// any other file. The changes aren't propagated anywhere: once flushed (or
+// the descriptor is closed) its node, from `GetNode`, can be added to a
+// directory with `AddChild`. (`NewFile` is the constructor used by the
+// directories for their entries.)
+func NewDetachedFile(ctx context.Context, ds ipld.DAGService, opts ...FileOpt) (*File, error) {
+	var o fileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	nd := ft.EmptyFileNode()
+	if o.cidBuilder != nil {
+		nd.SetCidBuilder(o.cidBuilder)
+	}
+	if err := ds.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+	fi, err := NewFile(nd.Cid().String(), nd, nil, ds)
+	if err != nil {
+		return nil, err
+	}
+	fi.cidBuilder = o.cidBuilder
+	if o.rawLeaves {
+		fi.RawLeaves = true
+	}
+	return fi, nil
+}
+
+// OpenFileNode fetches the UnixFS file node with the given CID and opens
+// it for reading. The resulting `File` is not attached to any directory
+// (so it can't be written to), this is mainly used to read previous
+// versions of files that are no longer reachable from the current `Root`.
+func OpenFileNode(ctx context.Context, ds ipld.DAGService, c cid.Cid) (FileDescriptor, error) {
+	nd, err := ds.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return nil, err
+		}
+		if fsn.Type() != ft.TFile && fsn.Type() != ft.TRaw {
+			return nil, fmt.Errorf("%s is not a unixfs file (unixfs type: %s)", c, fsn.Type())
+		}
+	case *dag.RawNode:
+	default:
+		return nil, fmt.Errorf("%s is not a unixfs file", c)
+	}
+
+	fi, err := NewFile(c.String(), nd, nil, ds)
+	if err != nil {
+		return nil, err
+	}
+	return fi.Open(Flags{Read: true})
+}
+
+func (fi *File) Open(flags Flags, opts ...OpenOption) (_ FileDescriptor, _retErr error) {
+	var openOpts openOptions
+	for _, opt := range opts {
+		opt(&openOpts)
+	}
+
 	if flags.Write {
 		fi.desclock.Lock()
 		defer func() {
 			if _retErr != nil {
 				fi.desclock.Unlock()
+			} else if r := rootOf(fi.parent); r != nil {
+				r.addWriter(fi)
 			}
 		}()
 	} else if flags.Read {
@@ -73,8 +161,13 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 
 	fi.nodeLock.RLock()
 	node := fi.node
+	builder := fi.cidBuilder
 	fi.nodeLock.RUnlock()
 
+	if c := customFileCodec(node); c != nil {
+		return fi.openCodec(c, node, flags)
+	}
+
 	// TODO: Move this `switch` logic outside (maybe even
 	// to another package, this seems like a job of UnixFS),
 	// `NewDagModifier` uses the IPLD node, we're not
@@ -98,20 +191,275 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 		// Ok as well.
 	}
 
-	dmod, err := mod.NewDagModifier(context.TODO(), node, fi.dagService, chunker.DefaultSplitter)
-	// TODO: Remove the use of the `chunker` package here, add a new `NewDagModifier` in
-	// `go-unixfs` with the `DefaultSplitter` already included.
+	if raw, ok := node.(*dag.RawNode); ok && flags.Write && len(raw.RawData()) == 0 {
+		// The `DagModifier` can't extend a raw block, start writing
+		// from an empty UnixFS file instead (e.g., see `EmptyFileRaw`).
+		node = ft.EmptyFileNode()
+	}
+
+	splitter := chunker.DefaultSplitter
+	rawLeaves := fi.RawLeaves
+	if optionsOf(fi.parent).adaptiveChunking {
+		size, err := fi.Size()
+		if err != nil {
+			return nil, err
+		}
+		if openOpts.sizeHint > size {
+			size = openOpts.sizeHint
+		}
+		if size < AdaptiveChunkingThreshold {
+			splitter = chunker.SizeSplitterGen(AdaptiveSmallChunkSize)
+			rawLeaves = true
+		} else {
+			splitter = func(r io.Reader) chunker.Splitter {
+				return chunker.NewRabin(r, AdaptiveRabinAverageSize)
+			}
+		}
+	}
+
+	modds := fi.dagService
+	if flags.Write && openOpts.leafDedup {
+		modds = newDedupDAGService(modds)
+	}
+	newMod := func(node ipld.Node) (*mod.DagModifier, error) {
+		if pbnd, ok := node.(*dag.ProtoNode); ok && builder != nil && flags.Write {
+			pbnd = pbnd.Copy().(*dag.ProtoNode)
+			pbnd.SetCidBuilder(builder)
+			node = pbnd
+		}
+		dmod, err := mod.NewDagModifier(context.TODO(), node, modds, splitter)
+		// TODO: Remove the use of the `chunker` package here, add a new `NewDagModifier` in
+		// `go-unixfs` with the `DefaultSplitter` already included.
+		if err != nil {
+			return nil, err
+		}
+		dmod.RawLeaves = rawLeaves
+		if builder != nil {
+			// The `DagModifier` only takes a prefix, extract it from any CID
+			// generated by the builder.
+			c, err := builder.Sum(nil)
+			if err != nil {
+				return nil, err
+			}
+			dmod.Prefix = c.Prefix()
+		}
+		return dmod, nil
+	}
+	dmod, err := newMod(node)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &fileDescriptor{
+		inode:       fi,
+		flags:       flags,
+		mod:         dmod,
+		newMod:      newMod,
+		leaf:        flags.Write && isDataLeaf(node),
+		state:       stateCreated,
+		bufferLimit: int64(openOpts.writeBufferBlocks) * chunker.DefaultBlockSize,
+	}
+	if flags.Write && openOpts.autoFlush > 0 {
+		return newAutoFlushDescriptor(fd, openOpts.autoFlush), nil
+	}
+	if !flags.Write && openOpts.readAhead > 0 {
+		return &readAheadDescriptor{
+			fileDescriptor: fd,
+			node:           node,
+			blocks:         openOpts.readAhead,
+		}, nil
+	}
+	return fd, nil
+}
+
+// OpenAt opens the file (as `Open`) with the descriptor positioned at
+// `offset`. In read-only mode `offset` must not be past the end of the
+// file, when writing the file is extended (with zeros) up to `offset` if
+// needed.
+func (fi *File) OpenAt(flags Flags, offset int64, opts ...OpenOption) (_ FileDescriptor, _retErr error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("negative offset: %d", offset)
+	}
+
+	fd, err := fi.Open(flags, opts...)
 	if err != nil {
 		return nil, err
 	}
-	dmod.RawLeaves = fi.RawLeaves
+	defer func() {
+		if _retErr != nil {
+			fd.Close()
+		}
+	}()
 
-	return &fileDescriptor{
-		inode: fi,
-		flags: flags,
-		mod:   dmod,
-		state: stateCreated,
-	}, nil
+	size, err := fd.Size()
+	if err != nil {
+		return nil, err
+	}
+	if offset > size {
+		if !flags.Write {
+			return nil, fmt.Errorf("offset %d past the end of the file (%d bytes)", offset, size)
+		}
+		if err := fd.Truncate(offset); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// WriteExpecting replaces the contents of the file with the data read
+// from `r`, which is imported as `ipfs add` does by default (fixed size
+// chunks in a balanced layout, with the raw leaves and CID builder settings
+// of the file), and checks the resulting node has the CID `expected`. If
+// it doesn't `ErrCidMismatch` is returned and the file is left unchanged
+// (the imported blocks remain in the DAG service).
+func (fi *File) WriteExpecting(ctx context.Context, r io.Reader, expected cid.Cid) error {
+	fi.desclock.Lock()
+	defer fi.desclock.Unlock()
+
+	fi.nodeLock.RLock()
+	builder := fi.cidBuilder
+	fi.nodeLock.RUnlock()
+
+	dbp := h.DagBuilderParams{
+		Dagserv:    fi.dagService,
+		Maxlinks:   h.DefaultLinksPerBlock,
+		RawLeaves:  fi.RawLeaves,
+		CidBuilder: builder,
+	}
+	db, err := dbp.New(chunker.DefaultSplitter(&ctxReader{ctx, r}))
+	if err != nil {
+		return err
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		return err
+	}
+	if !nd.Cid().Equals(expected) {
+		return ErrCidMismatch
+	}
+
+	fi.nodeLock.Lock()
+	fi.node = nd
+	parent := fi.parent
+	name := fi.name
+	fi.nodeLock.Unlock()
+
+	if parent == nil {
+		return nil
+	}
+	return parent.updateChildEntry(child{name, nd, fi})
+}
+
+// FlushPartial makes sure the current content of the file (as last
+// flushed by its descriptors) is stored in the DAG service and returns its
+// CID, without waiting for the open descriptors to be closed nor updating
+// the parent directory. This allows to checkpoint a long write: the writer
+// flushes its descriptor (or uses `WithAutoFlush`) and the CID returned
+// here is persisted outside MFS (e.g., in a database, with the size
+// written so far). To resume after an interruption, the node with that CID
+// is fetched from the DAG service and added back to the tree (with
+// `PutNode`), and the rest of the data (from the file `Size` on) is
+// appended to it with `AppendFrom`, which also keeps the partial content
+// when it's still stored in a single block.
+func (fi *File) FlushPartial(ctx context.Context) (cid.Cid, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := fi.dagService.Add(ctx, nd); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// Reader returns a plain `io.ReadCloser` reading the whole file
+// sequentially. It reads the version of the file at the time of the call
+// (later writes aren't seen) and fetches its blocks as they're needed,
+// failing once `ctx` is done. Unlike a `FileDescriptor` opened for
+// reading it doesn't block writers of the file.
+func (fi *File) Reader(ctx context.Context) (io.ReadCloser, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	return uio.NewDagReader(ctx, nd, fi.dagService)
+}
+
+// ctxReader stops reading from `r` once `ctx` is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// AppendFrom streams the contents of `r` to the end of the file and
+// flushes it, returning the number of bytes appended. The new data is
+// chunked into new leaves added after the existing ones (the
+// `DagModifier` only rewrites the nodes that need to link to them).
+func (fi *File) AppendFrom(ctx context.Context, r io.Reader) (_ int64, _retErr error) {
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := fd.Close(); err != nil && _retErr == nil {
+			_retErr = err
+		}
+	}()
+
+	if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+
+	var written int64
+	buf := make([]byte, chunker.DefaultBlockSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			wn, err := fd.Write(buf[:n])
+			written += int64(wn)
+			if err != nil {
+				return written, err
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// GetCidBuilder returns the CID builder set with `SetCidBuilder` (nil if
+// none was set).
+func (fi *File) GetCidBuilder() cid.Builder {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+	return fi.cidBuilder
+}
+
+// SetCidBuilder sets the CID builder used for the nodes created by the
+// descriptors opened for writing from now on (including the root node of
+// the file), the existing leaves of the file are left untouched.
+func (fi *File) SetCidBuilder(b cid.Builder) {
+	fi.nodeLock.Lock()
+	defer fi.nodeLock.Unlock()
+	fi.cidBuilder = b
 }
 
 // Size returns the size of this file
@@ -123,6 +471,14 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 func (fi *File) Size() (int64, error) {
 	fi.nodeLock.RLock()
 	defer fi.nodeLock.RUnlock()
+	if c := customFileCodec(fi.node); c != nil {
+		cd, err := c.Open(context.TODO(), fi.dagService, fi.node, Flags{Read: true})
+		if err != nil {
+			return 0, err
+		}
+		defer cd.Close()
+		return cd.Size()
+	}
 	switch nd := fi.node.(type) {
 	case *dag.ProtoNode:
 		fsn, err := ft.FSNodeFromBytes(nd.Data())
@@ -137,6 +493,49 @@ func (fi *File) Size() (int64, error) {
 	}
 }
 
+// BlockCount returns the number of blocks (leaves and intermediate
+// nodes) of the DAG of this file, as of its last flush. Only the
+// intermediate nodes need to be fetched: raw leaves are counted from the
+// links pointing to them (UnixFS leaves can't be told apart from
+// intermediate nodes by their links so they are fetched too).
+func (fi *File) BlockCount(ctx context.Context) (int, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return 0, err
+	}
+	ancestors := make(map[cid.Cid]struct{})
+	return blockCount(ctx, fi.dagService, nd, ancestors, optionsOf(fi.parent).skipCycles)
+}
+
+// blockCount is the recursive helper of `BlockCount`.
+func blockCount(ctx context.Context, ds ipld.NodeGetter, nd ipld.Node, ancestors map[cid.Cid]struct{}, skipCycles bool) (int, error) {
+	ancestors[nd.Cid()] = struct{}{}
+	defer delete(ancestors, nd.Cid())
+
+	count := 1
+	for _, l := range nd.Links() {
+		if l.Cid.Prefix().Codec == cid.Raw {
+			count++
+			continue
+		}
+		if skip, err := ancestorBlock(ancestors, l.Cid, skipCycles); err != nil {
+			return 0, err
+		} else if skip {
+			continue
+		}
+		child, err := l.GetNode(ctx, ds)
+		if err != nil {
+			return 0, err
+		}
+		n, err := blockCount(ctx, ds, child, ancestors, skipCycles)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
 // GetNode returns the dag node associated with this file
 // TODO: Use this method and do not access the `nodeLock` directly anywhere else.
 func (fi *File) GetNode() (ipld.Node, error) {
@@ -145,6 +544,28 @@ func (fi *File) GetNode() (ipld.Node, error) {
 	return fi.node, nil
 }
 
+// setLinked records `c` as the CID linked in the parent directory.
+func (fi *File) setLinked(c cid.Cid) {
+	fi.nodeLock.Lock()
+	defer fi.nodeLock.Unlock()
+	fi.linked = c
+}
+
+// unlinked reports if the node of the file changed since it was last
+// linked in the parent directory.
+func (fi *File) unlinked() bool {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+	return !fi.node.Cid().Equals(fi.linked)
+}
+
+// GetNodeNoFlush returns the dag node of the file as of its last flush,
+// like `GetNode` (which never flushes the open descriptors of the file,
+// independently of `WithGetNodeFlush`).
+func (fi *File) GetNodeNoFlush() (ipld.Node, error) {
+	return fi.GetNode()
+}
+
 // TODO: Tight coupling with the `FileDescriptor`, at the
 // very least this should be an independent function that
 // takes a `File` argument and automates the open/flush/close
@@ -177,3 +598,16 @@ func (fi *File) Sync() error {
 func (fi *File) Type() NodeType {
 	return TFile
 }
+
+// path returns the absolute path of the file (just its name if it isn't
+// in a directory).
+func (fi *File) path() string {
+	fi.nodeLock.RLock()
+	parent, name := fi.parent, fi.name
+	fi.nodeLock.RUnlock()
+
+	if dir, ok := parent.(*Directory); ok {
+		return path.Join(dir.Path(), name)
+	}
+	return name
+}
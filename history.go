@@ -0,0 +1,143 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	dag "github.com/ipfs/go-merkledag"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Names of the links of a history record.
+const (
+	historyRootLink = "root"
+	historyPrevLink = "prev"
+)
+
+// history records the roots flushed with `WithHistory` as a backward
+// chain of records. UnixFS directories have no room for metadata so the
+// chain can't be carried by the root nodes themselves; each record is
+// instead a small dag-pb node (without UnixFS data) linking to the root it
+// records (`historyRootLink`) and to the previous record
+// (`historyPrevLink`).
+type history struct {
+	lock sync.Mutex
+	ds   ipld.DAGService
+
+	// Last recorded root and the record for it (undefined until the
+	// first change).
+	root cid.Cid
+	head cid.Cid
+}
+
+// record appends a record for the root `c` to the chain if it differs
+// from the last recorded one. The initial root is recorded along with the
+// first change.
+func (h *history) record(ctx context.Context, c cid.Cid) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if c.Equals(h.root) {
+		return nil
+	}
+	if !h.head.Defined() {
+		head, err := h.add(ctx, h.root, cid.Undef)
+		if err != nil {
+			return err
+		}
+		h.head = head
+	}
+	head, err := h.add(ctx, c, h.head)
+	if err != nil {
+		return err
+	}
+	h.root, h.head = c, head
+	return nil
+}
+
+// resume continues the chain whose last record is `head` from the root
+// `c`, recording it if it isn't the root `head` records.
+func (h *history) resume(ctx context.Context, head, c cid.Cid) error {
+	root, _, err := readRecord(ctx, h.ds, head)
+	if err != nil {
+		return err
+	}
+	h.root, h.head = root, head
+	return h.record(ctx, c)
+}
+
+// add stores a record node for `root` linking to `prev` (if defined).
+func (h *history) add(ctx context.Context, root, prev cid.Cid) (cid.Cid, error) {
+	nd := new(dag.ProtoNode)
+	nd.AddRawLink(historyRootLink, &ipld.Link{Cid: root})
+	if prev.Defined() {
+		nd.AddRawLink(historyPrevLink, &ipld.Link{Cid: prev})
+	}
+	if err := h.ds.Add(ctx, nd); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// readRecord returns the root recorded by the history record `c` and the
+// previous record (undefined for the first one).
+func readRecord(ctx context.Context, ds ipld.DAGService, c cid.Cid) (root, prev cid.Cid, err error) {
+	nd, err := ds.Get(ctx, c)
+	if err != nil {
+		return cid.Undef, cid.Undef, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return cid.Undef, cid.Undef, fmt.Errorf("history record %s is not a dag-pb node", c)
+	}
+	rl, err := pbnd.GetNodeLink(historyRootLink)
+	if err != nil {
+		return cid.Undef, cid.Undef, fmt.Errorf("history record %s: %w", c, err)
+	}
+	if pl, err := pbnd.GetNodeLink(historyPrevLink); err == nil {
+		prev = pl.Cid
+	}
+	return rl.Cid, prev, nil
+}
+
+// HistoryHead returns the CID of the last record of the history chain
+// (undefined if history wasn't enabled with `WithHistory` or the root
+// hasn't changed yet). Persist it to continue the chain from a new `Root`
+// with `WithHistoryHead`.
+func (kr *Root) HistoryHead() cid.Cid {
+	if kr.history == nil {
+		return cid.Undef
+	}
+	kr.history.lock.Lock()
+	defer kr.history.lock.Unlock()
+	return kr.history.head
+}
+
+// PreviousRoots returns up to `n` of the roots flushed before the current
+// one, most recent first, walking the chain recorded with `WithHistory`
+// (see `HistoryHead`).
+func (kr *Root) PreviousRoots(ctx context.Context, n int) ([]cid.Cid, error) {
+	if kr.history == nil {
+		return nil, fmt.Errorf("history not enabled")
+	}
+
+	var roots []cid.Cid
+	next := kr.HistoryHead()
+	first := true
+	for next.Defined() && len(roots) < n {
+		root, prev, err := readRecord(ctx, kr.history.ds, next)
+		if err != nil {
+			return nil, err
+		}
+		// The head records the current root.
+		if !first {
+			roots = append(roots, root)
+		}
+		first = false
+		next = prev
+	}
+	return roots, nil
+}
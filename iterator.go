@@ -0,0 +1,185 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// EntryIterator is a pull iterator over the entries of a `Directory`,
+// returned by `Directory.Iterator`. It's not safe for concurrent use.
+type EntryIterator interface {
+	// Next advances to the next entry, returning false when there are no
+	// more entries or an error occurred (check `Err`).
+	Next() bool
+	// Entry returns the current entry (after a successful `Next`).
+	Entry() NodeListing
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+	// Close stops the iteration releasing its resources, it must be called
+	// if the iteration is abandoned before `Next` returns false.
+	Close()
+}
+
+// Iterator returns an `EntryIterator` over the entries of this directory.
+// The names are enumerated (lazily, fetching the HAMT shards as needed)
+// from the directory node as of this call, so the directory can be freely
+// modified during the iteration: entries removed since are skipped and
+// entries added since are not reported. The entries are in no particular
+// order.
+func (d *Directory) Iterator(ctx context.Context) (EntryIterator, error) {
+	nd, err := flushedNode(d)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := uio.NewDirectoryFromNode(d.dagService, nd)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &dirIterator{
+		dir:    d,
+		links:  snapshot.EnumLinksAsync(ctx),
+		cancel: cancel,
+	}, nil
+}
+
+type dirIterator struct {
+	dir    *Directory
+	links  <-chan ft.LinkResult
+	cancel context.CancelFunc
+
+	entry NodeListing
+	err   error
+}
+
+func (it *dirIterator) Next() bool {
+	for it.links != nil {
+		res, ok := <-it.links
+		if !ok {
+			it.Close()
+			return false
+		}
+		if res.Err != nil {
+			it.err = res.Err
+			it.Close()
+			return false
+		}
+
+		child, err := it.dir.Child(res.Link.Name)
+		if err == os.ErrNotExist {
+			// Removed after the iterator was created.
+			continue
+		}
+		if err == nil {
+			it.entry, err = nodeListing(res.Link.Name, child)
+		}
+		if err != nil {
+			it.err = err
+			it.Close()
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (it *dirIterator) Entry() NodeListing {
+	return it.entry
+}
+
+func (it *dirIterator) Err() error {
+	return it.err
+}
+
+func (it *dirIterator) Close() {
+	// Canceling the context stops the enumeration goroutine.
+	it.cancel()
+	it.links = nil
+}
+
+// DirSnapshot is a stable, read-only view of the entries of a `Directory`
+// at the time `OpenSnapshot` was called, unaffected by the changes made to
+// the directory afterwards. It's not safe for concurrent use.
+type DirSnapshot struct {
+	ctx  context.Context
+	ds   ipld.DAGService
+	node ipld.Node
+	dir  uio.Directory
+}
+
+// OpenSnapshot flushes this directory and returns a `DirSnapshot` of its
+// current entries.
+func (d *Directory) OpenSnapshot(ctx context.Context) (DirSnapshot, error) {
+	nd, err := flushedNode(d)
+	if err != nil {
+		return DirSnapshot{}, err
+	}
+	dir, err := uio.NewDirectoryFromNode(d.dagService, nd)
+	if err != nil {
+		return DirSnapshot{}, err
+	}
+	return DirSnapshot{
+		ctx:  ctx,
+		ds:   d.dagService,
+		node: nd,
+		dir:  dir,
+	}, nil
+}
+
+// Node returns the directory node of the snapshot.
+func (s DirSnapshot) Node() ipld.Node {
+	return s.node
+}
+
+// List returns the entries of the snapshot (in no particular order).
+func (s DirSnapshot) List() ([]NodeListing, error) {
+	var out []NodeListing
+	err := s.dir.ForEachLink(s.ctx, func(l *ipld.Link) error {
+		nd, err := s.ds.Get(s.ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+
+		entry := NodeListing{
+			Name: l.Name,
+			Type: int(TFile),
+			Hash: l.Cid.String(),
+		}
+		switch nd := nd.(type) {
+		case *dag.ProtoNode:
+			fsn, err := ft.FSNodeFromBytes(nd.Data())
+			if err != nil {
+				return err
+			}
+			if fsn.IsDir() {
+				entry.Type = int(TDir)
+			} else {
+				entry.Size = int64(fsn.FileSize())
+			}
+		case *dag.RawNode:
+			entry.Size = int64(len(nd.RawData()))
+		default:
+			return fmt.Errorf("unrecognized node type %T for entry %s", nd, l.Name)
+		}
+		out = append(out, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Get returns the node of the entry `name` of the snapshot, or
+// `os.ErrNotExist` if it had no such entry.
+func (s DirSnapshot) Get(name string) (ipld.Node, error) {
+	return s.dir.Find(s.ctx, name)
+}
@@ -0,0 +1,23 @@
+package mfs
+
+import (
+	bserv "github.com/ipfs/go-blockservice"
+	dag "github.com/ipfs/go-merkledag"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// NewMemDAGService returns a DAG service backed by an in-memory (map based)
+// thread-safe blockstore that never fetches blocks from the network.
+//
+// This is meant for tests (e.g., to construct a `Root` in the tests of code
+// using MFS), nothing stored in it is ever persisted or released.
+func NewMemDAGService() ipld.DAGService {
+	db := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := bstore.NewBlockstore(db)
+	return dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+}
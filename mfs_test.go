@@ -1,33 +1,37 @@
 package mfs
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	gopath "path"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	path "github.com/ipfs/go-path"
 
-	bserv "github.com/ipfs/go-blockservice"
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
 	importer "github.com/ipfs/go-unixfs/importer"
 	uio "github.com/ipfs/go-unixfs/io"
 
 	cid "github.com/ipfs/go-cid"
-	ds "github.com/ipfs/go-datastore"
-	dssync "github.com/ipfs/go-datastore/sync"
-	bstore "github.com/ipfs/go-ipfs-blockstore"
 	chunker "github.com/ipfs/go-ipfs-chunker"
-	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	u "github.com/ipfs/go-ipfs-util"
 	ipld "github.com/ipfs/go-ipld-format"
 )
@@ -37,10 +41,7 @@ func emptyDirNode() *dag.ProtoNode {
 }
 
 func getDagserv(t *testing.T) ipld.DAGService {
-	db := dssync.MutexWrap(ds.NewMapDatastore())
-	bs := bstore.NewBlockstore(db)
-	blockserv := bserv.New(bs, offline.Exchange(bs))
-	return dag.NewDAGService(blockserv)
+	return NewMemDAGService()
 }
 
 func getRandFile(t *testing.T, ds ipld.DAGService, size int64) ipld.Node {
@@ -1419,3 +1420,6160 @@ func TestFSNodeType(t *testing.T) {
 		t.Fatal("FSNode type should be file, but not")
 	}
 }
+
+func TestOpenFileNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+
+	nd := fileNodeFromReader(t, ds, bytes.NewReader([]byte("before")))
+	if err := rootdir.AddChild("file", nd); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := rootdir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wfd, err := fi.(*File).Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wfd.WriteAt([]byte("after!"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := wfd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rfd, err := OpenFileNode(ctx, ds, nd.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(rfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "before" {
+		t.Fatalf("expected previous contents, got %q", out)
+	}
+	if _, err := rfd.Write([]byte("x")); err == nil {
+		t.Fatal("expected write to a historical file to fail")
+	}
+	if err := rfd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dirNode, err := rootdir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileNode(ctx, ds, dirNode.Cid()); err == nil {
+		t.Fatal("expected opening a directory as a file to fail")
+	}
+}
+
+func TestDuplicateLinkPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	first := fileNodeFromReader(t, ds, bytes.NewReader([]byte("first")))
+	last := fileNodeFromReader(t, ds, bytes.NewReader([]byte("last")))
+
+	nd := emptyDirNode()
+	for _, fnd := range []ipld.Node{first, last} {
+		l, err := ipld.MakeLink(fnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nd.AddRawLink("dup", l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRoot(ctx, ds, nd, nil, WithDuplicateLinkPolicy(DuplicateLinkError)); !errors.Is(err, ErrDuplicateLink) {
+		t.Fatalf("expected ErrDuplicateLink, got %v", err)
+	}
+
+	for policy, expected := range map[DuplicateLinkPolicy]ipld.Node{
+		DuplicateLinkFirst: first,
+		DuplicateLinkLast:  last,
+	} {
+		rt, err := NewRoot(ctx, ds, nd, nil, WithDuplicateLinkPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := rt.GetDirectory().ListNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != "dup" {
+			t.Fatalf("expected a single entry, got %v", names)
+		}
+		if err := assertFileAtPath(ds, rt.GetDirectory(), expected, "dup"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDirectoryPreload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+	for i := 0; i < 10; i++ {
+		if err := rootdir.AddChild(fmt.Sprintf("file%d", i), getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := mkdirP(t, rootdir, "sub/inner")
+	if err := sub.AddChild("deep", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := rootdir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2, err := NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt2.GetDirectory()
+
+	if err := dir.Preload(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.entriesCache) != 11 {
+		t.Fatalf("expected 11 cached entries, got %d", len(dir.entriesCache))
+	}
+	subdir, ok := dir.entriesCache["sub"].(*Directory)
+	if !ok {
+		t.Fatal("expected sub to be a cached directory")
+	}
+	if len(subdir.entriesCache) != 0 {
+		t.Fatal("preload should not descend into subdirectories")
+	}
+}
+
+func TestNewRootFromCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 1000)
+	if err := rootdir.AddChild("afile", fi); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rootdir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt2, err := NewRootFromCid(ctx, ds, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, rt2.GetDirectory(), fi, "afile"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRootFromCid(ctx, ds, fi.Cid(), nil); err == nil {
+		t.Fatal("expected creating a root over a file to fail")
+	}
+
+	raw := dag.NewRawNode([]byte("raw"))
+	if err := ds.Add(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRootFromCid(ctx, ds, raw.Cid(), nil); err == nil {
+		t.Fatal("expected creating a root over a raw node to fail")
+	}
+}
+
+func TestListRecursive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+	mkdirP(t, rootdir, "a/b")
+	mkdirP(t, rootdir, "c")
+	if err := PutNode(rt, "/a/b/f1", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a.txt", getRandFile(t, ds, 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := rootdir.ListRecursive(ctx, ListRecursiveOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range listing {
+		names = append(names, l.Name)
+	}
+	if !compStrArrs(names, []string{"a", "a.txt", "a/b", "a/b/f1", "c"}) {
+		t.Fatalf("unexpected listing: %v", names)
+	}
+	if listing[1].Size != 200 || listing[1].Type != int(TFile) {
+		t.Fatalf("unexpected entry for a.txt: %+v", listing[1])
+	}
+
+	listing, err = rootdir.ListRecursive(ctx, ListRecursiveOpts{FilesOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 2 || listing[0].Name != "a.txt" || listing[1].Name != "a/b/f1" {
+		t.Fatalf("unexpected files only listing: %v", listing)
+	}
+
+	var walked []string
+	err = Walk(ctx, rootdir, func(path string, nd FSNode) error {
+		walked = append(walked, path)
+		if path == "a" {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(walked, []string{"a", "a.txt", "c"}) {
+		t.Fatalf("unexpected walk: %v", walked)
+	}
+}
+
+func TestUnlinkReturn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 1000)
+	if err := rootdir.AddChild("afile", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := rootdir.UnlinkReturn("afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(fi.Cid()) {
+		t.Fatal("unlinked node doesn't match the added one")
+	}
+	if err := assertDirAtPath(rootdir, "/", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rootdir.UnlinkReturn("afile"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	// Undo the removal.
+	if err := rootdir.AddChild("afile", nd); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, rootdir, fi, "afile"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileAppendFrom(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+	start := make([]byte, 300000)
+	u.NewTimeSeededRand().Read(start)
+	if err := rootdir.AddChild("log", fileNodeFromReader(t, ds, bytes.NewReader(start))); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := rootdir.Child("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	more := make([]byte, 500000)
+	u.NewTimeSeededRand().Read(more)
+	n, err := fi.AppendFrom(ctx, bytes.NewReader(more))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(more)) {
+		t.Fatalf("expected to append %d bytes, appended %d", len(more), n)
+	}
+
+	rfd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfd.Close()
+	out, err := io.ReadAll(rfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, append(start, more...)) {
+		t.Fatal("appended file contents don't match")
+	}
+
+	// Files stored in a single block (or none) keep their contents.
+	for name, nd := range map[string]ipld.Node{
+		"small": fileNodeFromReader(t, ds, strings.NewReader("hello")),
+		"raw":   dag.NewRawNode([]byte("hello")),
+		"empty": ft.EmptyFileNode(),
+	} {
+		if err := rootdir.AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := lookupFile(rt, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fi.AppendFrom(ctx, strings.NewReader(" world")); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "hello world"
+		if name == "empty" {
+			expected = " world"
+		}
+		rfd, err := fi.Open(Flags{Read: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(rfd)
+		rfd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Fatalf("%s: expected %q after appending, got %q", name, expected, out)
+		}
+	}
+}
+
+func TestRootCompact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+
+	big := mkdirP(t, rt.GetDirectory(), "big")
+	fi := getRandFile(t, ds, 100)
+	var names []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("entry%02d", i)
+		names = append(names, name)
+		if err := big.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isShard := func() bool {
+		nd, err := big.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := ft.FSNodeFromBytes(nd.(*dag.ProtoNode).Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsn.Type() == ft.THAMTShard
+	}
+	if !isShard() {
+		t.Fatal("expected directory to be sharded")
+	}
+
+	// Raising the threshold leaves the shard redundant.
+	uio.HAMTShardingSize = 256 * 1024
+	report, err := rt.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Compacted != 1 || report.BytesReclaimed <= 0 {
+		t.Fatalf("unexpected compact report: %+v", report)
+	}
+	if isShard() {
+		t.Fatal("expected directory to be unsharded")
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "/big", names); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileAutoFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootdir := rt.GetDirectory()
+	if err := rootdir.AddChild("file", ft.EmptyFileNode()); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := rootdir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	fd, err := fi.Open(Flags{Write: true}, WithAutoFlush(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("flushed in the background")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent directory should eventually see the written data
+	// without an explicit flush.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dirNode, err := rootdir.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lnk, err := dirNode.(*dag.ProtoNode).GetNodeLink("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lnk.Cid.Equals(ft.EmptyFileNode().Cid()) {
+			nd, err := ds.Get(ctx, lnk.Cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := catNode(ds, nd.(*dag.ProtoNode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "flushed in the background" {
+				t.Fatalf("unexpected flushed data: %q", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("file was never flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWithoutRepublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), func(ctx context.Context, c cid.Cid) error {
+		t.Error("publish function should never be called")
+		return nil
+	}, WithoutRepublisher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.repub != nil {
+		t.Fatal("no republisher should have been created")
+	}
+
+	if err := Mkdir(rt, "/a", MkdirOpts{Flush: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FlushPath(ctx, rt, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStructuralHash(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	fi := getRandFile(t, ds, 1000)
+	build := func(builder cid.Builder) *Root {
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true, CidBuilder: builder}); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutNode(rt, "/a/b/file", fi); err != nil {
+			t.Fatal(err)
+		}
+		return rt
+	}
+
+	rt1 := build(nil)
+	rt2 := build(cid.V1Builder{Codec: cid.DagProtobuf, MhType: 0x12})
+	d1, d2 := rt1.GetDirectory(), rt2.GetDirectory()
+
+	n1, err := d1.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := d2.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1.Cid().Equals(n2.Cid()) {
+		t.Fatal("expected both trees to have different CIDs")
+	}
+
+	h1, err := d1.StructuralHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := d2.StructuralHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h1, h2) {
+		t.Fatal("trees with the same entries should have the same structural hash")
+	}
+
+	if err := PutNode(rt2, "/a/other", fi); err != nil {
+		t.Fatal(err)
+	}
+	h3, err := d2.StructuralHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(h1, h3) {
+		t.Fatal("adding an entry should change the structural hash")
+	}
+}
+
+func TestWriteBufferBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 5*chunker.DefaultBlockSize+12345)
+	u.NewTimeSeededRand().Read(data)
+
+	write := func(name string, seek int64, opts ...OpenOption) ipld.Node {
+		if err := rt.GetDirectory().AddChild(name, ft.EmptyFileNode()); err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := rt.GetDirectory().Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi := fsn.(*File)
+		fd, err := fi.Open(Flags{Write: true, Sync: true}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seek > 0 {
+			// Start with whole blocks and overwrite them from an
+			// unaligned offset, past the end of the file.
+			if _, err := fd.Write(data[:4*chunker.DefaultBlockSize]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fd.Seek(seek, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Write in odd sized pieces to cross block boundaries.
+		for b := data; len(b) > 0; {
+			n := 100000
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := fd.Write(b[:n]); err != nil {
+				t.Fatal(err)
+			}
+			b = b[n:]
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+
+	for _, seek := range []int64{0, chunker.DefaultBlockSize + 777} {
+		unlimited := write(fmt.Sprintf("unlimited-%d", seek), seek)
+		limited := write(fmt.Sprintf("limited-%d", seek), seek, WithWriteBufferBlocks(2))
+		if !unlimited.Cid().Equals(limited.Cid()) {
+			t.Fatalf("limiting the write buffer changed the resulting file (seek %d)", seek)
+		}
+	}
+}
+
+func TestWriteBufferBlocksMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 1 GiB")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	// Every block has the same contents, so the DAG service stores a
+	// single leaf and the heap only grows with what the descriptor buffers.
+	block := make([]byte, chunker.DefaultBlockSize)
+	u.NewTimeSeededRand().Read(block)
+	const size = 1 << 30
+	const limit = 2
+
+	if err := rt.GetDirectory().AddChild("big", ft.EmptyFileNode()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fi.Open(Flags{Write: true, Sync: true}, WithWriteBufferBlocks(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The DAG service keeps every version of the file's internal nodes, so
+	// the heap slowly grows with the amount written: check how much it grows
+	// within a window of writes, which the unlimited 2 MiB `DagModifier`
+	// buffer would exceed.
+	const window = 8
+	var ms runtime.MemStats
+	var samples []uint64
+	var peak uint64
+	for written := 0; written < size; written += len(block) {
+		if _, err := fd.Write(block); err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		samples = append(samples, ms.HeapAlloc)
+		if len(samples) > window {
+			samples = samples[1:]
+		}
+		low := samples[0]
+		for _, s := range samples {
+			if s < low {
+				low = s
+			}
+		}
+		if ms.HeapAlloc-low > peak {
+			peak = ms.HeapAlloc - low
+		}
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Growing the buffer may leave it with up to 1.5 times the capacity
+	// of the data it holds.
+	if max := uint64(2 * limit * chunker.DefaultBlockSize); peak > max {
+		t.Fatalf("heap grew by %d bytes within %d writes, expected at most %d", peak, window, max)
+	}
+	if s, err := fi.Size(); err != nil || s != size {
+		t.Fatalf("expected a size of %d, got %d (%v)", size, s, err)
+	}
+}
+
+func TestWalkSince(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for _, p := range []string{"/static/a", "/static/b", "/changing"} {
+		if err := Mkdir(rt, p, MkdirOpts{Mkparents: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PutNode(rt, "/static/a/file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	known := make(map[string]cid.Cid)
+	record := func(path string, nd FSNode) error {
+		n, err := nd.GetNode()
+		if err != nil {
+			return err
+		}
+		known[path] = n.Cid()
+		return nil
+	}
+	if err := rt.WalkSince(ctx, known, record); err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != 5 {
+		t.Fatalf("expected to visit the whole tree, got %v", known)
+	}
+
+	if err := PutNode(rt, "/changing/new", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	var visited []string
+	err := rt.WalkSince(ctx, known, func(path string, nd FSNode) error {
+		visited = append(visited, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(visited, []string{"/changing", "/changing/new"}) {
+		t.Fatalf("unexpected visited paths: %v", visited)
+	}
+}
+
+func TestFSNodeUniformMethods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/dir", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/file", ft.EmptyFileNode()); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := cid.V1Builder{Codec: cid.DagProtobuf, MhType: 0x12}
+	for _, p := range []string{"/dir", "/file"} {
+		fsn, err := Lookup(rt, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsn.SetCidBuilder(v1)
+	}
+
+	fsn, err := Lookup(rt, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := AsFile(fsn); ok {
+		t.Fatal("directory returned as a file")
+	}
+	if d, ok := AsDir(fsn); !ok || d.GetCidBuilder().(cid.V1Builder) != v1 {
+		t.Fatal("expected a directory with the v1 builder")
+	}
+
+	fsn, err = Lookup(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := AsDir(fsn); ok {
+		t.Fatal("file returned as a directory")
+	}
+	fi, ok := AsFile(fsn)
+	if !ok {
+		t.Fatal("expected a file")
+	}
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := fi.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Version() != 1 {
+		t.Fatalf("expected the written file to use the v1 builder, got %s", nd.Cid())
+	}
+}
+
+func TestUnlinkMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+
+	dir := mkdirP(t, rt.GetDirectory(), "dir")
+	fi := getRandFile(t, ds, 100)
+	var toRemove []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("entry%02d", i)
+		if i >= 2 {
+			toRemove = append(toRemove, name)
+		}
+		if err := dir.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	missing, err := dir.UnlinkMany(append(toRemove, "nope"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(missing, []string{"nope"}) {
+		t.Fatalf("unexpected missing names: %v", missing)
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "/dir", []string{"entry00", "entry01"}); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := ft.FSNodeFromBytes(nd.(*dag.ProtoNode).Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != ft.TDirectory {
+		t.Fatal("expected the directory to be converted back to a basic one")
+	}
+}
+
+func TestDeterministicRoot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	files := make(map[string]ipld.Node)
+	var paths []string
+	for i := 0; i < 20; i++ {
+		p := fmt.Sprintf("/d%d/f%d", i%4, i)
+		paths = append(paths, p)
+		files[p] = getRandFile(t, ds, 100)
+	}
+
+	build := func(order []string) cid.Cid {
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithDeterministic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range order {
+			dir, _ := gopath.Split(p)
+			if err := Mkdir(rt, dir, MkdirOpts{Mkparents: true}); err != nil {
+				t.Fatal(err)
+			}
+			if err := PutNode(rt, p, files[p]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nd, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rt.GetDirectory().modTime.IsZero() {
+			t.Fatal("deterministic roots shouldn't record modification times")
+		}
+		return nd.Cid()
+	}
+
+	first := build(paths)
+	reversed := make([]string, len(paths))
+	for i, p := range paths {
+		reversed[len(paths)-1-i] = p
+	}
+	if second := build(reversed); !first.Equals(second) {
+		t.Fatalf("building the same tree produced different CIDs: %s != %s", first, second)
+	}
+}
+
+func TestAdaptiveChunking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithAdaptiveChunking())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, size int, opts ...OpenOption) *dag.ProtoNode {
+		if err := rt.GetDirectory().AddChild(name, ft.EmptyFileNode()); err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := rt.GetDirectory().Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi := fsn.(*File)
+		fd, err := fi.Open(Flags{Write: true, Sync: true}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		u.NewTimeSeededRand().Read(data)
+		if _, err := fd.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.(*dag.ProtoNode)
+	}
+
+	small := write("small", 200000)
+	if len(small.Links()) != 4 {
+		t.Fatalf("expected 4 small chunks, got %d", len(small.Links()))
+	}
+	for _, l := range small.Links() {
+		if l.Cid.Type() != cid.Raw {
+			t.Fatal("expected small files to use raw leaves")
+		}
+	}
+
+	large := write("large", 1500000, WithSizeHint(4*1024*1024))
+	var leafSizes []int
+	var collect func(nd ipld.Node)
+	collect = func(nd ipld.Node) {
+		if len(nd.Links()) == 0 {
+			data, err := ft.ReadUnixFSNodeData(nd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leafSizes = append(leafSizes, len(data))
+			return
+		}
+		for _, l := range nd.Links() {
+			child, err := l.GetNode(ctx, ds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			collect(child)
+		}
+	}
+	collect(large)
+	fixed := true
+	for _, size := range leafSizes[:len(leafSizes)-1] {
+		if int64(size) != chunker.DefaultBlockSize {
+			fixed = false
+		}
+	}
+	if fixed {
+		t.Fatalf("expected large files to use a content-defined chunker, got leaves of %v", leafSizes)
+	}
+}
+
+func TestStatInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/b/file", getRandFile(t, ds, 1234)); err != nil {
+		t.Fatal(err)
+	}
+
+	var info os.FileInfo
+	info, err := StatInfo(rt, "/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "file" || info.Size() != 1234 || info.IsDir() || info.Mode() != 0 || !info.ModTime().IsZero() {
+		t.Fatalf("unexpected file info: %v %v %v %v", info.Name(), info.Size(), info.Mode(), info.ModTime())
+	}
+
+	info, err = StatInfo(rt, "/a/b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "b" || !info.IsDir() || !info.Mode().IsDir() {
+		t.Fatalf("unexpected directory info: %v %v", info.Name(), info.Mode())
+	}
+	if _, ok := info.Sys().(*Directory); !ok {
+		t.Fatal("expected Sys to return the directory")
+	}
+
+	if info, err = StatInfo(rt, "/"); err != nil || info.Name() != "/" || !info.IsDir() {
+		t.Fatalf("unexpected root info: %v", err)
+	}
+}
+
+func TestMaxPathDepth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithMaxPathDepth(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/a/b/c", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/b/c/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/b/c/d"); err != ErrPathTooDeep {
+		t.Fatalf("expected ErrPathTooDeep, got %v", err)
+	}
+
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DirLookup(a, "b/c/d/e"); err != ErrPathTooDeep {
+		t.Fatalf("expected ErrPathTooDeep, got %v", err)
+	}
+}
+
+func TestFindAndPruneDangling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	kept := getRandFile(t, ds, 100)
+	lost := dag.NodeWithData(ft.FilePBData([]byte("lost"), 4))
+	if err := PutNode(rt, "/a/kept", kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/b/lost", lost); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Remove(ctx, lost.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	rt2, err := NewRootFromCid(ctx, ds, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dangling, err := rt2.FindDangling(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dangling) != 1 || dangling[0].Path != "/a/b/lost" || !dangling[0].Cid.Equals(lost.Cid()) {
+		t.Fatalf("unexpected dangling links: %v", dangling)
+	}
+
+	n, err := rt2.PruneDangling(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected to prune 1 entry, pruned %d", n)
+	}
+	if err := assertDirAtPath(rt2.GetDirectory(), "/a/b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, rt2.GetDirectory(), kept, "a/kept"); err != nil {
+		t.Fatal(err)
+	}
+	if dangling, err := rt2.FindDangling(ctx); err != nil || len(dangling) != 0 {
+		t.Fatalf("expected no dangling links left, got %v (%v)", dangling, err)
+	}
+}
+
+func TestReachableSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 1000)
+	// The same file twice, its blocks must be reported once.
+	if err := PutNode(rt, "/a/x", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/y", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	rootNd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := cid.NewSet()
+	err = dag.Walk(ctx, dag.GetLinksDirect(ds), rootNd.Cid(), expected.Visit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := rt.ReachableSet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != expected.Len() {
+		t.Fatalf("expected %d reachable blocks, got %d", expected.Len(), set.Len())
+	}
+	for _, c := range []cid.Cid{rootNd.Cid(), fi.Cid()} {
+		if !set.Has(c) {
+			t.Fatalf("%s missing from the reachable set", c)
+		}
+	}
+
+	visits := 0
+	err = rt.WalkReachable(ctx, func(c cid.Cid) error {
+		if !expected.Has(c) {
+			t.Fatalf("unexpected block %s", c)
+		}
+		visits++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visits <= expected.Len() {
+		t.Fatalf("expected the shared file to be walked twice, got %d visits for %d blocks", visits, expected.Len())
+	}
+}
+
+func TestTryAddChild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	dir.lock.Lock()
+	added, err := dir.TryAddChild("a", emptyDirNode())
+	dir.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added {
+		t.Fatal("expected the add to be skipped while the lock is held")
+	}
+	if _, err := dir.Child("a"); err != os.ErrNotExist {
+		t.Fatalf("expected no entry, got %v", err)
+	}
+
+	added, err = dir.TryAddChild("a", emptyDirNode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Fatal("expected the add to be performed")
+	}
+	if err := assertDirAtPath(dir, "/a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.TryAddChild("a", emptyDirNode()); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+}
+
+// Counts (and optionally delays) the calls adding nodes to the DAG service.
+type slowDagService struct {
+	ipld.DAGService
+	latency time.Duration
+
+	lk       sync.Mutex
+	adds     int
+	addManys int
+}
+
+func (s *slowDagService) Add(ctx context.Context, nd ipld.Node) error {
+	s.lk.Lock()
+	s.adds++
+	s.lk.Unlock()
+	time.Sleep(s.latency)
+	return s.DAGService.Add(ctx, nd)
+}
+
+func (s *slowDagService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	s.lk.Lock()
+	s.addManys++
+	s.lk.Unlock()
+	time.Sleep(s.latency)
+	return s.DAGService.AddMany(ctx, nds)
+}
+
+// Builds a tree of `width` directories with `width` subdirectories each
+// and flushes it, returning the root CID.
+func flushWideTree(ctx context.Context, t testing.TB, ds ipld.DAGService, width int, opts ...RootOption) cid.Cid {
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < width; i++ {
+		for j := 0; j < width; j++ {
+			err := Mkdir(rt, fmt.Sprintf("/d%d/d%d", i, j), MkdirOpts{Mkparents: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd.Cid()
+}
+
+func TestFlushBatchSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expected := flushWideTree(ctx, t, getDagserv(t), 10)
+
+	ds := &slowDagService{DAGService: getDagserv(t)}
+	c := flushWideTree(ctx, t, ds, 10, WithFlushBatchSize(1024))
+	if !c.Equals(expected) {
+		t.Fatalf("expected root %s, got %s", expected, c)
+	}
+	if ds.addManys == 0 {
+		t.Fatal("expected the flush to add nodes in batches")
+	}
+}
+
+func BenchmarkFlushWideTree(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, bc := range []struct {
+		name string
+		opts []RootOption
+	}{
+		{"per-node", nil},
+		{"batch", []RootOption{WithFlushBatchSize(1024)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ds := &slowDagService{DAGService: NewMemDAGService(), latency: 100 * time.Microsecond}
+				flushWideTree(ctx, b, ds, 10, bc.opts...)
+			}
+		})
+	}
+}
+
+func TestListByType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for _, d := range []string{"/d1", "/d2"} {
+		if err := Mkdir(rt, d, MkdirOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PutNode(rt, "/f1", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/f2", dag.NewRawNode([]byte("raw"))); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fresh root has no cached entries.
+	rt2, err := NewRootFromCid(ctx, ds, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Root{rt, rt2} {
+		dirs, err := r.GetDirectory().ListByType(ctx, TDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := r.GetDirectory().ListByType(ctx, TFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(dirs)
+		sort.Strings(files)
+		if !compStrArrs(dirs, []string{"d1", "d2"}) {
+			t.Fatalf("unexpected directories: %v", dirs)
+		}
+		if !compStrArrs(files, []string{"f1", "f2"}) {
+			t.Fatalf("unexpected files: %v", files)
+		}
+	}
+	if len(rt2.GetDirectory().entriesCache) != 0 {
+		t.Fatal("expected ListByType to leave the entries uncached")
+	}
+}
+
+func TestFileMatches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	nd := fileNodeFromReader(t, ds, bytes.NewReader(data))
+	if err := PutNode(rt, "/f", nd); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := FileMatches(rt, "/f", nd.Cid()); err != nil || !ok {
+		t.Fatalf("expected the CID to match (%v)", err)
+	}
+	if ok, err := FileMatches(rt, "/f", emptyDirNode().Cid()); err != nil || ok {
+		t.Fatalf("expected a different CID not to match (%v)", err)
+	}
+
+	if ok, err := FileMatchesBytes(rt, "/f", data); err != nil || !ok {
+		t.Fatalf("expected the content to match (%v)", err)
+	}
+	if ok, err := FileMatchesBytes(rt, "/f", data[:len(data)-1]); err != nil || ok {
+		t.Fatalf("expected a different size not to match (%v)", err)
+	}
+	other := append([]byte{}, data...)
+	other[len(other)-1]++
+	if ok, err := FileMatchesBytes(rt, "/f", other); err != nil || ok {
+		t.Fatalf("expected different content not to match (%v)", err)
+	}
+
+	if err := Mkdir(rt, "/d", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FileMatches(rt, "/d", nd.Cid()); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+}
+
+func TestRootNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	fi := getRandFile(t, ds, 100)
+	if err := PutNode(rt, "/f", fi); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.RootNode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := nd.Cid()
+
+	pbnd := nd.(*dag.ProtoNode)
+	pbnd.Links()[0].Name = "mutated"
+	pbnd.SetData([]byte("mutated"))
+	if err := pbnd.AddNodeLink("other", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	nd2, err := rt.RootNode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd2.Cid().Equals(expected) {
+		t.Fatal("mutating the returned node changed the root")
+	}
+	if err := assertFileAtPath(ds, rt.GetDirectory(), fi, "f"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportZip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{
+		"a/x":   make([]byte, 300000),
+		"a/b/y": []byte("hello"),
+		"z":     {},
+	}
+	for p, data := range contents {
+		rand.Read(data)
+		if err := PutNode(rt, "/"+p, fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link, err := ft.SymlinkData("b/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/l", dag.NodeWithData(link)); err != nil {
+		t.Fatal(err)
+	}
+	contents["a/l"] = []byte("b/y")
+
+	var buf bytes.Buffer
+	if err := ExportZip(ctx, rt.GetDirectory(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if isLink := f.Mode()&os.ModeSymlink != 0; isLink != (f.Name == "a/l") {
+			t.Fatalf("unexpected mode %v for %s", f.Mode(), f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents[f.Name]) {
+			t.Fatalf("content mismatch for %s", f.Name)
+		}
+	}
+	if !compStrArrs(names, []string{"a/", "a/b/", "a/b/y", "a/l", "a/x", "z"}) {
+		t.Fatalf("unexpected archive entries: %v", names)
+	}
+
+	raw := dag.NodeWithData([]byte("not unixfs"))
+	if err := ds.Add(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddRawChild("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportZip(ctx, rt.GetDirectory(), io.Discard); err != ErrInvalidChild {
+		t.Fatalf("expected ErrInvalidChild exporting an opaque entry, got %v", err)
+	}
+}
+
+func TestFileOpenAt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 300000)
+	rand.Read(data)
+	if err := PutNode(rt, "/f", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	fd, err := fi.OpenAt(Flags{Read: true}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data[1000:]) {
+		t.Fatal("unexpected content read at offset 1000")
+	}
+	fd.Close()
+
+	end := int64(len(data))
+	if _, err := fi.OpenAt(Flags{Read: true}, end+1); err == nil {
+		t.Fatal("expected an error opening past the end for reading")
+	}
+
+	fd, err = fi.OpenAt(Flags{Write: true, Sync: true}, end+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err = fi.Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	out, err = io.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, append(data, 0, 0, 'a', 'b')) {
+		t.Fatalf("unexpected content after writing past the end (%d bytes)", len(out))
+	}
+
+	// Files stored in a single block, written before, at and past the end.
+	for offset, expected := range map[int64]string{
+		2:  "hexlo",
+		5:  "hellox",
+		10: "hello\x00\x00\x00\x00\x00x",
+	} {
+		for _, nd := range []ipld.Node{
+			fileNodeFromReader(t, ds, strings.NewReader("hello")),
+			dag.NewRawNode([]byte("hello")),
+		} {
+			if err := PutNode(rt, "/small", nd); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := lookupFile(rt, "/small")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd, err := fi.OpenAt(Flags{Write: true, Sync: true}, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fd.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fd.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			fd, err = fi.Open(Flags{Read: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(fd)
+			fd.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != expected {
+				t.Fatalf("expected %q writing at %d, got %q", expected, offset, out)
+			}
+			if err := rt.GetDirectory().Unlink("small"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/skip", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 1000)
+	for _, p := range []string{"/a/f", "/skip/f"} {
+		if err := PutNode(rt, p, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos := make(map[string]NodeInfo)
+	err := rt.Inspect(ctx, func(path string, info NodeInfo) error {
+		infos[path] = info
+		if path == "/skip" {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for p := range infos {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if !compStrArrs(paths, []string{"/", "/a", "/a/b", "/a/f", "/skip"}) {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+
+	if info := infos["/"]; info.Type != TDir || info.Children != 2 || !info.Mode.IsDir() {
+		t.Fatalf("unexpected root info: %+v", info)
+	}
+	if info := infos["/a"]; info.Name != "a" || info.Children != 2 {
+		t.Fatalf("unexpected directory info: %+v", info)
+	}
+	info := infos["/a/f"]
+	if info.Name != "f" || info.Type != TFile || info.Size != 1000 || !info.Cid.Equals(fi.Cid()) || info.Mode.IsDir() {
+		t.Fatalf("unexpected file info: %+v", info)
+	}
+}
+
+func TestCidVersionConversion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 600000)
+	rand.Read(data)
+	if err := PutNode(rt, "/a/b/f", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := rt.ToV1(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() != 1 {
+		t.Fatalf("expected a CIDv1 root, got %s", c)
+	}
+	set, err := rt.ReachableSet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.ForEach(func(c cid.Cid) error {
+		if c.Version() != 1 {
+			return fmt.Errorf("block %s not converted", c)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := Lookup(rt, "/a/b/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnd, err := fsn.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := catNode(ds, fnd.(*dag.ProtoNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("file content changed by the conversion")
+	}
+	if err := Mkdir(rt, "/new", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := Lookup(rt, "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := nd.GetNode(); n.Cid().Version() != 1 {
+		t.Fatal("expected new directories to use CIDv1")
+	}
+	if err := rt.GetDirectory().Unlink("new"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = rt.ToV0(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(orig.Cid()) {
+		t.Fatalf("expected the conversion back to CIDv0 to restore %s, got %s", orig.Cid(), c)
+	}
+}
+
+func TestDirectoryIterator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	defer func(old int) { uio.HAMTShardingSize = old }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+
+	dir := rt.GetDirectory()
+	var expected []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, name)
+	}
+
+	it, err := dir.Iterator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes made during the iteration.
+	if err := dir.Unlink("f00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("new", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for it.Next() {
+		if it.Entry().Type != int(TFile) || it.Entry().Size != 10 {
+			t.Fatalf("unexpected entry %+v", it.Entry())
+		}
+		names = append(names, it.Entry().Name)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	sort.Strings(names)
+	if !compStrArrs(names, expected[1:]) {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+
+	// Stopping early.
+	it, err = dir.Iterator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expected an entry")
+	}
+	it.Close()
+	if it.Next() {
+		t.Fatal("expected no entries after Close")
+	}
+}
+
+func TestReplaceBase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	if err := Mkdir(rt, "/old", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the new tree on its own.
+	other, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(other, "/new/sub", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 100)
+	if err := PutNode(other, "/new/f", fi); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := other.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.ReplaceBase(ctx, fi); err == nil {
+		t.Fatal("expected an error replacing the root with a file")
+	}
+	if err := rt.ReplaceBase(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Lookup(rt, "/old"); err != os.ErrNotExist {
+		t.Fatalf("expected the old tree to be gone, got %v", err)
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "/new/sub", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, rt.GetDirectory(), fi, "new/f"); err != nil {
+		t.Fatal(err)
+	}
+	rnd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rnd.Cid().Equals(nd.Cid()) {
+		t.Fatalf("expected root %s, got %s", nd.Cid(), rnd.Cid())
+	}
+}
+
+func TestShardHysteresis(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardHysteresis(10, 10)); err == nil {
+		t.Fatal("expected an error with down >= up")
+	}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardHysteresis(20, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 10)
+
+	add := func(i int) {
+		if err := dir.AddChild(fmt.Sprintf("f%02d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(i int) {
+		if err := dir.Unlink(fmt.Sprintf("f%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(sharded bool, conversions int) {
+		t.Helper()
+		if dir.isShardedUnsync() != sharded {
+			t.Fatalf("expected sharded to be %v", sharded)
+		}
+		if dir.ConversionCount() != conversions {
+			t.Fatalf("expected %d conversions, got %d", conversions, dir.ConversionCount())
+		}
+	}
+
+	for i := 0; i < 19; i++ {
+		add(i)
+	}
+	check(false, 0)
+	add(19)
+	check(true, 1)
+
+	// Churn around the shard-up threshold doesn't convert back.
+	for i := 0; i < 5; i++ {
+		remove(19)
+		add(19)
+	}
+	check(true, 1)
+
+	for i := 19; i >= 10; i-- {
+		remove(i)
+	}
+	check(true, 1)
+	remove(9)
+	check(false, 2)
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 9 {
+		t.Fatalf("expected 9 entries, got %d", len(names))
+	}
+}
+
+func TestConversionCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	defer func(old int) { uio.HAMTShardingSize = old }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 10)
+	i := 0
+	for !dir.isShardedUnsync() {
+		if err := dir.AddChild(fmt.Sprintf("f%02d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+
+	// Without hysteresis the directory thrashes around the threshold.
+	observed := 1
+	last := fmt.Sprintf("f%02d", i-1)
+	for j := 0; j < 3; j++ {
+		for _, op := range []func() error{
+			func() error { return dir.Unlink(last) },
+			func() error { return dir.AddChild(last, fi) },
+		} {
+			sharded := dir.isShardedUnsync()
+			if err := op(); err != nil {
+				t.Fatal(err)
+			}
+			if dir.isShardedUnsync() != sharded {
+				observed++
+			}
+		}
+	}
+	if observed < 3 {
+		t.Fatalf("expected the directory to thrash, observed %d conversions", observed)
+	}
+	if n := dir.ConversionCount(); n != observed {
+		t.Fatalf("expected %d conversions, got %d", observed, n)
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 300000)
+	rand.Read(data)
+	if err := PutNode(rt, "/f.bin", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/page", fileNodeFromReader(t, ds, strings.NewReader("<html><body>hi</body></html>"))); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/f.bin", nil)
+	req.Header.Set("Range", "bytes=1000-1999")
+	w := httptest.NewRecorder()
+	if err := ServeFile(w, req, rt, "/f.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected a partial content response, got %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data[1000:2000]) {
+		t.Fatal("unexpected range content")
+	}
+
+	w = httptest.NewRecorder()
+	if err := ServeFile(w, httptest.NewRequest("GET", "/page", nil), rt, "/page"); err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("expected a sniffed text/html content type, got %q", ct)
+	}
+
+	w = httptest.NewRecorder()
+	if err := ServeFile(w, httptest.NewRequest("GET", "/missing", nil), rt, "/missing"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected a 404, got %d", w.Code)
+	}
+}
+
+func TestClone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 300000)
+	if err := PutNode(rt, "/a/b/f", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	to := getDagserv(t)
+	// A block already present in the destination is kept.
+	if err := to.Add(ctx, fi); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := Clone(ctx, rt, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig, err := rt.ReachableSet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orig.ForEach(func(c cid.Cid) error {
+		_, err := to.Get(ctx, c)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(to, clone.GetDirectory(), fi, "a/b/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both trees are independent.
+	if err := Mkdir(clone, "/a/c", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/c"); err != os.ErrNotExist {
+		t.Fatalf("expected the change to be local to the clone, got %v", err)
+	}
+}
+
+func TestNameValidator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	for _, name := range []string{"", ".", "..", "a/b", "a\x00b", "tab\t", strings.Repeat("x", MaxStrictNameLength+1)} {
+		if err := StrictNameValidator(name); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("expected %q to be rejected, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"a", "file.txt", "ünïcode", strings.Repeat("x", MaxStrictNameLength)} {
+		if err := StrictNameValidator(name); err != nil {
+			t.Fatalf("expected %q to be accepted, got %v", name, err)
+		}
+	}
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithNameValidator(StrictNameValidator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	if _, err := dir.Mkdir(".."); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected Mkdir to reject the name, got %v", err)
+	}
+	if err := dir.AddChild("bad\n", getRandFile(t, ds, 10)); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected AddChild to reject the name, got %v", err)
+	}
+	if err := PutNode(rt, "/ok", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/ok", "/bad\x01"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected Mv to reject the name, got %v", err)
+	}
+	if _, err := Lookup(rt, "/ok"); err != nil {
+		t.Fatalf("expected the source of the rejected move to remain, got %v", err)
+	}
+}
+
+func TestNewBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/b/old", getRandFile(t, ds, 300000)); err != nil {
+		t.Fatal(err)
+	}
+	base, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := getRandFile(t, ds, 300000)
+	if err := PutNode(rt, "/a/new", added); err != nil {
+		t.Fatal(err)
+	}
+	target, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := NewBlocks(ctx, ds, base.Cid(), target.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new file, plus the new versions of "/a" and the root.
+	expected := cid.NewSet()
+	err = dag.Walk(ctx, dag.GetLinksDirect(ds), added.Cid(), expected.Visit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aNd, err := Lookup(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := aNd.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Add(a.Cid())
+	expected.Add(target.Cid())
+
+	if set.Len() != expected.Len() {
+		t.Fatalf("expected %d new blocks, got %d", expected.Len(), set.Len())
+	}
+	err = expected.ForEach(func(c cid.Cid) error {
+		if !set.Has(c) {
+			return fmt.Errorf("%s missing from the new blocks", c)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 100)
+	if err := dir.AddChild("f", fi); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Mkdir("d"); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := dir.OpenSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("g", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := snap.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	if len(entries) != 2 || entries[0].Name != "d" || entries[0].Type != int(TDir) ||
+		entries[1].Name != "f" || entries[1].Type != int(TFile) || entries[1].Size != 100 {
+		t.Fatalf("unexpected snapshot entries: %+v", entries)
+	}
+
+	nd, err := snap.Get("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(fi.Cid()) {
+		t.Fatal("unexpected node for the snapshot entry")
+	}
+	if _, err := snap.Get("g"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist for an entry added later, got %v", err)
+	}
+}
+
+func TestPathsFor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 100)
+	for _, p := range []string{"/a/b/f", "/a/copy", "/top"} {
+		if err := PutNode(rt, p, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := rt.PathsFor(ctx, fi.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(paths, []string{"/a/b/f", "/a/copy", "/top"}) {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+
+	root, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := rt.PathsFor(ctx, root.Cid()); err != nil || !compStrArrs(paths, []string{"/"}) {
+		t.Fatalf("unexpected paths for the root: %v (%v)", paths, err)
+	}
+	if paths, err := rt.PathsFor(ctx, emptyDirNode().Cid()); err != nil || len(paths) != 0 {
+		t.Fatalf("expected no paths, got %v (%v)", paths, err)
+	}
+
+	// A copy of a directory isn't walked again.
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aNd, err := a.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a2", aNd); err != nil {
+		t.Fatal(err)
+	}
+	root, err = rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &flakyDagService{DAGService: ds, reads: make(map[cid.Cid]int)}
+	reopened, err := NewRoot(ctx, counting, root.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err = reopened.PathsFor(ctx, fi.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(paths, []string{"/a/b/f", "/a/copy", "/a2/b/f", "/a2/copy", "/top"}) {
+		t.Fatalf("unexpected paths with a copied directory: %v", paths)
+	}
+	if n := counting.reads[fi.Cid()]; n != 3 {
+		t.Fatalf("expected the copied directory not to be walked, the file was fetched %d times", n)
+	}
+}
+
+func TestFileWriteExpecting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	orig := getRandFile(t, ds, 100)
+	if err := PutNode(rt, "/f", orig); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	data := make([]byte, 600000)
+	rand.Read(data)
+	expected := fileNodeFromReader(t, getDagserv(t), bytes.NewReader(data)).Cid()
+
+	if err := fi.WriteExpecting(ctx, bytes.NewReader(data[1:]), expected); err != ErrCidMismatch {
+		t.Fatalf("expected ErrCidMismatch, got %v", err)
+	}
+	if ok, err := FileMatches(rt, "/f", orig.Cid()); err != nil || !ok {
+		t.Fatalf("expected the file to be left unchanged (%v)", err)
+	}
+
+	if err := fi.WriteExpecting(ctx, bytes.NewReader(data), expected); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := Lookup(rt, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := nd.GetNode(); !n.Cid().Equals(expected) {
+		t.Fatal("expected the file to have the written content")
+	}
+	root, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, _, err := root.ResolveLink([]string{"f"}); err != nil || !l.Cid.Equals(expected) {
+		t.Fatalf("expected the parent to link to the new content (%v)", err)
+	}
+}
+
+func TestListWithIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	for _, name := range []string{"c", "a", "b"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dir.Mkdir("0"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := dir.ListWithIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := nd.Links()
+	if len(entries) != len(links) {
+		t.Fatalf("expected %d entries, got %d", len(links), len(entries))
+	}
+	for i, e := range entries {
+		if e.Index != i || e.Name != links[i].Name {
+			t.Fatalf("entry %+v doesn't match link %d (%s)", e, i, links[i].Name)
+		}
+		expectedType := TFile
+		if e.Name == "0" {
+			expectedType = TDir
+		}
+		if e.Type != expectedType {
+			t.Fatalf("unexpected type for %+v", e)
+		}
+	}
+}
+
+// Fails the first `failures` reads of every node with a transient error.
+type flakyDagService struct {
+	ipld.DAGService
+
+	lk       sync.Mutex
+	failures int
+	reads    map[cid.Cid]int
+}
+
+var errTransient = errors.New("transient error")
+
+func (f *flakyDagService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	f.lk.Lock()
+	f.reads[c]++
+	fail := f.reads[c] <= f.failures
+	f.lk.Unlock()
+	if fail {
+		return nil, errTransient
+	}
+	return f.DAGService.Get(ctx, c)
+}
+
+func TestReadRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(failures int, opts ...RootOption) (*Root, *flakyDagService) {
+		flaky := &flakyDagService{DAGService: ds, failures: failures, reads: make(map[cid.Cid]int)}
+		r, err := NewRoot(ctx, flaky, nd.(*dag.ProtoNode), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, flaky
+	}
+
+	r, _ := open(1)
+	if _, err := Lookup(r, "/a/b"); err != errTransient {
+		t.Fatalf("expected the transient error without retries, got %v", err)
+	}
+
+	r, _ = open(2, WithReadRetry(3, time.Millisecond))
+	if err := assertDirAtPath(r.GetDirectory(), "/a/b", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ = open(3, WithReadRetry(3, time.Millisecond))
+	if _, err := Lookup(r, "/a/b"); err != errTransient {
+		t.Fatalf("expected the transient error after the attempts, got %v", err)
+	}
+
+	// Not found errors aren't retried.
+	r, flaky := open(0, WithReadRetry(3, time.Millisecond))
+	missing := dag.NodeWithData(ft.FilePBData([]byte("missing"), 7))
+	if err := r.GetDirectory().AddChild("missing", missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Remove(ctx, missing.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetDirectory().Child("missing"); err != ipld.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if n := flaky.reads[missing.Cid()]; n != 1 {
+		t.Fatalf("expected a single read of a missing node, got %d", n)
+	}
+}
+
+func TestPruneEmpty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for _, d := range []string{"/a/b/c", "/a/d", "/e/f", "/g"} {
+		if err := Mkdir(rt, d, MkdirOpts{Mkparents: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PutNode(rt, "/e/f/file", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pruned: /a/b/c, /a/b, /a/d, /a and /g.
+	n, err := rt.GetDirectory().PruneEmpty(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 directories pruned, got %d", n)
+	}
+
+	names, err := rt.GetDirectory().ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(names, []string{"e"}) {
+		t.Fatalf("unexpected entries left: %v", names)
+	}
+	if _, err := Lookup(rt, "/e/f/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = rt.GetDirectory().PruneEmpty(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing left to prune, got %d", n)
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/b/f", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/g", getRandFile(t, ds, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	type dumped struct {
+		Name     string    `json:"name"`
+		Type     string    `json:"type"`
+		Cid      string    `json:"cid"`
+		Size     uint64    `json:"size"`
+		Children []*dumped `json:"children"`
+	}
+	dump := func(opts ...DumpOption) *dumped {
+		var buf bytes.Buffer
+		if err := rt.DumpJSON(ctx, &buf, opts...); err != nil {
+			t.Fatal(err)
+		}
+		var out dumped
+		if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+			t.Fatalf("invalid JSON %q: %s", buf.String(), err)
+		}
+		return &out
+	}
+
+	root := dump()
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Name != "/" || root.Type != "directory" || root.Cid != nd.Cid().String() {
+		t.Fatalf("unexpected root: %+v", root)
+	}
+	if len(root.Children) != 2 || root.Children[0].Name != "a" || root.Children[1].Name != "g" {
+		t.Fatalf("unexpected root children: %+v", root.Children)
+	}
+	if g := root.Children[1]; g.Type != "file" || g.Size != 20 || g.Children != nil {
+		t.Fatalf("unexpected file entry: %+v", g)
+	}
+	f := root.Children[0].Children[0].Children[0]
+	if f.Name != "f" || f.Size != 1000 {
+		t.Fatalf("unexpected nested file entry: %+v", f)
+	}
+
+	limited := dump(WithDumpMaxDepth(1))
+	if a := limited.Children[0]; a.Name != "a" || a.Children != nil {
+		t.Fatalf("expected the directory at the depth limit without children: %+v", a)
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	nd := getRandFile(t, ds, 300000)
+	if err := PutNode(rt, "/file", nd); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := catNode(ds, nd.(*dag.ProtoNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fi.Reader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Readers don't hold the descriptor lock.
+	if _, err := fi.AppendFrom(ctx, bytes.NewReader([]byte("more"))); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatal("reader returned unexpected contents")
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	r, err = fi.Reader(cctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ccancel()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected reading with a canceled context to fail")
+	}
+}
+
+func TestMkdirExistOK(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	if err := Mkdir(rt, "/a", MkdirOpts{ExistOK: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/", MkdirOpts{ExistOK: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []MkdirOpts{{}, {ExistOK: true}, {Mkparents: true}} {
+		if err := Mkdir(rt, "/a/f", opts); err != ErrNotDir {
+			t.Fatalf("expected ErrNotDir with %+v, got %v", opts, err)
+		}
+	}
+
+	// The existing directory is untouched.
+	if err := assertDirAtPath(rt.GetDirectory(), "/a", []string{"f"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushConflictResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	type conflict struct {
+		path string
+		a, b cid.Cid
+	}
+	var conflicts []conflict
+	resolved := getRandFile(t, ds, 100)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithFlushConflictResolver(
+		func(path string, a, b ipld.Node) (ipld.Node, error) {
+			conflicts = append(conflicts, conflict{path, a.Cid(), b.Cid()})
+			return resolved, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Mkdir(rt, "/d", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/d/f", getRandFile(t, ds, 300000)); err != nil {
+		t.Fatal(err)
+	}
+	write := func(fi *File) ipld.Node {
+		if _, err := fi.AppendFrom(ctx, bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+
+	// Writes through the cached entry aren't conflicts.
+	fi, err := lookupFile(rt, "/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(fi)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+
+	// Replace the entry while `fi` is still in use.
+	replacement := getRandFile(t, ds, 2000)
+	d, err := lookupDir(rt, "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unlink("f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("f", replacement); err != nil {
+		t.Fatal(err)
+	}
+	written := write(fi)
+
+	if len(conflicts) != 1 {
+		t.Fatalf("expected a single conflict, got %v", conflicts)
+	}
+	expected := conflict{"/d/f", replacement.Cid(), written.Cid()}
+	if conflicts[0] != expected {
+		t.Fatalf("expected conflict %v, got %v", expected, conflicts[0])
+	}
+	current, err := lookupFile(rt, "/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := current.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(resolved.Cid()) {
+		t.Fatal("expected the entry to be the resolved node")
+	}
+}
+
+func TestCopyChild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	if err := PutNode(rt, "/config.json", getRandFile(t, ds, 300000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/other", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.CopyChild("missing", "copy"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if err := dir.CopyChild("config.json", "config.json.bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.CopyChild("config.json", "other"); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+	if err := dir.CopyChild("config.json", "other", WithOverwrite()); err != nil {
+		t.Fatal(err)
+	}
+
+	orig, err := lookupFile(rt, "/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origNode, err := orig.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/config.json.bak", "/other"} {
+		fi, err := lookupFile(rt, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nd.Cid().Equals(origNode.Cid()) {
+			t.Fatalf("expected %s to link the same node", name)
+		}
+	}
+
+	// The copies are independent entries.
+	if _, err := orig.AppendFrom(ctx, bytes.NewReader([]byte("more"))); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := FileMatches(rt, "/config.json.bak", origNode.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matches {
+		t.Fatal("expected the copy to keep the original contents")
+	}
+}
+
+func TestFollowBase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	remote := func(name string) cid.Cid {
+		r, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PutNode(r, "/"+name, getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := r.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+
+	var lk sync.Mutex
+	current, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := current.Cid()
+	publish := func(c cid.Cid) {
+		lk.Lock()
+		published = c
+		lk.Unlock()
+	}
+	resolve := func(ctx context.Context) (cid.Cid, error) {
+		lk.Lock()
+		defer lk.Unlock()
+		return published, nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- rt.FollowBase(ctx, resolve, time.Millisecond) }()
+
+	waitFor := func(path string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := Lookup(rt, path); err == nil {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", path)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	publish(remote("a"))
+	waitFor("/a")
+	publish(remote("b"))
+	waitFor("/b")
+	if _, err := Lookup(rt, "/a"); err != os.ErrNotExist {
+		t.Fatalf("expected the previous base to be replaced, got %v", err)
+	}
+
+	// Local changes stop the mirror when the base changes again.
+	if err := Mkdir(rt, "/local", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	publish(remote("c"))
+	select {
+	case err := <-done:
+		if err != ErrBaseConflict {
+			t.Fatalf("expected ErrBaseConflict, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the conflict")
+	}
+	if _, err := Lookup(rt, "/local"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The swap checks again that the tree is the base, e.g., for a change
+	// made after a check.
+	base, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/late", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	newBase, err := ds.Get(ctx, remote("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.replaceBase(ctx, newBase, base.Cid()); err != ErrBaseConflict {
+		t.Fatalf("expected ErrBaseConflict, got %v", err)
+	}
+	if _, err := Lookup(rt, "/late"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEstimateFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &slowDagService{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	estimate := func() FlushEstimate {
+		adds := ds.adds
+		est, err := rt.EstimateFlush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds.adds != adds {
+			t.Fatal("expected EstimateFlush not to store any node")
+		}
+		return est
+	}
+	if est := estimate(); est.DirtyNodes != 0 || est.EstimatedBytes != 0 {
+		t.Fatalf("expected nothing to flush in a new root, got %+v", est)
+	}
+
+	// The new directories are stored but the root and /a need to be
+	// updated to link to them.
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if est := estimate(); est.DirtyNodes != 2 || est.EstimatedBytes == 0 {
+		t.Fatalf("expected 2 nodes to flush, got %+v", est)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if est := estimate(); est.DirtyNodes != 0 {
+		t.Fatalf("expected nothing to flush after a flush, got %+v", est)
+	}
+
+	// Flushing a subdirectory alone leaves its parents to flush.
+	if err := PutNode(rt, "/a/b/f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if est := estimate(); est.DirtyNodes != 3 {
+		t.Fatalf("expected 3 nodes to flush, got %+v", est)
+	}
+	b, err := lookupDir(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetNode(); err != nil {
+		t.Fatal(err)
+	}
+	if est := estimate(); est.DirtyNodes != 2 {
+		t.Fatalf("expected 2 nodes to flush, got %+v", est)
+	}
+
+	if _, err := rt.GetDirectory().GetNode(); err != nil {
+		t.Fatal(err)
+	}
+	if est := estimate(); est.DirtyNodes != 0 {
+		t.Fatalf("expected nothing to flush after getting the root node, got %+v", est)
+	}
+
+	// Unlinking from a shard that stays sharded only leaves the shard and
+	// its parent to flush, not its loaded entries.
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+	if err := Mkdir(rt, "/s/d", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := PutNode(rt, fmt.Sprintf("/s/f%d", i), getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/s/d", "/s/f1"} {
+		if _, err := Lookup(rt, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := lookupDir(rt, "/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UnlinkMany([]string{"f2"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isShardedUnsync() {
+		t.Fatal("expected /s to stay sharded")
+	}
+	if est := estimate(); est.DirtyNodes != 2 {
+		t.Fatalf("expected 2 nodes to flush after unlinking from a shard, got %+v", est)
+	}
+	if _, err := s.GetNode(); err != nil {
+		t.Fatal(err)
+	}
+	if est := estimate(); est.DirtyNodes != 1 {
+		t.Fatalf("expected 1 node to flush, got %+v", est)
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	base, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(base, "/a/b/c", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := base.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &flakyDagService{DAGService: ds, reads: make(map[cid.Cid]int)}
+	rt, err := NewRoot(ctx, counting, nd.(*dag.ProtoNode), nil, WithNodeCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := Lookup(rt, "/a/b/c"); err != nil {
+			t.Fatal(err)
+		}
+		rt.GetDirectory().Uncache("a")
+	}
+	for c, n := range counting.reads {
+		if n != 1 {
+			t.Fatalf("expected %s to be read once, got %d", c, n)
+		}
+	}
+	stats := rt.NodeCacheStats()
+	if stats.Misses != 3 || stats.Hits != 6 || stats.Len != 3 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+
+	// Evicts the least recently used nodes.
+	rt, err = NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil, WithNodeCache(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := rt.NodeCacheStats(); stats.Len != 1 {
+		t.Fatalf("expected a single cached node, got %+v", stats)
+	}
+}
+
+func BenchmarkRepeatedLookup(b *testing.B) {
+	for _, size := range []int{0, 100} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var opts []RootOption
+			if size > 0 {
+				opts = append(opts, WithNodeCache(size))
+			}
+			rt, err := NewRoot(ctx, NewMemDAGService(), emptyDirNode(), nil, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := Mkdir(rt, "/a/b/c/d/e", MkdirOpts{Mkparents: true, Flush: true}); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := Lookup(rt, "/a/b/c/d/e"); err != nil {
+					b.Fatal(err)
+				}
+				rt.GetDirectory().Uncache("a")
+			}
+		})
+	}
+}
+
+func TestMoveChild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	if err := Mkdir(rt, "/sub", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 1000)
+	for _, p := range []string{"/f", "/g", "/sub/g"} {
+		if err := PutNode(rt, p, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dir.MoveChild("f", "sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(dir, "/sub", []string{"f", "g"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/f"); err != os.ErrNotExist {
+		t.Fatalf("expected the entry to be moved, got %v", err)
+	}
+
+	if err := dir.MoveChild("g", "sub"); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+	if err := dir.MoveChild("g", "sub/g"); err != ErrNotDir {
+		t.Fatalf("expected ErrNotDir, got %v", err)
+	}
+	if err := dir.MoveChild("g", "x/y"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if err := dir.MoveChild("sub", "sub/inner", WithMoveMkparents()); err == nil {
+		t.Fatal("expected moving a directory into itself to fail")
+	}
+
+	if err := dir.MoveChild("g", "x/y", WithMoveMkparents()); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(dir, "/x/y", []string{"g"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(dir, "/", []string{"sub", "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The path is cleaned and can't leave the directory.
+	if err := PutNode(rt, "/h", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.MoveChild("h", "sub/../x/./y/", WithMoveMkparents()); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(dir, "/x/y", []string{"g", "h"}); err != nil {
+		t.Fatal(err)
+	}
+	x, err := lookupDir(rt, "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"..", "y/../../sub", "../x"} {
+		if err := x.MoveChild("y", p, WithMoveMkparents()); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("expected ErrInvalidName moving to %q, got %v", p, err)
+		}
+	}
+	if err := assertDirAtPath(dir, "/", []string{"sub", "x"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	base, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("é", 6) // 12 bytes.
+	if err := Mkdir(base, "/"+long, MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(base, "/short", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := base.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil, WithMaxNameLength(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+
+	// Existing entries are kept (and reported).
+	longest, err := dir.LongestName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longest != long {
+		t.Fatalf("expected the longest name to be %q, got %q", long, longest)
+	}
+
+	if _, err := dir.Mkdir(long + "x"); err != ErrNameTooLong {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+	if err := dir.AddChild(strings.Repeat("é", 5)+"x", emptyDirNode()); err != ErrNameTooLong {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+	if err := Mv(rt, "/short", "/"+strings.Repeat("a", 11)); err != ErrNameTooLong {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+	if err := dir.AddChild(strings.Repeat("é", 5), emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Delays every read by `latency`, tracking the maximum number of reads in
+// flight.
+type slowReadDagService struct {
+	ipld.DAGService
+	latency time.Duration
+
+	lk          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *slowReadDagService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	s.lk.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.lk.Unlock()
+	defer func() {
+		s.lk.Lock()
+		s.inFlight--
+		s.lk.Unlock()
+	}()
+
+	select {
+	case <-time.After(s.latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.DAGService.Get(ctx, c)
+}
+
+// GetMany fetches the nodes one at a time (as a service without batching).
+func (s *slowReadDagService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := s.Get(ctx, c)
+			out <- &ipld.NodeOption{Node: nd, Err: err}
+		}
+	}()
+	return out
+}
+
+func TestFileReadAhead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	nd := getRandFile(t, ds, 3000000)
+	expected, err := catNode(ds, nd.(*dag.ProtoNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &slowReadDagService{DAGService: ds, latency: time.Millisecond}
+	rt, err := NewRoot(ctx, slow, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/f", nd); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := fi.Open(Flags{Read: true}, WithReadAhead(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatal("read ahead returned unexpected contents")
+	}
+	if slow.maxInFlight < 2 {
+		t.Fatalf("expected concurrent reads, got at most %d", slow.maxInFlight)
+	}
+
+	// Seek into the middle of a block.
+	for _, off := range []int64{0, 1, 262144, 1000000, int64(len(expected)) - 10} {
+		if _, err := fd.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 10)
+		if _, err := fd.CtxReadFull(ctx, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected[off:off+10]) {
+			t.Fatalf("unexpected contents at offset %d", off)
+		}
+	}
+	if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end, got %v", err)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.CtxReadFull(cctx, make([]byte, 10)); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers ignore the option.
+	wfd, err := fi.Open(Flags{Read: true, Write: true}, WithReadAhead(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := wfd.(*readAheadDescriptor); ok {
+		t.Fatal("expected a plain descriptor for writing")
+	}
+	if err := wfd.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	ds := NewMemDAGService()
+
+	data := make([]byte, 4000000)
+	rand.Read(data)
+	nd, err := importer.BuildDagFromReader(ds, chunker.DefaultSplitter(bytes.NewReader(data)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	slow := &slowReadDagService{DAGService: ds, latency: time.Millisecond}
+
+	for _, blocks := range []int{0, 8} {
+		b.Run(fmt.Sprintf("blocks=%d", blocks), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				fi, err := NewFile("f", nd, nil, slow)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var opts []OpenOption
+				if blocks > 0 {
+					opts = append(opts, WithReadAhead(blocks))
+				}
+				fd, err := fi.Open(Flags{Read: true}, opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, fd); err != nil {
+					b.Fatal(err)
+				}
+				if err := fd.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDirectoryLen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+
+	base, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := base.GetDirectory().Mkdir(fmt.Sprintf("existing%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nd, err := base.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &flakyDagService{DAGService: ds, reads: make(map[cid.Cid]int)}
+	rt, err := NewRoot(ctx, counting, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	checkLen := func(expected int) {
+		t.Helper()
+		n, err := dir.Len(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := dir.ListNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected || len(names) != expected {
+			t.Fatalf("expected %d entries, got %d (%d listed)", expected, n, len(names))
+		}
+	}
+	checkLen(5)
+
+	// Go over the sharding threshold and back.
+	for i := 0; i < 40; i++ {
+		if err := dir.AddChild(fmt.Sprintf("entry%d", i), emptyDirNode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !dir.isShardedUnsync() {
+		t.Fatal("expected the directory to be sharded")
+	}
+	checkLen(45)
+
+	// Replacing entries doesn't change the count.
+	if err := dir.CopyChild("existing0", "entry0", WithOverwrite()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Mkdir("entry1"); err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	checkLen(45)
+
+	for i := 0; i < 38; i++ {
+		if err := dir.Unlink(fmt.Sprintf("entry%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dir.isShardedUnsync() {
+		t.Fatal("expected the directory to be converted back")
+	}
+	checkLen(7)
+	if _, err := dir.UnlinkMany([]string{"entry38", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	checkLen(6)
+
+	// Counted only once.
+	totalReads := func() int {
+		var n int
+		for _, r := range counting.reads {
+			n += r
+		}
+		return n
+	}
+	reads := totalReads()
+	if _, err := dir.Len(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if totalReads() != reads {
+		t.Fatal("expected Len not to list the entries again")
+	}
+}
+
+func TestFileFlushPartial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	data := make([]byte, 900000)
+	rand.Read(data)
+	// Checkpoints of several blocks and of less than one block, of uploads
+	// started with nothing or with their first bytes imported in a single
+	// block (a checkpoint taken before writing anything is that block).
+	for _, c := range []struct{ imported, written int }{
+		{0, 600000},
+		{0, 1000},
+		{500, 1000},
+		{1000, 1000},
+	} {
+		testFileFlushPartial(ctx, t, ds, data, c.imported, c.written)
+	}
+}
+
+func testFileFlushPartial(ctx context.Context, t *testing.T, ds ipld.DAGService, data []byte, imported, written int) {
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := ft.EmptyFileNode()
+	if imported > 0 {
+		start = fileNodeFromReader(t, ds, bytes.NewReader(data[:imported])).(*dag.ProtoNode)
+	}
+	if err := PutNode(rt, "/upload", start); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fi.Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteAt(data[imported:written], int64(imported)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Checkpoint with the writer still open.
+	partial, err := fi.FlushPartial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resume in a new tree from the persisted CID.
+	rt2, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := ds.Get(ctx, partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt2, "/upload", nd); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := lookupFile(rt2, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := resumed.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(written) {
+		t.Fatalf("expected the partial file to have %d bytes, got %d", written, size)
+	}
+	if _, err := resumed.AppendFrom(ctx, bytes.NewReader(data[size:])); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := FileMatchesBytes(rt2, "/upload", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matches {
+		t.Fatal("expected the resumed file to have the whole content")
+	}
+}
+
+func TestShardListingOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+
+	names := make([]string, 300)
+	for i := range names {
+		names[i] = fmt.Sprintf("entry%d", i)
+	}
+	list := func(order []string, reload bool) []string {
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range order {
+			if err := rt.GetDirectory().AddChild(name, emptyDirNode()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dir := rt.GetDirectory()
+		if reload {
+			nd, err := dir.GetNode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rt, err = NewRootFromCid(ctx, ds, nd.Cid(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir = rt.GetDirectory()
+		}
+		if !dir.isShardedUnsync() {
+			t.Fatal("expected a sharded directory")
+		}
+		listed, err := dir.ListNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var viaEntries []string
+		err = dir.ForEachEntry(ctx, func(nl NodeListing) error {
+			viaEntries = append(viaEntries, nl.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compStrArrs(listed, viaEntries) {
+			t.Fatal("expected ForEachEntry in the order of ListNames")
+		}
+		return listed
+	}
+
+	expected := list(names, false)
+	shuffled := append([]string(nil), names...)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	for _, reload := range []bool{false, true} {
+		if listed := list(shuffled, reload); !compStrArrs(listed, expected) {
+			t.Fatalf("expected the same order regardless of insertion order (reloaded: %v)", reload)
+		}
+	}
+}
+
+func TestAddRawChild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	raw := dag.NodeWithData([]byte("not unixfs"))
+	if err := ds.Add(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddRawChild("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(dir *Directory) {
+		fsn, err := dir.Child("raw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		op, ok := fsn.(*Opaque)
+		if !ok {
+			t.Fatalf("expected an opaque node, got %T", fsn)
+		}
+		if op.Type() != TRaw {
+			t.Fatal("expected TRaw type")
+		}
+		nd, err := op.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nd.Cid().Equals(raw.Cid()) {
+			t.Fatal("expected the linked node")
+		}
+		entries, err := dir.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Type != int(TRaw) {
+			t.Fatalf("expected a single raw entry, got %v", entries)
+		}
+	}
+	check(dir)
+
+	// Reload from the DAG so the entry isn't cached.
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err = NewRootFromCid(ctx, ds, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rt.GetDirectory())
+	fsn, err := Lookup(rt, "/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != TRaw {
+		t.Fatal("expected Lookup to return the opaque node")
+	}
+
+	if err := Mv(rt, "/raw", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithHistory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := make([]cid.Cid, 0, 4)
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = append(roots, nd.Cid())
+
+	for i := 0; i < 3; i++ {
+		if err := rt.GetDirectory().AddChild(fmt.Sprintf("dir%d", i), emptyDirNode()); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		// Flushing without changes doesn't add a record.
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, nd.Cid())
+	}
+
+	prev, err := rt.PreviousRoots(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prev) != 3 {
+		t.Fatalf("expected 3 previous roots, got %d", len(prev))
+	}
+	for i, c := range prev {
+		if !c.Equals(roots[len(roots)-2-i]) {
+			t.Fatalf("unexpected previous root %d", i)
+		}
+	}
+	if prev, err := rt.PreviousRoots(ctx, 1); err != nil || len(prev) != 1 || !prev[0].Equals(roots[2]) {
+		t.Fatalf("expected only the last previous root, got %v (%v)", prev, err)
+	}
+
+	// The previous roots are still available.
+	old, err := NewRootFromCid(ctx, ds, prev[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := old.GetDirectory().ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("expected the previous root to have 2 entries, got %v", names)
+	}
+
+	noHist, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noHist.PreviousRoots(ctx, 1); err == nil {
+		t.Fatal("expected an error without history")
+	}
+
+	// A new `Root` can continue the chain from a persisted head.
+	head := rt.HistoryHead()
+	last, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := NewRoot(ctx, ds, last.(*dag.ProtoNode), nil, WithHistoryHead(head))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.HistoryHead().Equals(head) {
+		t.Fatal("resuming from the current root shouldn't add a record")
+	}
+	if err := resumed.GetDirectory().AddChild("dir3", emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	prev, err = resumed.PreviousRoots(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prev) != 4 || !prev[0].Equals(last.Cid()) || !prev[3].Equals(roots[0]) {
+		t.Fatalf("expected the resumed chain to end with the previous one, got %v", prev)
+	}
+
+	// Resuming from another root records it first.
+	other, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithHistoryHead(head))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev, err := other.PreviousRoots(ctx, 10); err != nil || len(prev) != 4 || !prev[0].Equals(last.Cid()) {
+		t.Fatalf("expected the other root to follow the previous chain, got %v (%v)", prev, err)
+	}
+
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithHistoryHead(roots[0])); err == nil {
+		t.Fatal("expected an error resuming from a node that isn't a record")
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	expected := make(map[string][]byte)
+	var paths []string
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 1000*(i+1))
+		rand.Read(data)
+		nd := fileNodeFromReader(t, ds, bytes.NewReader(data))
+		name := fmt.Sprintf("file%d", i)
+		if err := rt.GetDirectory().AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+		expected["/"+name] = data
+		paths = append(paths, "/"+name)
+	}
+	if err := rt.GetDirectory().AddChild("dir", emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, "/missing", "/dir")
+
+	contents, err := ReadFiles(ctx, rt, paths, 2)
+	var rerr *ReadFilesError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected a ReadFilesError, got %v", err)
+	}
+	if len(rerr.Errs) != 2 || rerr.Errs["/missing"] != os.ErrNotExist || rerr.Errs["/dir"] == nil {
+		t.Fatalf("unexpected errors: %v", rerr.Errs)
+	}
+	if len(contents) != len(expected) {
+		t.Fatalf("expected %d files, got %d", len(expected), len(contents))
+	}
+	for p, data := range expected {
+		if !bytes.Equal(contents[p], data) {
+			t.Fatalf("wrong contents for %s", p)
+		}
+	}
+
+	if _, err := ReadFiles(ctx, rt, paths[:5], 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushInProgress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &slowDagService{DAGService: getDagserv(t), latency: 100 * time.Millisecond}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.FlushInProgress() {
+		t.Fatal("expected no flush in progress")
+	}
+	if err := rt.WaitFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.GetDirectory().AddChild("dir", emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- rt.Flush() }()
+	for !rt.FlushInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, time.Millisecond)
+	defer shortCancel()
+	if err := rt.WaitFlush(shortCtx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	if err := rt.WaitFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rt.FlushInProgress() {
+		t.Fatal("expected the flush to be done")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlinkIfExists(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	if _, err := dir.Mkdir("a"); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := dir.UnlinkIfExists("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Fatal("expected the entry to be removed")
+	}
+	if _, err := dir.Child("a"); err != os.ErrNotExist {
+		t.Fatalf("expected the entry to be gone, got %v", err)
+	}
+
+	removed, err = dir.UnlinkIfExists("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed {
+		t.Fatal("expected nothing to be removed")
+	}
+	if err := dir.Unlink("a"); err == nil {
+		t.Fatal("expected Unlink to fail on a missing entry")
+	}
+}
+
+func TestLeafCidBuilder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+	leafBuilder := cid.V1Builder{Codec: cid.Raw, MhType: 0x13} // SHA2-512
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithLeafCidBuilder(leafBuilder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/file", ft.EmptyFileNode()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi.SetCidBuilder(cid.V1Builder{Codec: cid.DagProtobuf, MhType: 0x12})
+	fi.RawLeaves = true
+
+	data := make([]byte, 600000)
+	rand.Read(data)
+	write := func(b []byte, at int64) {
+		fd, err := fi.Open(Flags{Write: true, Sync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.WriteAt(b, at); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := nd.Cid().Prefix(); p.Codec != cid.DagProtobuf || p.MhType != 0x12 {
+			t.Fatalf("unexpected prefix of the file node: %v", p)
+		}
+		if len(nd.Links()) == 0 {
+			t.Fatal("expected a file with many leaves")
+		}
+		for _, l := range nd.Links() {
+			if p := l.Cid.Prefix(); p.Codec != cid.Raw || p.MhType != 0x13 {
+				t.Fatalf("unexpected prefix of a leaf: %v", p)
+			}
+		}
+		if ok, err := FileMatchesBytes(rt, "/file", data); err != nil || !ok {
+			t.Fatalf("unexpected file contents (%v)", err)
+		}
+	}
+
+	write(data, 0)
+	check()
+
+	// Modify the middle of the file.
+	copy(data[300000:], []byte("modified"))
+	write([]byte("modified"), 300000)
+	check()
+}
+
+func TestEqual(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	build := func(sharded bool, chunkSize int64, data []byte, extra bool) cid.Cid {
+		if sharded {
+			defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+			uio.HAMTShardingSize = 1
+		}
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := importer.BuildDagFromReader(ds, chunker.NewSizeSplitter(bytes.NewReader(data), chunkSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutNode(rt, "/a/b/file", nd); err != nil {
+			t.Fatal(err)
+		}
+		if extra {
+			if err := Mkdir(rt, "/extra", MkdirOpts{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		root, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.Cid()
+	}
+
+	base := build(false, chunker.DefaultBlockSize, data, false)
+	other := build(true, 1000, data, false)
+	if base.Equals(other) {
+		t.Fatal("expected different representations")
+	}
+	for _, c := range []cid.Cid{base, other} {
+		if eq, err := Equal(ctx, ds, base, c); err != nil || !eq {
+			t.Fatalf("expected equal trees (%v)", err)
+		}
+	}
+
+	modified := append([]byte(nil), data...)
+	modified[50000]++
+	for _, c := range []cid.Cid{
+		build(true, 1000, modified, false),
+		build(false, chunker.DefaultBlockSize, data[:len(data)-1], false),
+		build(false, chunker.DefaultBlockSize, data, true),
+	} {
+		if eq, err := Equal(ctx, ds, base, c); err != nil || eq {
+			t.Fatalf("expected different trees (%v)", err)
+		}
+	}
+
+	// Symlinks are compared by target.
+	link := func(target string) cid.Cid {
+		data, err := ft.SymlinkData(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PutNode(rt, "/link", dag.NodeWithData(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		root, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v1, err := rt.ToV1(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq, err := Equal(ctx, ds, root.Cid(), v1); err != nil || !eq {
+			t.Fatalf("expected a tree with a symlink to equal its CIDv1 version (%v)", err)
+		}
+		return root.Cid()
+	}
+	if eq, err := Equal(ctx, ds, link("a/b"), link("a/c")); err != nil || eq {
+		t.Fatalf("expected symlinks with different targets to differ (%v)", err)
+	}
+}
+
+// countingWriter counts the calls to `Write`.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func TestStreamListJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/f", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/g", getRandFile(t, ds, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(dir *Directory) {
+		var w countingWriter
+		if err := dir.StreamListJSON(ctx, &w); err != nil {
+			t.Fatal(err)
+		}
+		if w.writes != 3 {
+			t.Fatalf("expected a write per entry, got %d", w.writes)
+		}
+		sizes := map[string]uint64{"f": 1000, "g": 20}
+		dec := json.NewDecoder(&w.Buffer)
+		for i := 0; dec.More(); i++ {
+			var entry struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+				Cid  string `json:"cid"`
+				Size uint64 `json:"size"`
+			}
+			if err := dec.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			fsn, err := dir.Child(entry.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nd, err := fsn.GetNode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Cid != nd.Cid().String() {
+				t.Fatalf("unexpected CID of %s", entry.Name)
+			}
+			switch entry.Name {
+			case "a":
+				if entry.Type != "directory" {
+					t.Fatalf("unexpected directory entry: %+v", entry)
+				}
+			default:
+				if entry.Type != "file" || entry.Size != sizes[entry.Name] {
+					t.Fatalf("unexpected file entry: %+v", entry)
+				}
+			}
+		}
+	}
+	list(rt.GetDirectory())
+
+	// Without cached entries.
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err = NewRootFromCid(ctx, ds, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list(rt.GetDirectory())
+}
+
+func TestAddChildrenTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	if _, err := dir.Mkdir("existing"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.AddChildrenTx([]NamedNode{
+		{"ok", getRandFile(t, ds, 100)},
+		{"dup", emptyDirNode()},
+		{"dup", emptyDirNode()},
+		{"existing", emptyDirNode()},
+		{"opaque", dag.NodeWithData([]byte("not unixfs"))},
+		{"nil", nil},
+	})
+	var aerr *AddChildrenError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("expected an AddChildrenError, got %v", err)
+	}
+	if len(aerr.Errs) != 4 || aerr.Errs["dup"] != ErrDuplicateLink || aerr.Errs["existing"] != ErrDirExists || aerr.Errs["opaque"] != ErrInvalidChild || aerr.Errs["nil"] != ErrInvalidChild {
+		t.Fatalf("unexpected errors: %v", aerr.Errs)
+	}
+	after, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Cid().Equals(before.Cid()) {
+		t.Fatal("expected the directory to be left untouched")
+	}
+
+	entries := []NamedNode{
+		{"a", getRandFile(t, ds, 100)},
+		{"b", emptyDirNode()},
+		{"c", getRandFile(t, ds, 200)},
+	}
+	if err := dir.AddChildrenTx(entries); err != nil {
+		t.Fatal(err)
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !compStrArrs(names, []string{"a", "b", "c", "existing"}) {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+}
+
+func TestHasOpenWriterUnder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/ab", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/b/file", ft.EmptyFileNode()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rfd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.HasOpenWriterUnder("/") {
+		t.Fatal("readers aren't writers")
+	}
+	rfd.Close()
+
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/", "/a", "a/b/", "/a/b/file"} {
+		if !rt.HasOpenWriterUnder(p) {
+			t.Fatalf("expected a writer under %s", p)
+		}
+	}
+	for _, p := range []string{"/ab", "/a/b/file2", "/a/c"} {
+		if rt.HasOpenWriterUnder(p) {
+			t.Fatalf("expected no writer under %s", p)
+		}
+	}
+
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rt.HasOpenWriterUnder("/") {
+		t.Fatal("expected no writers after closing")
+	}
+}
+
+func TestAddChildCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Sharding needs the nodes of the entries.
+	rt, err := NewRoot(ctx, getDagserv(t), emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	missing := fileNodeFromReader(t, NewMemDAGService(), bytes.NewReader([]byte("missing")))
+	if err := dir.AddChildCid("missing", missing.Cid(), 7); err != nil {
+		t.Fatal(err)
+	}
+	shardingSize := uio.HAMTShardingSize
+	uio.HAMTShardingSize = 1
+	err = dir.AddChild("other", emptyDirNode())
+	uio.HAMTShardingSize = shardingSize
+	if err != ipld.ErrNotFound {
+		t.Fatalf("expected ipld.ErrNotFound sharding with a missing entry, got %v", err)
+	}
+	if dir.isShardedUnsync() {
+		t.Fatal("expected the directory not to be sharded")
+	}
+
+	for _, sharded := range []bool{false, true} {
+		ds := getDagserv(t)
+		if sharded {
+			defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+			uio.HAMTShardingSize = 1
+		}
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := rt.GetDirectory()
+
+		// A node not in the DAG service yet.
+		nd := fileNodeFromReader(t, NewMemDAGService(), bytes.NewReader(make([]byte, 1000)))
+		size, err := nd.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.AddChildCid("file", nd.Cid(), size); err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.AddChildCid("file", nd.Cid(), size); err != ErrDirExists {
+			t.Fatalf("expected ErrDirExists, got %v", err)
+		}
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if dir.isShardedUnsync() != sharded {
+			t.Fatalf("expected sharded: %v", sharded)
+		}
+		if _, err := ds.Get(ctx, nd.Cid()); err != ipld.ErrNotFound {
+			t.Fatalf("expected the node not to be added, got %v", err)
+		}
+
+		var link *ipld.Link
+		err = dir.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+			link = l
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link == nil || link.Name != "file" || !link.Cid.Equals(nd.Cid()) || link.Size != size {
+			t.Fatalf("unexpected link: %+v", link)
+		}
+
+		dangling, err := rt.FindDangling(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dangling) != 1 || dangling[0].Path != "/file" {
+			t.Fatalf("expected the link to be dangling, got %v", dangling)
+		}
+
+		if err := ds.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := lookupFile(rt, "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fsize, err := fi.Size(); err != nil || fsize != 1000 {
+			t.Fatalf("unexpected file size %d (%v)", fsize, err)
+		}
+	}
+}
+
+func TestReadWithBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 3*chunker.DefaultBlockSize+1000)
+	rand.Read(data)
+	nd := fileNodeFromReader(t, ds, bytes.NewReader(data))
+	if err := rt.GetDirectory().AddChild("file", nd); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaves []cid.Cid
+	for _, l := range nd.Links() {
+		leaves = append(leaves, l.Cid)
+	}
+
+	for _, opts := range [][]OpenOption{nil, {WithReadAhead(2)}} {
+		fd, err := fi.Open(Flags{Read: true}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Start in the middle of the first block.
+		if _, err := fd.Seek(100, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		var read []byte
+		var blocks []cid.Cid
+		buf := make([]byte, 300000)
+		for {
+			n, c, err := fd.ReadWithBlocks(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			read = append(read, buf[:n]...)
+			if len(blocks) == 0 || !blocks[len(blocks)-1].Equals(c) {
+				blocks = append(blocks, c)
+			}
+			left := (len(read) + 100) % int(chunker.DefaultBlockSize)
+			if left != 0 && len(read)+100 != len(data) {
+				t.Fatalf("expected the read to stop at the end of a block, stopped at %d", len(read)+100)
+			}
+		}
+		if !bytes.Equal(read, data[100:]) {
+			t.Fatal("unexpected contents")
+		}
+		if len(blocks) != len(leaves) {
+			t.Fatalf("expected %d blocks, got %d", len(leaves), len(blocks))
+		}
+		for i := range blocks {
+			if !blocks[i].Equals(leaves[i]) {
+				t.Fatalf("unexpected block %d", i)
+			}
+		}
+		fd.Close()
+	}
+
+	// On a read/write descriptor the pending writes are read (and so
+	// stored) like with `Read`.
+	fd, err := fi.Open(Flags{Read: true, Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if _, err := fd.WriteAt([]byte("written"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	_, c, err := fd.ReadWithBlocks(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "written" {
+		t.Fatalf("expected the pending write to be read, got %q", buf)
+	}
+	if _, err := ds.Get(ctx, c); err != nil {
+		t.Fatalf("expected the block read to be stored: %s", err)
+	}
+}
+
+func TestOpLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	var oplog bytes.Buffer
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithOpLog(&oplog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/f", ft.EmptyFileNode()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/a/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/a/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().CopyChild("g", "h"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	base, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base = base.(*dag.ProtoNode).Copy()
+	if err := base.(*dag.ProtoNode).AddNodeLink("x", emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Add(ctx, emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.ReplaceBase(ctx, base); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/x/y", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mutations of a clone aren't logged.
+	clone, err := Clone(ctx, rt, ds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(clone, "/z", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []string
+	dec := json.NewDecoder(bytes.NewReader(oplog.Bytes()))
+	for dec.More() {
+		var entry OpLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Time.IsZero() {
+			t.Fatal("expected a timestamp")
+		}
+		ops = append(ops, entry.Op+" "+entry.Path)
+	}
+	expected := []string{
+		"mkdir /a", "mkdir /a/b", "add /a/f", "write /a/f", "add /g", "unlink /a/f", "add /h", "unlink /a/b",
+		"base /", "mkdir /x/y",
+	}
+	if !compStrArrs(ops, expected) {
+		t.Fatalf("unexpected log: %v", ops)
+	}
+
+	replayed, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayOpLog(replayed, &oplog); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := replayed.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq, err := Equal(ctx, ds, orig.Cid(), got.Cid()); err != nil || !eq {
+		t.Fatalf("expected the replayed tree to be equal (%v)", err)
+	}
+
+	if err := ReplayOpLog(replayed, strings.NewReader(`{"op":"bogus","path":"/x"}`)); err == nil {
+		t.Fatal("expected an error for an unknown operation")
+	}
+}
+
+func TestGetLink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, sharded := range []bool{false, true} {
+		ds := getDagserv(t)
+		if sharded {
+			defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+			uio.HAMTShardingSize = 1
+		}
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := rt.GetDirectory()
+
+		nodes := make(map[string]ipld.Node)
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("file%d", i)
+			nodes[name] = getRandFile(t, ds, int64(100*(i+1)))
+			if err := dir.AddChild(name, nodes[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if dir.isShardedUnsync() != sharded {
+			t.Fatalf("expected sharded: %v", sharded)
+		}
+
+		for name, nd := range nodes {
+			l, err := dir.GetLink(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := nd.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Name != name || !l.Cid.Equals(nd.Cid()) || l.Size != size {
+				t.Fatalf("unexpected link for %s: %+v", name, l)
+			}
+		}
+		if _, err := dir.GetLink("missing"); err != os.ErrNotExist {
+			t.Fatalf("expected os.ErrNotExist, got %v", err)
+		}
+	}
+}
+
+func TestEmptyFileMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, tc := range []struct {
+		opts     []RootOption
+		expected string
+	}{
+		{nil, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{[]RootOption{WithEmptyFileMode(EmptyFileUnixFS)}, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{[]RootOption{WithEmptyFileMode(EmptyFileRaw)}, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+	} {
+		ds := getDagserv(t)
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Touch(rt, "/empty"); err != nil {
+			t.Fatal(err)
+		}
+		// Touching again leaves the file as is.
+		if err := Touch(rt, "/empty"); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := lookupFile(rt, "/empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nd.Cid().String() != tc.expected {
+			t.Fatalf("expected %s, got %s", tc.expected, nd.Cid())
+		}
+		if size, err := fi.Size(); err != nil || size != 0 {
+			t.Fatalf("expected an empty file, got %d (%v)", size, err)
+		}
+
+		fd, err := fi.Open(Flags{Write: true, Sync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := FileMatchesBytes(rt, "/empty", []byte("data")); err != nil || !ok {
+			t.Fatalf("expected the file to be writable (%v)", err)
+		}
+	}
+
+	if _, err := NewRoot(ctx, getDagserv(t), emptyDirNode(), nil, WithEmptyFileMode(EmptyFileMode(42))); err == nil {
+		t.Fatal("expected an error for an invalid mode")
+	}
+}
+
+func TestProofFor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, sharded := range []bool{false, true} {
+		ds := getDagserv(t)
+		if sharded {
+			defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+			uio.HAMTShardingSize = 1
+		}
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := rt.GetDirectory()
+		var names []string
+		for i := 0; i < 500; i++ {
+			name := fmt.Sprintf("entry%d", i)
+			if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		nd, err := dir.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deepest := 0
+		for _, name := range names {
+			proof, err := dir.ProofFor(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := dir.GetLink(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proof.Root.Equals(nd.Cid()) || !proof.Cid.Equals(l.Cid) {
+				t.Fatal("unexpected proof root or CID")
+			}
+			if err := VerifyProof(proof); err != nil {
+				t.Fatalf("invalid proof for %s: %s", name, err)
+			}
+			if len(proof.Nodes) > deepest {
+				deepest = len(proof.Nodes)
+			}
+		}
+		if sharded && deepest < 2 {
+			t.Fatal("expected proofs through sub-shards")
+		}
+		if !sharded && deepest != 1 {
+			t.Fatal("expected single node proofs")
+		}
+
+		proof, err := dir.ProofFor(ctx, names[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered := proof
+		tampered.Name = names[1]
+		if err := VerifyProof(tampered); err != ErrInvalidProof {
+			t.Fatalf("expected the name to be checked, got %v", err)
+		}
+		tampered = proof
+		tampered.Cid = nd.Cid()
+		if err := VerifyProof(tampered); err != ErrInvalidProof {
+			t.Fatalf("expected the CID to be checked, got %v", err)
+		}
+		tampered = proof
+		tampered.Nodes = append([][]byte{}, proof.Nodes...)
+		tampered.Nodes[0] = append([]byte{}, proof.Nodes[0]...)
+		tampered.Nodes[0][len(tampered.Nodes[0])-1]++
+		if err := VerifyProof(tampered); err != ErrInvalidProof {
+			t.Fatalf("expected the nodes to be checked, got %v", err)
+		}
+
+		if _, err := dir.ProofFor(ctx, "missing"); err != os.ErrNotExist {
+			t.Fatalf("expected os.ErrNotExist, got %v", err)
+		}
+
+		// Only the nodes on the path of the entry are fetched.
+		counting := &flakyDagService{DAGService: ds, reads: make(map[cid.Cid]int)}
+		reopened, err := NewRoot(ctx, counting, nd.(*dag.ProtoNode), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names[:20] {
+			counting.reads = make(map[cid.Cid]int)
+			proof, err := reopened.GetDirectory().ProofFor(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reads int
+			for _, n := range counting.reads {
+				reads += n
+			}
+			if reads > len(proof.Nodes)-1 {
+				t.Fatalf("expected at most %d fetches for a proof of %d nodes, got %d", len(proof.Nodes)-1, len(proof.Nodes), reads)
+			}
+		}
+	}
+
+	// A shard node holding the entry at a position its hash doesn't lead
+	// to doesn't prove its membership.
+	name, target := "entry", getRandFile(t, getDagserv(t), 10).Cid()
+	idx, err := (&nameHashBits{h: nameHash(name)}).next(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := func(idx int) Proof {
+		data, err := ft.HAMTShardData(make([]byte, 32), 256, hamt.HashMurmur3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd := dag.NodeWithData(data)
+		nd.AddRawLink(fmt.Sprintf("%02X", idx)+name, &ipld.Link{Cid: target})
+		return Proof{Root: nd.Cid(), Name: name, Cid: target, Nodes: [][]byte{nd.RawData()}, Positions: []int{0}}
+	}
+	if err := VerifyProof(shard(idx)); err != nil {
+		t.Fatalf("expected the entry at its position to be valid, got %v", err)
+	}
+	if err := VerifyProof(shard((idx + 1) % 256)); err != ErrInvalidProof {
+		t.Fatalf("expected the position to be checked, got %v", err)
+	}
+}
+
+func TestShardingMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardingMode(ShardingMode(42), 5)); err == nil {
+		t.Fatal("expected an error with an invalid mode")
+	}
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardingMode(ShardingByCount, -1)); err == nil {
+		t.Fatal("expected an error with an invalid threshold")
+	}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardingMode(ShardingByCount, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 10)
+
+	for i := 0; i < 4; i++ {
+		if err := dir.AddChild(fmt.Sprintf("f%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metric, err := dir.ShardingMetric()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric != 4 {
+		t.Fatalf("expected a metric of 4, got %d", metric)
+	}
+	if dir.isShardedUnsync() {
+		t.Fatal("expected a basic directory below the threshold")
+	}
+	if err := dir.AddChild("f4", fi); err != nil {
+		t.Fatal(err)
+	}
+	if !dir.isShardedUnsync() {
+		t.Fatal("expected a shard at the threshold")
+	}
+	if err := dir.Unlink("f4"); err != nil {
+		t.Fatal(err)
+	}
+	if dir.isShardedUnsync() {
+		t.Fatal("expected a basic directory after falling below the threshold")
+	}
+
+	// The size metric is tracked with each operation and matches the
+	// size of the basic node of the directory, even when sharded.
+	checkSize := func(dir *Directory) int {
+		t.Helper()
+		metric, err := dir.ShardingMetric()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir.lock.Lock()
+		basic, err := dir.basicNodeUnsync()
+		dir.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metric != len(basic.RawData()) {
+			t.Fatalf("expected a metric of %d, got %d", len(basic.RawData()), metric)
+		}
+		if dir.isShardedUnsync() != (metric >= 200) {
+			t.Fatalf("unexpected representation for a metric of %d", metric)
+		}
+		return metric
+	}
+	rt, err = NewRoot(ctx, ds, emptyDirNode(), nil, WithShardingMode(ShardingBySize, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = rt.GetDirectory()
+	for i := 0; i < 3; i++ {
+		if err := dir.AddChild(fmt.Sprintf("f%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSize(dir)
+	for i := 3; !dir.isShardedUnsync(); i++ {
+		if i > 20 {
+			t.Fatal("expected the directory to be sharded")
+		}
+		if err := dir.AddChild(fmt.Sprintf("f%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if metric := checkSize(dir); metric < 200 {
+		t.Fatalf("expected a metric above the threshold, got %d", metric)
+	}
+	// Updating entries (growing a file) and removing them.
+	fsn, err := dir.Child("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteAt(make([]byte, 100000), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !dir.isShardedUnsync() {
+		t.Fatal("expected the directory to still be sharded")
+	}
+	checkSize(dir)
+	if _, err := dir.UnlinkMany([]string{"f0", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(dir)
+	for i := 2; dir.isShardedUnsync(); i++ {
+		if err := dir.Unlink(fmt.Sprintf("f%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSize(dir)
+
+	// The default metric can be given its own threshold too.
+	rt, err = NewRoot(ctx, ds, emptyDirNode(), nil, WithShardingMode(ShardingDefault, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = rt.GetDirectory()
+	for i := 0; !dir.isShardedUnsync(); i++ {
+		if i > 20 {
+			t.Fatal("expected the directory to be sharded")
+		}
+		if err := dir.AddChild(fmt.Sprintf("f%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if metric, err := dir.ShardingMetric(); err != nil || metric < 100 || metric >= 100+2+fi.Cid().ByteLen()+1 {
+		t.Fatalf("expected a shard once the metric reaches the threshold, got %d (%v)", metric, err)
+	}
+}
+
+func TestExportToOS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{
+		"a/x":   make([]byte, 300000),
+		"a/b/y": []byte("hello"),
+	}
+	for p, data := range contents {
+		rand.Read(data)
+		if err := PutNode(rt, "/"+p, fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ft.SymlinkData("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/l", dag.NodeWithData(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(t.TempDir(), "out")
+	if err := ExportToOS(ctx, rt, "/a", local); err != nil {
+		t.Fatal(err)
+	}
+	for p, data := range contents {
+		got, err := os.ReadFile(filepath.Join(local, filepath.FromSlash(p[len("a/"):])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("content mismatch for %s", p)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(local, "l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "x" {
+		t.Fatalf("expected the symlink to point to x, got %s", target)
+	}
+
+	// Existing files are only replaced when overwriting.
+	if err := ExportToOS(ctx, rt, "/a", local); !os.IsExist(err) {
+		t.Fatalf("expected an exists error, got %v", err)
+	}
+	if err := ExportToOS(ctx, rt, "/a", local, ExportOverwrite()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single file.
+	single := filepath.Join(t.TempDir(), "y")
+	if err := ExportToOS(ctx, rt, "/a/b/y", single, ExportPerm(0600, 0700)); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestBlockCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for name, tc := range map[string]struct {
+		size   int64
+		blocks int
+	}{
+		"small": {10, 1},
+		// A root node with 4 leaves of the default chunk size.
+		"large": {1000000, 5},
+	} {
+		if err := rt.GetDirectory().AddChild(name, getRandFile(t, ds, tc.size)); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := lookupFile(rt, "/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := fi.BlockCount(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.blocks {
+			t.Fatalf("%s: expected %d blocks, got %d", name, tc.blocks, n)
+		}
+	}
+}
+
+func TestGetNodeNoFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithGetNodeFlush(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	clean, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clean.Cid().Equals(emptyDirNode().Cid()) {
+		t.Fatal("expected the empty directory node")
+	}
+
+	if err := dir.AddChild("a", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.GetNode(); err != ErrNotFlushed {
+		t.Fatalf("expected ErrNotFlushed, got %v", err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed.Cid().Equals(clean.Cid()) {
+		t.Fatal("expected the flushed node to include the new entry")
+	}
+
+	// Open writers are pending changes.
+	fi, err := lookupFile(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fi.Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.GetNodeNoFlush(); err != ErrNotFlushed {
+		t.Fatalf("expected ErrNotFlushed with an open writer, got %v", err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The default flushes.
+	_, rt = setupRoot(ctx, t)
+	if err := rt.GetDirectory().AddChild("a", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.GetDirectory().GetNodeNoFlush(); err != ErrNotFlushed {
+		t.Fatalf("expected ErrNotFlushed, got %v", err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err = rt.GetDirectory().GetNodeNoFlush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clean.Cid().Equals(nd.Cid()) {
+		t.Fatal("expected the node stored by GetNode")
+	}
+}
+
+func TestRebase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	build := func(rt *Root, extra bool) {
+		t.Helper()
+		for _, p := range []string{"/a/b", "/c"} {
+			if err := Mkdir(rt, p, MkdirOpts{Mkparents: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := PutNode(rt, "/a/b/x", fileNodeFromReader(t, ds, bytes.NewReader([]byte("x")))); err != nil {
+			t.Fatal(err)
+		}
+		if extra {
+			if err := PutNode(rt, "/c/y", fileNodeFromReader(t, ds, bytes.NewReader([]byte("y")))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build(rt, false)
+	other, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build(other, true)
+	newRoot, err := other.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := lookupDir(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := lookupDir(rt, "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Rebase(ctx, newRoot, []string{"/a/b", "/c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	nb, err := lookupDir(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb != b {
+		t.Fatal("expected the unchanged directory to be preserved")
+	}
+	nc, err := lookupDir(rt, "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc == c {
+		t.Fatal("expected the changed directory to be replaced")
+	}
+	if _, err := lookupFile(rt, "/c/y"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The preserved directory is attached to the new tree.
+	if err := b.AddChild("z", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupFile(rt, "/a/b/z"); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Equals(newRoot.Cid()) {
+		t.Fatal("expected the change in the preserved directory to reach the root")
+	}
+}
+
+func TestWalkDirty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for _, p := range []string{"/a/b", "/c", "/e/f"} {
+		if err := Mkdir(rt, p, MkdirOpts{Mkparents: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/a/b/x", "/e/f/y"} {
+		if err := PutNode(rt, p, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := lookupFile(rt, "/e/f/y"); err != nil {
+		t.Fatal(err)
+	}
+
+	walkDirty := func() []string {
+		t.Helper()
+		var paths []string
+		err := rt.WalkDirty(func(path string, nd FSNode) error {
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := walkDirty(); len(paths) != 0 {
+		t.Fatalf("expected nothing dirty after a flush, got %v", paths)
+	}
+
+	fi, err := lookupFile(rt, "/a/b/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fi.Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/c/new", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/d", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"/a", "/a/b", "/a/b/x", "/c", "/c/new", "/d"}
+	if paths := walkDirty(); !compStrArrs(paths, expected) {
+		t.Fatalf("expected %v, got %v", expected, paths)
+	}
+
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := walkDirty(); len(paths) != 0 {
+		t.Fatalf("expected nothing dirty after a flush, got %v", paths)
+	}
+
+	// Unlinking from a shard that stays sharded syncs its loaded entries
+	// without changing them.
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 500
+	if err := Mkdir(rt, "/s/d", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := PutNode(rt, fmt.Sprintf("/s/f%d", i), getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/s/d", "/s/f1"} {
+		if _, err := Lookup(rt, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := lookupDir(rt, "/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UnlinkMany([]string{"f2"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isShardedUnsync() {
+		t.Fatal("expected /s to stay sharded")
+	}
+	if paths := walkDirty(); !compStrArrs(paths, []string{"/s"}) {
+		t.Fatalf("expected only /s dirty after unlinking from it, got %v", paths)
+	}
+}
+
+func TestReadFileLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	if err := PutNode(rt, "/f", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadFileLimit(rt, "/f", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+	if _, err := ReadFileLimit(rt, "/f", 999); err != ErrFileTooLarge {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	if _, err := ReadFileLimit(rt, "/missing", 1000); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestListSymlinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/f", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	for p, target := range map[string]string{
+		"/a/l1":   "f",
+		"/a/b/l2": "../../../etc/passwd",
+	} {
+		data, err := ft.SymlinkData(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PutNode(rt, p, dag.NodeWithData(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := dir.ListSymlinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SymlinkInfo{
+		{Path: "b/l2", Target: "../../../etc/passwd"},
+		{Path: "l1", Target: "f"},
+	}
+	if len(links) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, links)
+	}
+	for i := range links {
+		if links[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, links)
+		}
+	}
+}
+
+// Counts the nodes added by CID, failing the adds while `fail` is set.
+type addCountingDagService struct {
+	ipld.DAGService
+
+	lock sync.Mutex
+	adds map[cid.Cid]int
+	fail bool
+}
+
+func (a *addCountingDagService) Add(ctx context.Context, nd ipld.Node) error {
+	return a.AddMany(ctx, []ipld.Node{nd})
+}
+
+func (a *addCountingDagService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.fail {
+		return errTransient
+	}
+	for _, nd := range nds {
+		a.adds[nd.Cid()]++
+	}
+	return a.DAGService.AddMany(ctx, nds)
+}
+
+func TestLeafDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &addCountingDagService{DAGService: getDagserv(t), adds: make(map[cid.Cid]int)}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 4*chunker.DefaultBlockSize)
+	write := func(name string, opts ...OpenOption) ipld.Node {
+		t.Helper()
+		if err := Touch(rt, "/"+name); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := lookupFile(rt, "/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := fi.Open(Flags{Write: true, Sync: true}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fi.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+	leafAdds := func(nd ipld.Node) int {
+		ds.lock.Lock()
+		defer ds.lock.Unlock()
+		return ds.adds[nd.Links()[0].Cid]
+	}
+
+	plain := write("plain")
+	if n := leafAdds(plain); n != 4 {
+		t.Fatalf("expected the leaf to be added 4 times without the option, got %d", n)
+	}
+	deduped := write("deduped", WithLeafDedup())
+	if !deduped.Cid().Equals(plain.Cid()) {
+		t.Fatal("expected the same DAG with and without dedup")
+	}
+	if n := leafAdds(deduped); n != 5 {
+		t.Fatalf("expected the leaf to be added once more with the option, got %d", n)
+	}
+	ok, err := FileMatchesBytes(rt, "/deduped", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("content mismatch")
+	}
+
+	// A leaf whose addition failed is added again.
+	dedup := newDedupDAGService(ds)
+	leaf := dag.NewRawNode([]byte("leaf"))
+	ds.fail = true
+	if err := dedup.Add(ctx, leaf); err == nil {
+		t.Fatal("expected the add to fail")
+	}
+	ds.fail = false
+	if err := dedup.Add(ctx, leaf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Get(ctx, leaf.Cid()); err != nil {
+		t.Fatalf("expected the leaf to be stored: %v", err)
+	}
+}
+
+func TestSwapChildren(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	blue := []byte("blue")
+	if err := PutNode(rt, "/blue", fileNodeFromReader(t, ds, bytes.NewReader(blue))); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/green/sub", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.SwapChildren("blue", "missing"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if ok, err := FileMatchesBytes(rt, "/blue", blue); err != nil || !ok {
+		t.Fatalf("expected /blue unchanged after a failed swap (%v)", err)
+	}
+
+	if err := dir.SwapChildren("blue", "green"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := FileMatchesBytes(rt, "/green", blue); err != nil || !ok {
+		t.Fatalf("expected /green to have the contents of /blue (%v)", err)
+	}
+	if _, err := lookupDir(rt, "/blue/sub"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !compStrArrs(names, []string{"blue", "green"}) {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+}
+
+// blobCodec is a `FileCodec` storing the whole file in the data of a
+// single dag-pb node, after a header.
+type blobCodec struct{}
+
+var blobHeader = []byte("blob\x00")
+
+func (blobCodec) Match(nd ipld.Node) bool {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	return ok && bytes.HasPrefix(pbnd.Data(), blobHeader)
+}
+
+func (blobCodec) Open(ctx context.Context, ds ipld.DAGService, nd ipld.Node, flags Flags) (CodecDescriptor, error) {
+	data := nd.(*dag.ProtoNode).Data()[len(blobHeader):]
+	return &blobDescriptor{ds: ds, data: append([]byte(nil), data...)}, nil
+}
+
+type blobDescriptor struct {
+	ds     ipld.DAGService
+	data   []byte
+	offset int64
+}
+
+func (d *blobDescriptor) Read(p []byte) (int, error) {
+	if d.offset >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[d.offset:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *blobDescriptor) Write(p []byte) (int, error) {
+	n, err := d.WriteAt(p, d.offset)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *blobDescriptor) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(d.data)) {
+		d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *blobDescriptor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += int64(len(d.data))
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *blobDescriptor) Truncate(size int64) error {
+	d.data = d.data[:size]
+	return nil
+}
+
+func (d *blobDescriptor) Size() (int64, error) { return int64(len(d.data)), nil }
+
+func (d *blobDescriptor) Node() (ipld.Node, error) {
+	nd := dag.NodeWithData(append(append([]byte(nil), blobHeader...), d.data...))
+	return nd, d.ds.Add(context.Background(), nd)
+}
+
+func (d *blobDescriptor) Close() error { return nil }
+
+func TestFileCodec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	RegisterFileCodec("blob", blobCodec{})
+
+	blob := dag.NodeWithData(append(append([]byte(nil), blobHeader...), "hello"...))
+	if err := ds.Add(ctx, blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("b", blob); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := lookupFile(rt, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := fi.Size(); err != nil || size != 5 {
+		t.Fatalf("expected a size of 5, got %d (%v)", size, err)
+	}
+
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := FileMatchesBytes(rt, "/b", []byte("hello world")); err != nil || !ok {
+		t.Fatalf("expected the appended contents (%v)", err)
+	}
+	nd, err := fi.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(blobCodec{}).Match(nd) {
+		t.Fatal("expected the file to keep the layout of the codec")
+	}
+
+	// UnixFS files are unaffected.
+	if err := PutNode(rt, "/u", fileNodeFromReader(t, ds, bytes.NewReader([]byte("unixfs")))); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := FileMatchesBytes(rt, "/u", []byte("unixfs")); err != nil || !ok {
+		t.Fatalf("expected the unixfs contents (%v)", err)
+	}
+
+	// The writes are logged like those of UnixFS files.
+	var oplog bytes.Buffer
+	logged, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithOpLog(&oplog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logged.GetDirectory().AddChild("b", blob); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = lookupFile(logged, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err = fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteAt([]byte("j"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayOpLog(replayed, &oplog); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := FileMatchesBytes(replayed, "/b", []byte("jello")); err != nil || !ok {
+		t.Fatalf("expected the replayed write (%v)", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range []string{"/a/x", "/a/b/y", "/z"} {
+		if err := PutNode(rt, p, getRandFile(t, ds, int64(1000+i*300000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reachable, err := rt.ReachableSet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(failures int) (*Root, *flakyDagService) {
+		flaky := &flakyDagService{DAGService: ds, failures: failures, reads: make(map[cid.Cid]int)}
+		r, err := NewRoot(ctx, flaky, nd.(*dag.ProtoNode), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, flaky
+	}
+
+	r, flaky := open(0)
+	var fetched int
+	err = r.Prefetch(ctx, 4, WithPrefetchProgress(func(n int) { fetched = n }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != reachable.Len()-1 {
+		t.Fatalf("expected %d blocks fetched, got %d", reachable.Len()-1, fetched)
+	}
+	err = reachable.ForEach(func(c cid.Cid) error {
+		if !c.Equals(nd.Cid()) && flaky.reads[c] != 1 {
+			return fmt.Errorf("block %s read %d times", c, flaky.reads[c])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ = open(1)
+	if err := r.Prefetch(ctx, 4); err != errTransient {
+		t.Fatalf("expected the fetch error, got %v", err)
+	}
+}
+
+func TestNewDetachedFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	fi, err := NewDetachedFile(ctx, ds, WithFileCidBuilder(dag.V1CidPrefix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 300000)
+	rand.Read(data)
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := fi.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Version() != 1 {
+		t.Fatal("expected a CIDv1 node")
+	}
+	if err := rt.GetDirectory().AddChild("f", nd); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := FileMatchesBytes(rt, "/f", data); err != nil || !ok {
+		t.Fatalf("expected the written contents (%v)", err)
+	}
+}
+
+func TestMaxTreeDepth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithMaxTreeDepth(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/a/b/c", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/a/b/c/d", MkdirOpts{}); err != ErrTreeTooDeep {
+		t.Fatalf("expected ErrTreeTooDeep, got %v", err)
+	}
+	if err := Mkdir(rt, "/x/y/z/w", MkdirOpts{Mkparents: true}); err != ErrTreeTooDeep {
+		t.Fatalf("expected ErrTreeTooDeep, got %v", err)
+	}
+	c, err := lookupDir(rt, "/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddChild("f", getRandFile(t, ds, 10)); err != ErrTreeTooDeep {
+		t.Fatalf("expected ErrTreeTooDeep, got %v", err)
+	}
+	if err := PutNode(rt, "/a/b/f", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving a directory brings its subtree along: /m/n can't be moved
+	// under /a (putting n at level 4) but fits at the root.
+	if err := Mkdir(rt, "/p/m/n", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/p/m", "/a/b/m"); err != ErrTreeTooDeep {
+		t.Fatalf("expected ErrTreeTooDeep, got %v", err)
+	}
+	if err := Mv(rt, "/p/m", "/m"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := lookupDir(rt, "/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := m.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := lookupDir(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddChild("m", nd); err != ErrTreeTooDeep {
+		t.Fatalf("expected ErrTreeTooDeep, got %v", err)
+	}
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChild("m", nd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushAndCompactCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a/x", "/a/y", "/z"} {
+		if err := PutNode(rt, p, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lookupFile(rt, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := rt.CachedNodeCount(); n != 4 {
+		t.Fatalf("expected 4 cached nodes, got %d", n)
+	}
+
+	// An open file stays cached.
+	y, err := lookupFile(rt, "/a/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := y.Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	c, err := rt.FlushAndCompactCache(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(nd.Cid()) {
+		t.Fatal("expected the CID of the flushed root")
+	}
+	if n := rt.CachedNodeCount(); n != 2 {
+		t.Fatalf("expected the directory and the open file to stay cached, got %d nodes", n)
+	}
+	if _, err := lookupFile(rt, "/a/x"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRootEager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for _, p := range []string{"/a/b", "/a/c", "/d"} {
+		if err := Mkdir(rt, p, MkdirOpts{Mkparents: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PutNode(rt, "/f", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		budget int
+		cached int
+	}{
+		{0, 0},
+		{2, 2},  // /a and /d.
+		{10, 4}, // And /a/b and /a/c, /f is fetched but not kept.
+	} {
+		flaky := &flakyDagService{DAGService: ds, reads: make(map[cid.Cid]int)}
+		r, err := NewRootEager(ctx, flaky, nd.(*dag.ProtoNode), nil, tc.budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := r.CachedNodeCount(); n != tc.cached {
+			t.Fatalf("budget %d: expected %d cached nodes, got %d", tc.budget, tc.cached, n)
+		}
+		if reads := len(flaky.reads); reads > tc.budget {
+			t.Fatalf("budget %d: %d nodes fetched", tc.budget, reads)
+		}
+	}
+
+	// A failed preload stops the background flush.
+	goroutines := runtime.NumGoroutine()
+	flaky := &flakyDagService{DAGService: ds, failures: 1, reads: make(map[cid.Cid]int)}
+	_, err = NewRootEager(ctx, flaky, nd.(*dag.ProtoNode), nil, 10, WithBackgroundFlush(time.Millisecond))
+	if err != errTransient {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("expected at most %d goroutines, got %d", goroutines, n)
+	}
+}
+
+// Returns the `fakes` nodes for their keys (which aren't their CIDs), to
+// build cyclic DAGs.
+type lyingDagService struct {
+	ipld.DAGService
+
+	fakes map[cid.Cid]ipld.Node
+}
+
+func (l *lyingDagService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if nd, ok := l.fakes[c]; ok {
+		return nd, nil
+	}
+	return l.DAGService.Get(ctx, c)
+}
+
+// fakeCid returns a CID (of no node) for `lyingDagService`.
+func fakeCid(t *testing.T, name string) cid.Cid {
+	c, err := dag.V0CidPrefix().Sum([]byte(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCycleDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	// The root links "b" to a CID for which the DAG service returns a
+	// directory linking back to the root (and the same for a file).
+	lying := &lyingDagService{DAGService: ds, fakes: make(map[cid.Cid]ipld.Node)}
+	cyclic := func(fake string, data []byte, name string) *dag.ProtoNode {
+		c := fakeCid(t, fake)
+		root := dag.NodeWithData(data)
+		if err := root.AddRawLink(name, &ipld.Link{Cid: c}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.Add(ctx, root); err != nil {
+			t.Fatal(err)
+		}
+		back := dag.NodeWithData(data)
+		if err := back.AddRawLink(name, &ipld.Link{Cid: root.Cid()}); err != nil {
+			t.Fatal(err)
+		}
+		lying.fakes[c] = back
+		return root
+	}
+	root := cyclic("fake", ft.FolderPBData(), "b")
+
+	rt, err := NewRoot(ctx, lying, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.DumpJSON(ctx, io.Discard); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from DumpJSON, got %v", err)
+	}
+	if _, err := rt.FindDangling(ctx); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from FindDangling, got %v", err)
+	}
+	if _, err := rt.GetDirectory().StructuralHash(ctx); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from StructuralHash, got %v", err)
+	}
+	other := cyclic("other", ft.FolderPBData(), "b")
+	if _, err := Equal(ctx, lying, root.Cid(), other.Cid()); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from Equal, got %v", err)
+	}
+	fi, err := NewFile("f", cyclic("file", ft.FilePBData(nil, 0), ""), nil, lying)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fi.BlockCount(ctx); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from BlockCount, got %v", err)
+	}
+
+	rt, err = NewRoot(ctx, lying, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err = Walk(ctx, rt.GetDirectory(), func(path string, nd FSNode) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected, got %v", err)
+	}
+	if _, err := rt.GetDirectory().ListRecursive(ctx, ListRecursiveOpts{}); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from ListRecursive, got %v", err)
+	}
+	if err := rt.WalkReachable(ctx, func(cid.Cid) error { return nil }); !errors.Is(err, ErrCycleDetected) {
+		t.Fatalf("expected ErrCycleDetected from WalkReachable, got %v", err)
+	}
+
+	// The walk of the tree loads (and flushes) "b" under its real CID so
+	// the blocks are checked on a fresh root.
+	rt, err = NewRoot(ctx, lying, root, nil, WithSkipCycles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := rt.ReachableSet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != 2 {
+		t.Fatalf("expected 2 reachable blocks, got %d", set.Len())
+	}
+
+	rt, err = NewRoot(ctx, lying, root, nil, WithSkipCycles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = nil
+	err = Walk(ctx, rt.GetDirectory(), func(path string, nd FSNode) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(paths, []string{"b"}) {
+		t.Fatalf("expected only b to be visited, got %v", paths)
+	}
+	if err := rt.DumpJSON(ctx, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.GetDirectory().StructuralHash(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetRootSharded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 1000
+
+	var lk sync.Mutex
+	var published cid.Cid
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), func(ctx context.Context, c cid.Cid) error {
+		lk.Lock()
+		defer lk.Unlock()
+		published = c
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.IsRootSharded() {
+		t.Fatal("expected a basic root")
+	}
+	if err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 100)
+	if err := PutNode(rt, "/f", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.SetRootSharded(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if !rt.IsRootSharded() {
+		t.Fatal("expected a sharded root")
+	}
+
+	// The path operations work on the shard, which removing entries (well
+	// below the threshold) doesn't convert back.
+	if err := Mv(rt, "/f", "/a/b/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/c", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().Unlink("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupFile(rt, "/a/b/f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !rt.IsRootSharded() {
+		t.Fatal("expected the root to stay sharded")
+	}
+	names, err := rt.GetDirectory().ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compStrArrs(names, []string{"a"}) {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+
+	// The republisher publishes the shard.
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lk.Lock()
+	c := published
+	lk.Unlock()
+	nd, err := ds.Get(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := ft.FSNodeFromBytes(nd.(*dag.ProtoNode).Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != ft.THAMTShard {
+		t.Fatalf("expected a shard to be published, got %s", fsn.Type())
+	}
+
+	// A shard root can be loaded and converted back.
+	rt, err = NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.SetRootSharded(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if rt.IsRootSharded() {
+		t.Fatal("expected a basic root")
+	}
+	if _, err := lookupFile(rt, "/a/b/f"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithBackgroundFlush(0)); err == nil {
+		t.Fatal("expected an error with an invalid interval")
+	}
+
+	var lk sync.Mutex
+	var published cid.Cid
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), func(ctx context.Context, c cid.Cid) error {
+		lk.Lock()
+		defer lk.Unlock()
+		published = c
+		return nil
+	}, WithBackgroundFlush(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasEntry := func(c cid.Cid, name string) bool {
+		nd, err := ds.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = nd.(*dag.ProtoNode).GetNodeLink(name)
+		return err == nil
+	}
+
+	// The change is flushed without calling `Flush`.
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, dirty := rt.GetDirectory().storedCid()
+		if !dirty && hasEntry(c, "a") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the change wasn't flushed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// `Close` flushes (and publishes) the last changes.
+	if err := Mkdir(rt, "/b", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lk.Lock()
+	c := published
+	lk.Unlock()
+	if !hasEntry(c, "a") || !hasEntry(c, "b") {
+		t.Fatal("expected the last changes to be published on close")
+	}
+	select {
+	case <-rt.flushStopped:
+	default:
+		t.Fatal("expected the background flush to be stopped")
+	}
+}
+
+func TestExportToOSUnsafeNames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	fi := getRandFile(t, ds, 10)
+	for _, name := range []string{"..", "a/b", `\`} {
+		nd := ft.EmptyDirNode()
+		if err := nd.AddNodeLink(name, fi); err != nil {
+			t.Fatal(err)
+		}
+		rt, err := NewRoot(ctx, ds, nd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parent := t.TempDir()
+		local := filepath.Join(parent, "out")
+		if err := ExportToOS(ctx, rt, "/", local); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("%q: expected ErrInvalidName, got %v", name, err)
+		}
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "out" {
+			t.Fatalf("%q: expected only the export directory, got %v", name, entries)
+		}
+	}
+}
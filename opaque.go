@@ -0,0 +1,34 @@
+package mfs
+
+import (
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Opaque is an entry of a directory pointing to a node that isn't UnixFS
+// (e.g., a dag-cbor node or a dag-pb node without UnixFS data, see
+// `Directory.AddRawChild`). MFS doesn't interpret it, it only exposes its
+// node: it can be looked up, listed, moved and removed like other entries
+// but not modified.
+type Opaque struct {
+	name string
+	node ipld.Node
+}
+
+// GetNode returns the linked node.
+func (o *Opaque) GetNode() (ipld.Node, error) {
+	return o.node, nil
+}
+
+// Flush does nothing, an opaque node is never modified.
+func (o *Opaque) Flush() error {
+	return nil
+}
+
+// Type returns `TRaw`.
+func (o *Opaque) Type() NodeType {
+	return TRaw
+}
+
+// SetCidBuilder does nothing, opaque nodes are never re-encoded.
+func (o *Opaque) SetCidBuilder(cid.Builder) {}
@@ -0,0 +1,160 @@
+package mfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	gopath "path"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Operations recorded in the log of `WithOpLog`.
+const (
+	// An entry `Path` added, linking to `Cid`.
+	OpAdd = "add"
+	// An empty directory created at `Path`, with CID `Cid`.
+	OpMkdir = "mkdir"
+	// The entry `Path` removed.
+	OpUnlink = "unlink"
+	// The file at `Path` written (flushed by a descriptor), with the new
+	// CID `Cid`.
+	OpWrite = "write"
+	// The whole tree replaced with the root node `Cid` (`Root.ReplaceBase`,
+	// `Root.Rebase` and `Root.FollowBase`), `Path` is always "/".
+	OpBase = "base"
+)
+
+// Mutations made with other operations are recorded as the ones above
+// they're made of, e.g., `Mv` is recorded as the addition of the
+// destination (`OpAdd` replaces an existing entry) and the removal of the
+// source.
+
+// OpLogEntry is a mutation recorded in the log of `WithOpLog`, encoded as
+// a JSON object per line.
+type OpLogEntry struct {
+	Op   string    `json:"op"`
+	Path string    `json:"path"`
+	Cid  string    `json:"cid,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// opLog writes the entries of `WithOpLog`.
+type opLog struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// record writes an entry to the log. The mutation has already happened:
+// a failure to write is only logged.
+func (l *opLog) record(op, path string, c cid.Cid) {
+	entry := OpLogEntry{
+		Op:   op,
+		Path: path,
+		Time: time.Now(),
+	}
+	if c.Defined() {
+		entry.Cid = c.String()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		log.Errorf("writing to the operation log: %s", err)
+	}
+}
+
+// recordOp records the mutation `op` of the entry `name` of `d` in the
+// operation log, if enabled.
+func (d *Directory) recordOp(op, name string, c cid.Cid) {
+	if l := optionsOf(d).opLog; l != nil {
+		l.record(op, gopath.Join(d.Path(), name), c)
+	}
+}
+
+// replaceChild adds the entry `name` linking to `nd` (already in the DAG
+// service) or replaces the existing one, recording it as `op`.
+func (d *Directory) replaceChild(op, name string, nd ipld.Node) error {
+	if err := d.validateName(name); err != nil {
+		return err
+	}
+	if err := d.validateSubtree(nd); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.entriesCache, name)
+	if err := d.unixfsAddChild(name, nd); err != nil {
+		return err
+	}
+	d.touch()
+	d.recordOp(op, name, nd.Cid())
+	return nil
+}
+
+// ReplayOpLog applies the mutations of an operation log written with
+// `WithOpLog` to `r`, e.g., to reconstruct the state of a tree from its
+// last flushed root. The nodes referenced by the log must be available in
+// the DAG service of `r`. It stops at the first entry that can't be
+// applied.
+func ReplayOpLog(r *Root, oplog io.Reader) error {
+	ds := r.GetDirectory().dagService
+	dec := json.NewDecoder(oplog)
+	for i := 0; ; i++ {
+		var entry OpLogEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("decoding entry %d: %w", i, err)
+		}
+
+		if err := replayOp(r, ds, entry); err != nil {
+			return fmt.Errorf("replaying entry %d (%s %s): %w", i, entry.Op, entry.Path, err)
+		}
+	}
+}
+
+func replayOp(r *Root, ds ipld.NodeGetter, entry OpLogEntry) error {
+	dirPath, name := gopath.Split(gopath.Clean("/" + entry.Path))
+	dir, err := lookupDir(r, dirPath)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Op {
+	case OpBase:
+		c, err := cid.Decode(entry.Cid)
+		if err != nil {
+			return err
+		}
+		nd, err := ds.Get(r.GetDirectory().ctx, c)
+		if err != nil {
+			return err
+		}
+		return r.ReplaceBase(r.GetDirectory().ctx, nd)
+	case OpMkdir:
+		_, err := dir.Mkdir(name)
+		return err
+	case OpUnlink:
+		return dir.Unlink(name)
+	case OpAdd, OpWrite:
+		c, err := cid.Decode(entry.Cid)
+		if err != nil {
+			return err
+		}
+		nd, err := ds.Get(r.GetDirectory().ctx, c)
+		if err != nil {
+			return err
+		}
+		return dir.replaceChild(entry.Op, name, nd)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+}
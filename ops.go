@@ -1,11 +1,17 @@
 package mfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	gopath "path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	path "github.com/ipfs/go-path"
 
@@ -13,6 +19,12 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
+var ErrPathTooDeep = errors.New("path has too many components")
+
+// ErrNotDir is returned by `Mkdir` when the target path exists but isn't a
+// directory.
+var ErrNotDir = errors.New("not a directory")
+
 // TODO: Evaluate moving all this operations to as `Root`
 // methods, since all of them use it as its first argument
 // and there is no clear documentation that explains this
@@ -48,7 +60,7 @@ func Mv(r *Root, src, dst string) error {
 		return err
 	}
 
-	nd, err := srcObj.GetNode()
+	nd, err := flushedNode(srcObj)
 	if err != nil {
 		return err
 	}
@@ -56,7 +68,7 @@ func Mv(r *Root, src, dst string) error {
 	fsn, err := dstDir.Child(dstFname)
 	if err == nil {
 		switch n := fsn.(type) {
-		case *File:
+		case *File, *Opaque:
 			_ = dstDir.Unlink(dstFname)
 		case *Directory:
 			dstDir = n
@@ -123,10 +135,15 @@ type MkdirOpts struct {
 	Mkparents  bool
 	Flush      bool
 	CidBuilder cid.Builder
+	// Return nil (instead of `os.ErrExist`) if the target directory
+	// already exists. `Mkparents` also implies it.
+	ExistOK bool
 }
 
 // Mkdir creates a directory at 'path' under the directory 'd', creating
-// intermediary directories as needed if 'mkparents' is set to true
+// intermediary directories as needed if 'mkparents' is set to true. If the
+// target already exists it returns `ErrNotDir` if it isn't a directory and
+// otherwise `os.ErrExist` (unless `ExistOK` or `Mkparents` are set).
 func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 	if pth == "" {
 		return fmt.Errorf("no path given to Mkdir")
@@ -143,7 +160,7 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 
 	if len(parts) == 0 {
 		// this will only happen on 'mkdir /'
-		if opts.Mkparents {
+		if opts.Mkparents || opts.ExistOK {
 			return nil
 		}
 		return fmt.Errorf("cannot create directory '/': Already exists")
@@ -173,8 +190,11 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 	}
 
 	final, err := cur.Mkdir(parts[len(parts)-1])
+	if err == os.ErrExist && final == nil {
+		return ErrNotDir
+	}
 	if err != nil {
-		if !opts.Mkparents || err != os.ErrExist || final == nil {
+		if !(opts.Mkparents || opts.ExistOK) || err != os.ErrExist {
 			return err
 		}
 	}
@@ -192,6 +212,31 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 	return nil
 }
 
+// Touch creates an empty file at `pth` (encoded as set with
+// `WithEmptyFileMode`) if there's no entry there already; existing entries
+// are left untouched (there's no modification time to update). The parent
+// directory must exist.
+func Touch(r *Root, pth string) error {
+	dirPath, name := gopath.Split(gopath.Clean("/" + pth))
+	if name == "" {
+		return nil
+	}
+	dir, err := lookupDir(r, dirPath)
+	if err != nil {
+		return err
+	}
+
+	nd, err := dir.emptyFileNode()
+	if err != nil {
+		return err
+	}
+	err = dir.AddChild(name, nd)
+	if err == ErrDirExists {
+		return nil
+	}
+	return err
+}
+
 // Lookup extracts the root directory and performs a lookup under it.
 // TODO: Now that the root is always a directory, can this function
 // be collapsed with `DirLookup`? Or at least be made a method of `Root`?
@@ -209,6 +254,9 @@ func DirLookup(d *Directory, pth string) (FSNode, error) {
 	if len(parts) == 1 && parts[0] == "" {
 		return d, nil
 	}
+	if max := optionsOf(d).maxPathDepth; max > 0 && len(parts) > max {
+		return nil, ErrPathTooDeep
+	}
 
 	var cur FSNode
 	cur = d
@@ -228,6 +276,226 @@ func DirLookup(d *Directory, pth string) (FSNode, error) {
 	return cur, nil
 }
 
+// StatInfo returns an `os.FileInfo` describing the file or directory at
+// 'path'. The current UnixFS format has no mode or modification time so
+// `Mode` only carries the directory bit (for directories) and `ModTime`
+// is always the zero time. `Sys` returns the underlying `FSNode`.
+func StatInfo(r *Root, path string) (os.FileInfo, error) {
+	fsn, err := Lookup(r, path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &fileInfo{
+		name: gopath.Base(gopath.Clean("/" + path)),
+		node: fsn,
+	}
+	switch fsn := fsn.(type) {
+	case *Directory:
+		info.mode = os.ModeDir
+	case *File:
+		info.size, err = fsn.Size()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// fileInfo implements `os.FileInfo` for `StatInfo`.
+type fileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+	node FSNode
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.node }
+
+// FileMatches reports whether the file at 'path' has the CID `c`, only
+// its (already known) node is checked, no data is read.
+func FileMatches(r *Root, path string, c cid.Cid) (bool, error) {
+	fi, err := lookupFile(r, path)
+	if err != nil {
+		return false, err
+	}
+	nd, err := fi.GetNode()
+	if err != nil {
+		return false, err
+	}
+	return nd.Cid().Equals(c), nil
+}
+
+// FileMatchesBytes reports whether the content of the file at 'path' is
+// `data`. The sizes are compared first (from the file node) and only if
+// they match is the content read and compared, stopping at the first
+// difference. (The CID `data` would have depends on how the file was
+// chunked, which isn't recorded, so it can't be compared instead.)
+func FileMatchesBytes(r *Root, path string, data []byte) (bool, error) {
+	fi, err := lookupFile(r, path)
+	if err != nil {
+		return false, err
+	}
+	size, err := fi.Size()
+	if err != nil {
+		return false, err
+	}
+	if size != int64(len(data)) {
+		return false, nil
+	}
+
+	fd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	buf := make([]byte, 32*1024)
+	for len(data) > 0 {
+		if len(buf) > len(data) {
+			buf = buf[:len(data)]
+		}
+		n, err := io.ReadFull(fd, buf)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(buf[:n], data[:n]) {
+			return false, nil
+		}
+		data = data[n:]
+	}
+	return true, nil
+}
+
+// ReadFilesError is returned by `ReadFiles` when some of the paths
+// couldn't be read, with the error of each of them.
+type ReadFilesError struct {
+	Errs map[string]error
+}
+
+func (e *ReadFilesError) Error() string {
+	paths := make([]string, 0, len(e.Errs))
+	for p := range e.Errs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	msgs := make([]string, len(paths))
+	for i, p := range paths {
+		msgs[i] = fmt.Sprintf("%s: %s", p, e.Errs[p])
+	}
+	return fmt.Sprintf("reading %d files: %s", len(paths), strings.Join(msgs, "; "))
+}
+
+// ReadFiles reads the whole contents of the files at `paths`, resolving
+// and reading up to `concurrency` of them at the same time, and returns
+// them by path. A path that can't be read (e.g., because it doesn't exist)
+// doesn't abort the others: it's left out of the map and reported in the
+// returned `*ReadFilesError` along with the rest of the failures.
+func ReadFiles(ctx context.Context, r *Root, paths []string, concurrency int) (map[string][]byte, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		lock     sync.Mutex
+		contents = make(map[string][]byte, len(paths))
+		errs     = make(map[string]error)
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+	)
+	for _, p := range paths {
+		p := p
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+
+			data, err := readWholeFile(ctx, r, p)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs[p] = err
+				return
+			}
+			contents[p] = data
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return contents, &ReadFilesError{Errs: errs}
+	}
+	return contents, nil
+}
+
+// readWholeFile reads the whole contents of the file at `path`.
+func readWholeFile(ctx context.Context, r *Root, path string) ([]byte, error) {
+	fi, err := lookupFile(r, path)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := fi.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// ErrFileTooLarge is returned by `ReadFileLimit` for files bigger than
+// the limit.
+var ErrFileTooLarge = errors.New("file too large")
+
+// ReadFileLimit reads the whole contents of the file at `path` if its size
+// (taken from the root node of the file, before reading any data) is at
+// most `max` bytes, otherwise it returns `ErrFileTooLarge`. The read is
+// bounded by `max` too, in case the size of the node doesn't match the
+// actual contents.
+func ReadFileLimit(r *Root, path string, max int64) ([]byte, error) {
+	fi, err := lookupFile(r, path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fi.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size > max {
+		return nil, ErrFileTooLarge
+	}
+
+	fd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	data, err := io.ReadAll(io.LimitReader(fd, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, ErrFileTooLarge
+	}
+	return data, nil
+}
+
+func lookupFile(r *Root, path string) (*File, error) {
+	fsn, err := Lookup(r, path)
+	if err != nil {
+		return nil, err
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return nil, ErrIsDirectory
+	}
+	return fi, nil
+}
+
 // TODO: Document this function and link its functionality
 // with the republisher.
 func FlushPath(ctx context.Context, rt *Root, pth string) (ipld.Node, error) {
@@ -241,6 +509,8 @@ func FlushPath(ctx context.Context, rt *Root, pth string) (ipld.Node, error) {
 		return nil, err
 	}
 
-	rt.repub.WaitPub(ctx)
-	return nd.GetNode()
+	if rt.repub != nil {
+		rt.repub.WaitPub(ctx)
+	}
+	return flushedNode(nd)
 }
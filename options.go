@@ -1,7 +1,636 @@
 package mfs
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
 type Flags struct {
 	Read  bool
 	Write bool
 	Sync  bool
 }
+
+// OpenOption configures optional behavior of a `FileDescriptor`, passed
+// to `File.Open`.
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	autoFlush         time.Duration
+	writeBufferBlocks int
+	sizeHint          int64
+	readAhead         int
+	leafDedup         bool
+}
+
+// WithAutoFlush makes a descriptor opened for writing flush the file
+// (propagating the change up to the `Root`) every `interval` until it's
+// closed, bounding the amount of data lost if the process stops without
+// a final flush.
+func WithAutoFlush(interval time.Duration) OpenOption {
+	return func(o *openOptions) {
+		o.autoFlush = interval
+	}
+}
+
+// WithWriteBufferBlocks limits the amount of written data a descriptor
+// keeps in memory to `n` blocks (of the default chunker size): `Write`
+// stores the buffered data in the DAG service every time the write offset
+// reaches a multiple of the limit. As those offsets are block aligned, the
+// resulting file is the same regardless of the limit as long as the data
+// appended to it starts at a block boundary (e.g., writing sequentially
+// from the start, or after a `Seek` into a file whose size is a multiple
+// of the block size); otherwise its blocks may be split differently.
+// Only `Write` is limited, not `WriteAt`. (The underlying
+// `DagModifier` never buffers more than 2 MiB, so limits above that
+// have no effect.)
+func WithWriteBufferBlocks(n int) OpenOption {
+	return func(o *openOptions) {
+		o.writeBufferBlocks = n
+	}
+}
+
+// WithSizeHint signals the expected final size of the file being written,
+// used to select the chunker with `WithAdaptiveChunking`.
+func WithSizeHint(size int64) OpenOption {
+	return func(o *openOptions) {
+		o.sizeHint = size
+	}
+}
+
+// WithReadAhead makes a descriptor opened only for reading fetch the
+// blocks of the file ahead of the reads, up to `blocks` of them
+// concurrently (in each level of the DAG of the file), which keeps
+// sequential reads (e.g., with `io.Copy`) from waiting on the latency of
+// the DAG service for every block. The prefetching starts again from the
+// new offset after a `Seek` and stops when the descriptor is closed (or
+// the context passed to `CtxReadFull` is done). It's ignored when writing.
+func WithReadAhead(blocks int) OpenOption {
+	return func(o *openOptions) {
+		o.readAhead = blocks
+	}
+}
+
+// WithLeafDedup makes a descriptor opened for writing skip adding to the
+// DAG service the leaves produced by the chunker that are identical to
+// one already added through it (e.g., the runs of zeros of a disk image).
+// This only saves the calls to `Add`: identical leaves have the same CID so
+// they're already stored once (and linked to the same block), the DAG and
+// the storage used are the same as without the option.
+func WithLeafDedup() OpenOption {
+	return func(o *openOptions) {
+		o.leafDedup = true
+	}
+}
+
+// FileOpt configures a `File` created with `NewDetachedFile`.
+type FileOpt func(*fileOptions)
+
+type fileOptions struct {
+	cidBuilder cid.Builder
+	rawLeaves  bool
+}
+
+// WithFileCidBuilder sets the CID builder of the nodes of the file (see
+// `File.SetCidBuilder`).
+func WithFileCidBuilder(b cid.Builder) FileOpt {
+	return func(o *fileOptions) {
+		o.cidBuilder = b
+	}
+}
+
+// WithFileRawLeaves makes the file store its data in raw leaves (the
+// default for CIDv1 builders).
+func WithFileRawLeaves() FileOpt {
+	return func(o *fileOptions) {
+		o.rawLeaves = true
+	}
+}
+
+// CopyOption configures optional behavior of `Directory.CopyChild`.
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	overwrite bool
+}
+
+// WithOverwrite makes `Directory.CopyChild` replace the target entry if it
+// already exists instead of failing.
+func WithOverwrite() CopyOption {
+	return func(o *copyOptions) {
+		o.overwrite = true
+	}
+}
+
+// MoveOption configures optional behavior of `Directory.MoveChild`.
+type MoveOption func(*moveOptions)
+
+type moveOptions struct {
+	mkparents bool
+}
+
+// WithMoveMkparents makes `Directory.MoveChild` create the missing
+// directories of the destination path (as `MkdirOpts.Mkparents`).
+func WithMoveMkparents() MoveOption {
+	return func(o *moveOptions) {
+		o.mkparents = true
+	}
+}
+
+// RootOption configures optional behavior of a `Root` (and of every
+// `Directory` and `File` under it). Options are passed to `NewRoot`.
+type RootOption func(*rootOptions) error
+
+// rootOptions holds the configuration set through `RootOption`s, its
+// zero value corresponds to the default MFS behavior.
+type rootOptions struct {
+	dupLinkPolicy         DuplicateLinkPolicy
+	noRepublisher         bool
+	deterministic         bool
+	adaptiveChunking      bool
+	maxPathDepth          int
+	flushBatchSize        int
+	shardUp               int
+	shardDown             int
+	nameValidator         func(name string) error
+	readAttempts          int
+	readBackoff           time.Duration
+	flushConflictResolver func(path string, a, b ipld.Node) (ipld.Node, error)
+	nodeCacheSize         int
+	maxNameLength         int
+	history               bool
+	historyHead           cid.Cid
+	leafCidBuilder        cid.Builder
+	opLog                 *opLog
+	emptyFileMode         EmptyFileMode
+	shardingMode          ShardingMode
+	shardingThreshold     int
+	getNodeNoFlush        bool
+	maxTreeDepth          int
+	skipCycles            bool
+	backgroundFlush       time.Duration
+}
+
+var defaultRootOptions rootOptions
+
+// DuplicateLinkPolicy determines how a (malformed) directory node that
+// has more than one link with the same name is handled when loaded.
+type DuplicateLinkPolicy int
+
+const (
+	// DuplicateLinkError rejects directories with duplicate link names.
+	DuplicateLinkError DuplicateLinkPolicy = iota + 1
+	// DuplicateLinkFirst keeps the first link found for each name.
+	DuplicateLinkFirst
+	// DuplicateLinkLast keeps the last link found for each name.
+	DuplicateLinkLast
+)
+
+// WithDuplicateLinkPolicy sets the policy applied to duplicate link names
+// found when loading directories. Without this option directories are
+// loaded as is and the behavior over duplicate names is undefined.
+func WithDuplicateLinkPolicy(p DuplicateLinkPolicy) RootOption {
+	return func(o *rootOptions) error {
+		o.dupLinkPolicy = p
+		return nil
+	}
+}
+
+// WithoutRepublisher disables the `Republisher` of the `Root`, the `PubFunc`
+// passed to `NewRoot` (if any) is never called. `Flush` still updates the
+// tree and the caller is in charge of publishing the resulting root node.
+func WithoutRepublisher() RootOption {
+	return func(o *rootOptions) error {
+		o.noRepublisher = true
+		return nil
+	}
+}
+
+// WithDeterministic makes the tree independent of when (and in which
+// order) it was built: no modification times are recorded. Directory nodes
+// are always encoded with their links sorted by name (as required by
+// dag-pb) and HAMT shards place entries by the hash of their names, so,
+// given the same entries and CID builders, the root CID is the same across
+// runs and platforms.
+func WithDeterministic() RootOption {
+	return func(o *rootOptions) error {
+		o.deterministic = true
+		return nil
+	}
+}
+
+// Parameters of the chunking selection of `WithAdaptiveChunking`, they
+// are read each time a file is opened.
+var (
+	// AdaptiveChunkingThreshold is the file size (in bytes) below which a
+	// file is considered small.
+	AdaptiveChunkingThreshold int64 = 1024 * 1024
+	// AdaptiveSmallChunkSize is the size of the fixed chunks used for
+	// small files.
+	AdaptiveSmallChunkSize int64 = 1024 * 64
+	// AdaptiveRabinAverageSize is the average chunk size of the rabin
+	// (content-defined) chunker used for large files.
+	AdaptiveRabinAverageSize uint64 = 1024 * 256
+)
+
+// WithAdaptiveChunking selects the chunker used when writing each file
+// based on its size (the largest of its current size and the hint given
+// with `WithSizeHint`) when opened: small files (under
+// `AdaptiveChunkingThreshold`) are split in fixed chunks of
+// `AdaptiveSmallChunkSize` bytes stored as raw leaves, while larger ones
+// use a rabin chunker (with an average size of `AdaptiveRabinAverageSize`)
+// which allows to deduplicate data shifted between versions of a file.
+// Without this option files use the default fixed size chunker.
+func WithAdaptiveChunking() RootOption {
+	return func(o *rootOptions) error {
+		o.adaptiveChunking = true
+		return nil
+	}
+}
+
+// WithMaxPathDepth limits the number of components of the paths resolved
+// by `Lookup` and `DirLookup`, longer paths are rejected with
+// `ErrPathTooDeep` before resolving any of them. By default paths are
+// unlimited.
+func WithMaxPathDepth(n int) RootOption {
+	return func(o *rootOptions) error {
+		o.maxPathDepth = n
+		return nil
+	}
+}
+
+// WithFlushBatchSize makes `Flush` (of the `Root` or of a `Directory`)
+// store the nodes of the flushed directories through an `ipld.Batch`,
+// which adds them to the DAG service with `AddMany` in batches of up to
+// `n` nodes in total (split between the commits the batch runs in
+// parallel) instead of one `Add` call per node. The resulting nodes (and
+// CIDs) are the same.
+func WithFlushBatchSize(n int) RootOption {
+	return func(o *rootOptions) error {
+		o.flushBatchSize = n
+		return nil
+	}
+}
+
+// WithShardHysteresis replaces the automatic conversion of directories
+// between the basic and HAMT shard representations (driven by the single
+// `uio.HAMTShardingSize` threshold) with one based on the number of
+// entries: a directory is converted to a shard when it reaches `up`
+// entries but only converted back when it falls below `down` (which must
+// be smaller), so a directory hovering around the threshold doesn't keep
+// converting back and forth (see `Directory.ConversionCount`).
+func WithShardHysteresis(up, down int) RootOption {
+	return func(o *rootOptions) error {
+		if down < 0 || down >= up {
+			return fmt.Errorf("invalid shard hysteresis: down (%d) must be in [0, up (%d))", down, up)
+		}
+		o.shardUp = up
+		o.shardDown = down
+		return nil
+	}
+}
+
+// ShardingMode selects the metric compared against the sharding threshold
+// to decide when a directory is converted to a HAMT shard (and back).
+type ShardingMode int
+
+const (
+	// ShardingDefault uses the go-unixfs estimation of the directory size
+	// (the sum of the lengths of the names and CIDs of the entries).
+	ShardingDefault ShardingMode = iota
+	// ShardingByCount uses the number of entries.
+	ShardingByCount
+	// ShardingBySize uses the size in bytes of the serialized basic
+	// directory node.
+	ShardingBySize
+)
+
+// WithShardingMode sets the metric used to decide when directories are
+// converted between the basic and HAMT shard representations (see
+// `Directory.ShardingMetric`) and the `threshold` it's compared against:
+// a number of entries for `ShardingByCount`, of bytes otherwise. A zero
+// threshold keeps `uio.HAMTShardingSize` (whose `0` disables the automatic
+// conversions). The metric is computed once per directory and then updated
+// with each entry added or removed; for a HAMT shard that requires fetching
+// the node of the entry, and the entries whose node isn't in the DAG
+// service aren't accounted for when replaced or removed. It has no effect
+// on the directories of a root created `WithShardHysteresis`.
+func WithShardingMode(mode ShardingMode, threshold int) RootOption {
+	return func(o *rootOptions) error {
+		if mode < ShardingDefault || mode > ShardingBySize {
+			return fmt.Errorf("invalid sharding mode: %d", mode)
+		}
+		if threshold < 0 {
+			return fmt.Errorf("invalid sharding threshold: %d", threshold)
+		}
+		o.shardingMode = mode
+		o.shardingThreshold = threshold
+		return nil
+	}
+}
+
+// manualSharding reports if the conversions between the basic and HAMT
+// shard representations are done by MFS (see `applyShardHysteresis`)
+// instead of by the `DynamicDirectory` of go-unixfs.
+func (o *rootOptions) manualSharding() bool {
+	return o.shardUp > 0 || o.shardingMode != ShardingDefault || o.shardingThreshold > 0
+}
+
+// WithGetNodeFlush sets the behavior of `Directory.GetNode`: when `flush`
+// is true (the default) it syncs and stores the directory before
+// returning its node, when false it's non-mutating and returns the last
+// stored node, or `ErrNotFlushed` if there are pending changes (see
+// `Directory.GetNodeNoFlush`). This only changes the public method: the
+// operations of MFS that need the current node of a directory (e.g.,
+// `Root.Flush`, `Mv`) still sync it. `File.GetNode` never flushes so it's
+// unaffected.
+func WithGetNodeFlush(flush bool) RootOption {
+	return func(o *rootOptions) error {
+		o.getNodeNoFlush = !flush
+		return nil
+	}
+}
+
+// WithMaxTreeDepth limits the depth of the tree to `n` levels: adding an
+// entry (e.g., with `Mkdir` or `AddChild`) to a directory `n` levels below
+// the root (whose entries are at level 1) fails with `ErrTreeTooDeep`. A
+// directory added (or moved) as a whole brings its subtree along so the
+// depth of its entries is checked too, fetching its subdirectories (and
+// the root nodes of its files) down to the limit. The entries linked by
+// CID only (`AddChildCid`) aren't inspected. Zero (the default) means no
+// limit.
+func WithMaxTreeDepth(n int) RootOption {
+	return func(o *rootOptions) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum tree depth: %d", n)
+		}
+		o.maxTreeDepth = n
+		return nil
+	}
+}
+
+// WithSkipCycles makes the traversals of the tree (`Walk` and the ones
+// built on it, `Root.DumpJSON`, `Root.FindDangling`,
+// `Directory.StructuralHash`, `File.BlockCount` and the walks of the blocks
+// like `ReachableSet`) log a warning and skip the links to an ancestor
+// instead of failing with `ErrCycleDetected`.
+func WithSkipCycles() RootOption {
+	return func(o *rootOptions) error {
+		o.skipCycles = true
+		return nil
+	}
+}
+
+// WithBackgroundFlush starts a goroutine flushing the tree (as
+// `Root.Flush`, the new root being published through the republisher)
+// every `interval` if it has changes, so that the callers can mutate it
+// without flushing (without `MkdirOpts.Flush`, with descriptors opened
+// without `Sync`, etc.) and keep the cost of the flushes off their critical
+// path. This sets the durability window: the changes made since the last
+// flush are only in memory, up to `interval` of them (plus the duration of
+// a flush) are lost if the process stops without `Root.Close`, which stops
+// the goroutine and does a final flush. The writes buffered in descriptors
+// that are still open aren't in the tree until the descriptors are flushed
+// or closed (see `WithAutoFlush`).
+func WithBackgroundFlush(interval time.Duration) RootOption {
+	return func(o *rootOptions) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid background flush interval: %s", interval)
+		}
+		o.backgroundFlush = interval
+		return nil
+	}
+}
+
+// ErrInvalidName is returned (wrapped) by `StrictNameValidator`.
+var ErrInvalidName = errors.New("invalid entry name")
+
+// MaxStrictNameLength is the longest name (in bytes) accepted by
+// `StrictNameValidator`.
+const MaxStrictNameLength = 255
+
+// WithNameValidator sets the function checking the names of the new
+// entries created in directories (with `AddChild`, `Mkdir` and the
+// operations built on them, like `Mv` and `PutNode`), its error is
+// returned by the operation. The default is `PermissiveNameValidator`.
+func WithNameValidator(fn func(name string) error) RootOption {
+	return func(o *rootOptions) error {
+		o.nameValidator = fn
+		return nil
+	}
+}
+
+// ErrNameTooLong is returned when the name of a new entry is longer than
+// the limit set with `WithMaxNameLength`.
+var ErrNameTooLong = errors.New("entry name too long")
+
+// WithMaxNameLength rejects the names of new entries (see
+// `WithNameValidator`) longer than `n` bytes (of their UTF-8 encoding)
+// with `ErrNameTooLong`, bounding the size pathological names can add to
+// the directory nodes. It's checked before the validator. Existing entries
+// aren't checked, use `Directory.LongestName` to audit them.
+func WithMaxNameLength(n int) RootOption {
+	return func(o *rootOptions) error {
+		if n < 1 {
+			return fmt.Errorf("invalid maximum name length: %d", n)
+		}
+		o.maxNameLength = n
+		return nil
+	}
+}
+
+// PermissiveNameValidator accepts any name, it's the default validator.
+func PermissiveNameValidator(name string) error {
+	return nil
+}
+
+// StrictNameValidator rejects empty names, "." and "..", names containing
+// a "/" or a control character and names longer than `MaxStrictNameLength`.
+func StrictNameValidator(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty name", ErrInvalidName)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	case len(name) > MaxStrictNameLength:
+		return fmt.Errorf("%w: name longer than %d bytes", ErrInvalidName, MaxStrictNameLength)
+	}
+	for _, r := range name {
+		if r == '/' {
+			return fmt.Errorf("%w: %q contains a '/'", ErrInvalidName, name)
+		}
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %q contains a control character", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// WithReadRetry makes the reads from the DAG service of the tree (when
+// resolving paths, loading entries, traversing HAMT shards, etc.) retry
+// failed fetches, up to `attempts` in total, waiting `backoff` before the
+// first retry and doubling it after each one. Nodes not found
+// (`ipld.ErrNotFound`) and reads whose context is done are not retried.
+func WithReadRetry(attempts int, backoff time.Duration) RootOption {
+	return func(o *rootOptions) error {
+		if attempts < 1 {
+			return fmt.Errorf("invalid number of read attempts: %d", attempts)
+		}
+		o.readAttempts = attempts
+		o.readBackoff = backoff
+		return nil
+	}
+}
+
+// WithFlushConflictResolver sets a function to resolve the conflicts
+// between concurrent changes of an entry. A conflict is detected when a
+// file or directory propagates a change (when flushed) to its parent
+// directory but it's no longer the entry the parent has cached under its
+// name: the entry was replaced (e.g., removed and added again, moved over,
+// evicted with `Directory.Uncache` and loaded again, or its parent was
+// reset with `Root.ReplaceBase`) by another operation since it was
+// loaded. Instead of overwriting the entry (last writer wins), the parent
+// stores the node returned by `fn`, called with the absolute path of the
+// entry, its current node `a` and the node `b` being flushed. An error
+// from `fn` aborts the flush. Entries removed in the meantime are added
+// back as before, without calling `fn`.
+func WithFlushConflictResolver(fn func(path string, a, b ipld.Node) (ipld.Node, error)) RootOption {
+	return func(o *rootOptions) error {
+		o.flushConflictResolver = fn
+		return nil
+	}
+}
+
+// WithNodeCache keeps in memory up to `maxNodes` of the nodes read from
+// the DAG service (e.g., when resolving paths, loading directory entries
+// or traversing HAMT shards), the least recently used ones are evicted.
+// Repeated reads of the same (hot) nodes are then served without fetching
+// nor decoding them again. Nodes are addressed by their content so a
+// cached node can't be stale (changes produce nodes with new CIDs). The
+// effectiveness of the cache can be checked with `Root.NodeCacheStats`.
+func WithNodeCache(maxNodes int) RootOption {
+	return func(o *rootOptions) error {
+		if maxNodes < 1 {
+			return fmt.Errorf("invalid node cache size: %d", maxNodes)
+		}
+		o.nodeCacheSize = maxNodes
+		return nil
+	}
+}
+
+// WithHistory records every new root flushed (with `Root.Flush` or a
+// flush reaching the root) in a backward chain that can be walked with
+// `Root.PreviousRoots`, giving a lightweight time travel over the
+// filesystem. Each change of the root adds a small record node to the DAG
+// service and, as long as the chain is retained, keeps all the prior
+// roots (and every node only they reference) reachable, so the storage
+// used grows with the amount of changes flushed instead of the size of the
+// current tree. Each record is a dag-pb node of about 90 bytes (two
+// links) on top of the nodes of the root it records.
+func WithHistory() RootOption {
+	return func(o *rootOptions) error {
+		o.history = true
+		return nil
+	}
+}
+
+// WithHistoryHead enables `WithHistory` continuing the chain whose last
+// record is `head` (as returned by `Root.HistoryHead`, e.g., persisted
+// before a restart) instead of starting a new one. If the root the `Root`
+// is created with isn't the one `head` records, a record for it is added
+// right away.
+func WithHistoryHead(head cid.Cid) RootOption {
+	return func(o *rootOptions) error {
+		if !head.Defined() {
+			return fmt.Errorf("undefined history head")
+		}
+		o.history = true
+		o.historyHead = head
+		return nil
+	}
+}
+
+// WithLeafCidBuilder sets the CID builder of the leaf (data) blocks of the
+// files written, independently of the one of the structural nodes (the
+// intermediate file nodes and the directories, set with `SetCidBuilder`),
+// e.g., to produce the leaves some `ipfs add` configuration would. The
+// builder's codec is replaced by the one of each leaf (raw or dag-pb). The
+// leaves are re-encoded when the file descriptors are flushed, which
+// walks the (non-converted part of the) file: writes are slower and the
+// leaves written before the conversion remain in the DAG service.
+func WithLeafCidBuilder(b cid.Builder) RootOption {
+	return func(o *rootOptions) error {
+		o.leafCidBuilder = b
+		return nil
+	}
+}
+
+// WithOpLog writes to `w` a log of the mutations of the tree as they
+// happen (entries added or removed, directories created, files written
+// and the whole tree replaced), one JSON `OpLogEntry` per line, e.g., as
+// an audit trail or to replay them with `ReplayOpLog` after a crash.
+// Writing to `w` is serialized but the writes aren't buffered (nor
+// synced): wrap `w` as needed.
+func WithOpLog(w io.Writer) RootOption {
+	return func(o *rootOptions) error {
+		o.opLog = &opLog{enc: json.NewEncoder(w)}
+		return nil
+	}
+}
+
+// EmptyFileMode determines how the empty files created (e.g., with `Touch`)
+// are encoded, which determines their CID.
+type EmptyFileMode int
+
+const (
+	// EmptyFileUnixFS encodes empty files as a dag-pb UnixFS file node of
+	// size zero (with the CID builder of the directory), like `ipfs add`
+	// does by default: QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH
+	// with CIDv0 (the default) and
+	// bafybeif7ztnhq65lumvvtr4ekcwd2ifwgm3awq4zfr3srh462rwyinlb4y with a
+	// CIDv1 (SHA2-256) builder.
+	EmptyFileUnixFS EmptyFileMode = iota
+	// EmptyFileRaw encodes empty files as an empty raw block, like
+	// `ipfs add --raw-leaves` does (the CID builder of the directory only
+	// determines the hash function):
+	// bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku with
+	// SHA2-256.
+	EmptyFileRaw
+)
+
+// WithEmptyFileMode sets how the empty files created are encoded, the
+// default is `EmptyFileUnixFS`.
+func WithEmptyFileMode(mode EmptyFileMode) RootOption {
+	return func(o *rootOptions) error {
+		switch mode {
+		case EmptyFileUnixFS, EmptyFileRaw:
+		default:
+			return fmt.Errorf("invalid empty file mode: %d", mode)
+		}
+		o.emptyFileMode = mode
+		return nil
+	}
+}
+
+// optionsOf returns the options of the `Root` that `p` belongs to (or
+// the default ones if it isn't attached to a `Root`).
+func optionsOf(p parent) *rootOptions {
+	for p != nil {
+		switch cur := p.(type) {
+		case *Root:
+			return &cur.opts
+		case *Directory:
+			p = cur.parent
+		default:
+			p = nil
+		}
+	}
+	return &defaultRootOptions
+}
@@ -0,0 +1,231 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
+	"github.com/spaolacci/murmur3"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrInvalidProof is returned by `VerifyProof` for proofs that don't
+// prove the membership they claim.
+var ErrInvalidProof = errors.New("invalid proof")
+
+// Proof is returned by `Directory.ProofFor` to prove that the directory
+// with CID `Root` has an entry `Name` linking to `Cid`.
+type Proof struct {
+	Root cid.Cid
+	Name string
+	Cid  cid.Cid
+
+	// Encoded (dag-pb) nodes from the directory node down to the one
+	// with the link of the entry: a single node for basic directories,
+	// the path of (sub-)shard nodes for HAMT shards.
+	Nodes [][]byte
+	// Index of the link followed in each node of `Nodes` (the link to
+	// the next node or, in the last one, the link of the entry).
+	Positions []int
+}
+
+// ProofFor returns the proof that the entry `name` (with its current CID)
+// is a member of the directory (with its current CID, so pending changes
+// are applied to the directory node first), which can be checked with
+// `VerifyProof` knowing only the CID of the directory. For HAMT shards
+// only the (sub-)shard nodes on the path the hash of `name` leads to are
+// fetched.
+func (d *Directory) ProofFor(ctx context.Context, name string) (Proof, error) {
+	nd, err := flushedNode(d)
+	if err != nil {
+		return Proof{}, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return Proof{}, dag.ErrNotProtobuf
+	}
+
+	proof := Proof{Root: nd.Cid(), Name: name}
+	found, err := proofPath(ctx, d.dagService, pbnd, name, &proof)
+	if err != nil {
+		return Proof{}, err
+	}
+	if !found {
+		return Proof{}, os.ErrNotExist
+	}
+	return proof, nil
+}
+
+// proofPath appends to `proof` the path from `nd` to the link of the entry
+// `name`, reporting whether it was found under `nd`. In HAMT shards it
+// follows the bits of the hash of `name` down to the only (sub-)shard
+// node that can have the entry, as `hamt.Shard` does.
+func proofPath(ctx context.Context, ds ipld.NodeGetter, nd *dag.ProtoNode, name string, proof *Proof) (bool, error) {
+	hv := &nameHashBits{h: nameHash(name)}
+	for {
+		padLen, lg2, err := shardLayout(nd)
+		if err != nil {
+			return false, err
+		}
+		proof.Nodes = append(proof.Nodes, nd.RawData())
+
+		if padLen == 0 {
+			for i, l := range nd.Links() {
+				if l.Name == name {
+					proof.Positions = append(proof.Positions, i)
+					proof.Cid = l.Cid
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+
+		idx, err := hv.next(lg2)
+		if err != nil {
+			return false, err
+		}
+		i, l := linkWithPrefix(nd, fmt.Sprintf("%0*X", padLen, idx))
+		if l == nil {
+			return false, nil
+		}
+		proof.Positions = append(proof.Positions, i)
+		if len(l.Name) > padLen {
+			if l.Name[padLen:] != name {
+				return false, nil
+			}
+			proof.Cid = l.Cid
+			return true, nil
+		}
+
+		child, err := l.GetNode(ctx, ds)
+		if err != nil {
+			return false, err
+		}
+		var ok bool
+		nd, ok = child.(*dag.ProtoNode)
+		if !ok {
+			return false, dag.ErrNotProtobuf
+		}
+	}
+}
+
+// linkWithPrefix returns the link (and its index) of the shard node `nd`
+// whose name starts with `prefix`, if any.
+func linkWithPrefix(nd *dag.ProtoNode, prefix string) (int, *ipld.Link) {
+	for i, l := range nd.Links() {
+		if strings.HasPrefix(l.Name, prefix) {
+			return i, l
+		}
+	}
+	return -1, nil
+}
+
+// shardLayout returns the length of the prefix of the link names of the
+// HAMT shard node `nd` and the number of hash bits each level consumes
+// (zero for basic directories).
+func shardLayout(nd *dag.ProtoNode) (padLen, lg2 int, err error) {
+	fsn, err := ft.FSNodeFromBytes(nd.Data())
+	if err != nil {
+		return 0, 0, err
+	}
+	switch fsn.Type() {
+	case ft.TDirectory:
+		return 0, 0, nil
+	case ft.THAMTShard:
+		if fsn.HashType() != hamt.HashMurmur3 {
+			return 0, 0, fmt.Errorf("unsupported shard hash function: %#x", fsn.HashType())
+		}
+		lg2, err := hamt.Logtwo(int(fsn.Fanout()))
+		if err != nil || lg2 == 0 {
+			return 0, 0, fmt.Errorf("invalid shard fanout: %d", fsn.Fanout())
+		}
+		return len(fmt.Sprintf("%X", fsn.Fanout()-1)), lg2, nil
+	default:
+		return 0, 0, ErrNotDir
+	}
+}
+
+// nameHash returns the hash HAMT shards place `name` with.
+func nameHash(name string) []byte {
+	h := murmur3.New64()
+	h.Write([]byte(name))
+	return h.Sum(nil)
+}
+
+// nameHashBits reads the bits of a name's hash, most significant first,
+// as the index of the child at each level of a HAMT shard.
+type nameHashBits struct {
+	h        []byte
+	consumed int
+}
+
+func (hb *nameHashBits) next(n int) (int, error) {
+	if hb.consumed+n > len(hb.h)*8 {
+		return 0, fmt.Errorf("sharded directory too deep")
+	}
+	var v int
+	for i := 0; i < n; i++ {
+		bit := hb.h[hb.consumed/8] >> (7 - hb.consumed%8) & 1
+		v = v<<1 | int(bit)
+		hb.consumed++
+	}
+	return v, nil
+}
+
+// VerifyProof checks that `p` proves that the directory `p.Root` has an
+// entry `p.Name` linking to `p.Cid`, returning `ErrInvalidProof` if it
+// doesn't. Only the nodes of the proof are used.
+func VerifyProof(p Proof) error {
+	if len(p.Nodes) == 0 || len(p.Nodes) != len(p.Positions) {
+		return ErrInvalidProof
+	}
+
+	expected := p.Root
+	hv := &nameHashBits{h: nameHash(p.Name)}
+	for i, raw := range p.Nodes {
+		c, err := expected.Prefix().Sum(raw)
+		if err != nil || !c.Equals(expected) {
+			return ErrInvalidProof
+		}
+		nd, err := dag.DecodeProtobuf(raw)
+		if err != nil {
+			return ErrInvalidProof
+		}
+		padLen, lg2, err := shardLayout(nd)
+		if err != nil || (i > 0 && padLen == 0) {
+			return ErrInvalidProof
+		}
+		pos := p.Positions[i]
+		if pos < 0 || pos >= len(nd.Links()) {
+			return ErrInvalidProof
+		}
+		l := nd.Links()[pos]
+		if padLen > 0 {
+			// The link must be the one the hash of the name leads to.
+			idx, err := hv.next(lg2)
+			if err != nil || !strings.HasPrefix(l.Name, fmt.Sprintf("%0*X", padLen, idx)) {
+				return ErrInvalidProof
+			}
+		}
+
+		if i == len(p.Nodes)-1 {
+			if len(l.Name) < padLen || l.Name[padLen:] != p.Name ||
+				(padLen > 0 && len(l.Name) == padLen) || !l.Cid.Equals(p.Cid) {
+				return ErrInvalidProof
+			}
+			return nil
+		}
+		if padLen == 0 || len(l.Name) != padLen {
+			return ErrInvalidProof
+		}
+		expected = l.Cid
+	}
+	return ErrInvalidProof
+}
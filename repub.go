@@ -2,6 +2,7 @@ package mfs
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	cid "github.com/ipfs/go-cid"
@@ -16,7 +17,10 @@ type Republisher struct {
 	TimeoutLong  time.Duration
 	TimeoutShort time.Duration
 	RetryTimeout time.Duration
-	pubfunc      PubFunc
+
+	// Held while publishing, see `SetPubFunc`.
+	pubLock sync.Mutex
+	pubfunc PubFunc
 
 	update           chan cid.Cid
 	immediatePublish chan chan struct{}
@@ -65,6 +69,26 @@ func (rp *Republisher) Close() error {
 	return err
 }
 
+// SetPubFunc replaces the function used to publish, taking effect on the
+// next publish. If a publish is in progress it waits for it to complete
+// (the value being published is published with the previous function).
+// A nil function skips the publishes (the values are considered published).
+func (rp *Republisher) SetPubFunc(pf PubFunc) {
+	rp.pubLock.Lock()
+	defer rp.pubLock.Unlock()
+	rp.pubfunc = pf
+}
+
+// publish publishes `c` with the current `pubfunc`.
+func (rp *Republisher) publish(c cid.Cid) error {
+	rp.pubLock.Lock()
+	defer rp.pubLock.Unlock()
+	if rp.pubfunc == nil {
+		return nil
+	}
+	return rp.pubfunc(rp.ctx, c)
+}
+
 // Update the current value. The value will be published after a delay but each
 // consecutive call to Update may extend this delay up to TimeoutLong.
 func (rp *Republisher) Update(c cid.Cid) {
@@ -170,7 +194,7 @@ func (rp *Republisher) Run(lastPublished cid.Cid) {
 		// 2. If we have a value to publish, publish it now.
 		if toPublish.Defined() {
 			for {
-				err := rp.pubfunc(rp.ctx, toPublish)
+				err := rp.publish(toPublish)
 				if err == nil {
 					break
 				}
@@ -73,3 +73,39 @@ func TestRepublisher(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRepublisherSetPubFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	published := make(chan string, 10)
+	pubWith := func(name string) PubFunc {
+		return func(ctx context.Context, c cid.Cid) error {
+			published <- name
+			return nil
+		}
+	}
+
+	testCid1, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+	testCid2, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVX")
+
+	rp := NewRepublisher(ctx, pubWith("first"), time.Hour, time.Hour)
+	go rp.Run(cid.Undef)
+
+	rp.Update(testCid1)
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-published; name != "first" {
+		t.Fatalf("expected the first function, got %s", name)
+	}
+
+	rp.SetPubFunc(pubWith("second"))
+	rp.Update(testCid2)
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-published; name != "second" {
+		t.Fatalf("expected the second function, got %s", name)
+	}
+}
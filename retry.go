@@ -0,0 +1,57 @@
+package mfs
+
+import (
+	"context"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// retryDAGService retries the failed reads of the wrapped DAG service, see
+// `WithReadRetry`.
+type retryDAGService struct {
+	ipld.DAGService
+	attempts int
+	backoff  time.Duration
+}
+
+// Get returns the node fetched by the wrapped service, retrying errors
+// other than not finding the node (or the context being done) up to the
+// configured number of attempts, waiting `backoff` (doubled after each
+// attempt) in between.
+func (r *retryDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		nd, err := r.DAGService.Get(ctx, c)
+		if err == nil || err == ipld.ErrNotFound || ctx.Err() != nil || attempt >= r.attempts {
+			return nd, err
+		}
+		log.Debugf("retrying fetch of %s after error: %s", c, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// GetMany fetches the nodes one by one with `Get` (so each of them is
+// retried separately).
+func (r *retryDAGService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := r.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -7,11 +7,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
 
+	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
 )
@@ -32,6 +37,9 @@ var ErrIsDirectory = errors.New("error: is a directory")
 type child struct {
 	Name string
 	Node ipld.Node
+	// The MFS node that changed (if known), used to detect updates of
+	// entries that were replaced since (see `WithFlushConflictResolver`).
+	Source FSNode
 }
 
 // This interface represents the basic property of MFS directories of updating
@@ -59,6 +67,8 @@ type NodeType int
 const (
 	TFile NodeType = iota
 	TDir
+	// An `Opaque` entry, pointing to a node that isn't UnixFS.
+	TRaw
 )
 
 // FSNode abstracts the `Directory` and `File` structures, it represents
@@ -71,6 +81,10 @@ type FSNode interface {
 
 	Flush() error
 	Type() NodeType
+
+	// SetCidBuilder sets the CID builder used for the DAG nodes created
+	// from now on for this entry.
+	SetCidBuilder(cid.Builder)
 }
 
 // IsDir checks whether the FSNode is dir type
@@ -83,6 +97,18 @@ func IsFile(fsn FSNode) bool {
 	return fsn.Type() == TFile
 }
 
+// AsDir returns the FSNode as a `Directory` if it is one.
+func AsDir(fsn FSNode) (*Directory, bool) {
+	d, ok := fsn.(*Directory)
+	return d, ok
+}
+
+// AsFile returns the FSNode as a `File` if it is one.
+func AsFile(fsn FSNode) (*File, bool) {
+	fi, ok := fsn.(*File)
+	return fi, ok
+}
+
 // Root represents the root of a filesystem tree.
 type Root struct {
 
@@ -90,23 +116,62 @@ type Root struct {
 	dir *Directory
 
 	repub *Republisher
+
+	opts rootOptions
+
+	// Set with `WithNodeCache`.
+	cache *cachedDAGService
+
+	// Set with `WithHistory`.
+	history *history
+
+	// Number of flushes in progress (see `FlushInProgress`) and the
+	// channel closed when all of them complete.
+	flushLock sync.Mutex
+	flushing  int
+	flushDone chan struct{}
+
+	// Files with a descriptor open for writing (see
+	// `HasOpenWriterUnder`).
+	writersLock sync.Mutex
+	writers     map[*File]struct{}
+
+	// Set with `WithBackgroundFlush`, the channel closed to stop the
+	// goroutine and the one it closes when done.
+	flushStopOnce sync.Once
+	flushStop     chan struct{}
+	flushStopped  chan struct{}
 }
 
 // NewRoot creates a new Root and starts up a republisher routine for it.
-func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf PubFunc) (*Root, error) {
-
-	var repub *Republisher
-	if pf != nil {
-		repub = NewRepublisher(parent, pf, time.Millisecond*300, time.Second*3)
+func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf PubFunc, opts ...RootOption) (*Root, error) {
+	var rootOpts rootOptions
+	for _, opt := range opts {
+		if err := opt(&rootOpts); err != nil {
+			return nil, err
+		}
+	}
 
-		// No need to take the lock here since we just created
-		// the `Republisher` and no one has access to it yet.
+	if rootOpts.readAttempts > 1 {
+		ds = &retryDAGService{
+			DAGService: ds,
+			attempts:   rootOpts.readAttempts,
+			backoff:    rootOpts.readBackoff,
+		}
+	}
 
-		go repub.Run(node.Cid())
+	var cache *cachedDAGService
+	if rootOpts.nodeCacheSize > 0 {
+		cache = newCachedDAGService(ds, rootOpts.nodeCacheSize)
+		ds = cache
 	}
 
 	root := &Root{
-		repub: repub,
+		opts:  rootOpts,
+		cache: cache,
+	}
+	if rootOpts.history {
+		root.history = &history{ds: ds, root: node.Cid()}
 	}
 
 	fsn, err := ft.FSNodeFromBytes(node.Data())
@@ -131,9 +196,129 @@ func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf
 	default:
 		return nil, fmt.Errorf("unrecognized unixfs type: %s", fsn.Type())
 	}
+
+	if rootOpts.historyHead.Defined() {
+		if err := root.history.resume(parent, rootOpts.historyHead, node.Cid()); err != nil {
+			return nil, fmt.Errorf("resuming history: %w", err)
+		}
+	}
+
+	// The goroutines are only started once the root can't fail anymore.
+	if pf != nil && !rootOpts.noRepublisher {
+		root.repub = NewRepublisher(parent, pf, time.Millisecond*300, time.Second*3)
+
+		// No need to take the lock here since we just created
+		// the `Republisher` and no one has access to it yet.
+
+		go root.repub.Run(node.Cid())
+	}
+
+	if rootOpts.backgroundFlush > 0 {
+		root.flushStop = make(chan struct{})
+		root.flushStopped = make(chan struct{})
+		go root.backgroundFlushLoop(rootOpts.backgroundFlush)
+	}
 	return root, nil
 }
 
+// stopBackgroundFlush stops the goroutine of `WithBackgroundFlush` (if
+// any), waiting for the flush in progress to complete.
+func (kr *Root) stopBackgroundFlush() {
+	if kr.flushStop != nil {
+		kr.flushStopOnce.Do(func() { close(kr.flushStop) })
+		<-kr.flushStopped
+	}
+}
+
+// backgroundFlushLoop flushes the tree every `interval` if it has changes
+// until `Close` (see `WithBackgroundFlush`).
+func (kr *Root) backgroundFlushLoop(interval time.Duration) {
+	defer close(kr.flushStopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kr.flushStop:
+			return
+		case <-ticker.C:
+			est, err := kr.EstimateFlush()
+			if err == nil && est.DirtyNodes == 0 {
+				continue
+			}
+			if err == nil {
+				err = kr.Flush()
+			}
+			if err != nil {
+				log.Errorf("background flush failed: %s", err)
+			}
+		}
+	}
+}
+
+// NewRootFromCid fetches the node with the given CID and creates a new
+// Root over it (see `NewRoot`). The node must be a UnixFS directory.
+func NewRootFromCid(ctx context.Context, ds ipld.DAGService, c cid.Cid, pf PubFunc, opts ...RootOption) (*Root, error) {
+	nd, err := ds.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a unixfs directory", c)
+	}
+
+	return NewRoot(ctx, ds, pbnd, pf, opts...)
+}
+
+// NewRootEager creates a new Root (see `NewRoot`) and loads up to
+// `budget` of the first directories of the tree, breadth first (the
+// entries of each directory in lexical order), so navigating the top of
+// the tree doesn't need to fetch them. The nodes fetched to find the
+// directories (entries which turn out to be files) count towards the
+// budget too, bounding the nodes fetched, but only the directories are
+// kept in memory; the rest of the tree is loaded lazily as usual.
+func NewRootEager(ctx context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf PubFunc, budget int, opts ...RootOption) (*Root, error) {
+	root, err := NewRoot(ctx, ds, node, pf, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := []*Directory{root.GetDirectory()}
+	for len(queue) > 0 && budget > 0 {
+		dirs, err := queue[0].preload(ctx, &budget)
+		if err != nil {
+			root.stopBackgroundFlush()
+			if root.repub != nil {
+				root.repub.Close()
+			}
+			return nil, err
+		}
+		queue = append(queue[1:], dirs...)
+	}
+	return root, nil
+}
+
+// NodeCacheStats returns the statistics of the node cache of the root
+// (all zero if it wasn't enabled with `WithNodeCache`).
+func (kr *Root) NodeCacheStats() NodeCacheStats {
+	if kr.cache == nil {
+		return NodeCacheStats{}
+	}
+	return kr.cache.stats()
+}
+
+// SetPubFunc replaces the function with which the republisher publishes
+// the root, e.g., to switch to another IPNS key, taking effect on the next
+// publish (waiting for a publish in progress, if any, to complete). It has
+// no effect if the root has no republisher (created without a `PubFunc` or
+// with `WithoutRepublisher`).
+func (kr *Root) SetPubFunc(pf PubFunc) {
+	if kr.repub != nil {
+		kr.repub.SetPubFunc(pf)
+	}
+}
+
 // GetDirectory returns the root directory.
 func (kr *Root) GetDirectory() *Directory {
 	return kr.dir
@@ -143,10 +328,214 @@ func (kr *Root) GetDirectory() *Directory {
 // and updates the Root republisher.
 // TODO: We are definitely abusing the "flush" terminology here.
 func (kr *Root) Flush() error {
-	nd, err := kr.GetDirectory().GetNode()
+	kr.beginFlush()
+	defer kr.endFlush()
+
+	nd, err := kr.GetDirectory().flushNode()
+	if err != nil {
+		return err
+	}
+
+	if kr.history != nil {
+		if err := kr.history.record(context.TODO(), nd.Cid()); err != nil {
+			return err
+		}
+	}
+
+	if kr.repub != nil {
+		kr.repub.Update(nd.Cid())
+	}
+	return nil
+}
+
+// FlushInProgress reports whether a flush of the whole tree (`Flush` or
+// `FlushMemFree`) is currently running, e.g., to skip requesting another
+// one that would redo the same work.
+func (kr *Root) FlushInProgress() bool {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	return kr.flushing > 0
+}
+
+// WaitFlush blocks until the flushes in progress (see `FlushInProgress`)
+// complete, returning immediately if there are none. Flushes started
+// while waiting are waited on as well.
+func (kr *Root) WaitFlush(ctx context.Context) error {
+	kr.flushLock.Lock()
+	if kr.flushing == 0 {
+		kr.flushLock.Unlock()
+		return nil
+	}
+	done := kr.flushDone
+	kr.flushLock.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (kr *Root) beginFlush() {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	if kr.flushing == 0 {
+		kr.flushDone = make(chan struct{})
+	}
+	kr.flushing++
+}
+
+func (kr *Root) endFlush() {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	kr.flushing--
+	if kr.flushing == 0 {
+		close(kr.flushDone)
+	}
+}
+
+// HasOpenWriterUnder reports whether any file at or below `path` (e.g., a
+// directory about to be flushed or moved) currently has a descriptor open
+// for writing, whose data the flush wouldn't capture until it's flushed or
+// closed. The paths of the files are the current ones (a file moved while
+// open is checked at its new location).
+func (kr *Root) HasOpenWriterUnder(path string) bool {
+	path = gopath.Clean("/" + path)
+
+	kr.writersLock.Lock()
+	defer kr.writersLock.Unlock()
+	for fi := range kr.writers {
+		fpath := fi.path()
+		if path == "/" || fpath == path || strings.HasPrefix(fpath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (kr *Root) addWriter(fi *File) {
+	kr.writersLock.Lock()
+	defer kr.writersLock.Unlock()
+	if kr.writers == nil {
+		kr.writers = make(map[*File]struct{})
+	}
+	kr.writers[fi] = struct{}{}
+}
+
+func (kr *Root) hasWriter(fi *File) bool {
+	kr.writersLock.Lock()
+	defer kr.writersLock.Unlock()
+	_, ok := kr.writers[fi]
+	return ok
+}
+
+func (kr *Root) removeWriter(fi *File) {
+	kr.writersLock.Lock()
+	defer kr.writersLock.Unlock()
+	delete(kr.writers, fi)
+}
+
+// rootOf returns the `Root` that `p` belongs to (nil if it isn't attached
+// to one).
+func rootOf(p parent) *Root {
+	for p != nil {
+		switch cur := p.(type) {
+		case *Root:
+			return cur
+		case *Directory:
+			p = cur.parent
+		default:
+			p = nil
+		}
+	}
+	return nil
+}
+
+// FlushEstimate is returned by `EstimateFlush`.
+type FlushEstimate struct {
+	// Number of directory nodes a flush would store (the nodes of the
+	// files are stored when the files are written).
+	DirtyNodes int
+	// Approximate size of those nodes: the size of the current node of
+	// basic directories and of the last stored node of HAMT shards (the
+	// shard nodes below it aren't counted).
+	EstimatedBytes uint64
+}
+
+// EstimateFlush estimates the cost of flushing the tree (with `Flush`)
+// from the in-memory state of the loaded directories, without storing any
+// node (although the nodes of HAMT directories may be read to check their
+// entries).
+func (kr *Root) EstimateFlush() (FlushEstimate, error) {
+	var est FlushEstimate
+	_, _, err := kr.GetDirectory().estimateFlush(&est)
+	return est, err
+}
+
+// RootNode flushes the tree (as `Flush`) and returns a deep copy of the
+// root node (its data and each of its links included) that is safe to
+// hand to external code: mutating the returned node doesn't affect the
+// `Root`.
+func (kr *Root) RootNode(ctx context.Context) (ipld.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := kr.Flush(); err != nil {
+		return nil, err
+	}
+	nd, err := flushedNode(kr.GetDirectory())
 	if err != nil {
+		return nil, err
+	}
+
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, dag.ErrNotProtobuf
+	}
+	// `Copy` shares the links with the original node.
+	links := make([]*ipld.Link, len(pbnd.Links()))
+	for i, l := range pbnd.Links() {
+		lcopy := *l
+		links[i] = &lcopy
+	}
+	pbnd.SetLinks(links)
+	return pbnd, nil
+}
+
+// ReplaceBase atomically replaces the whole tree with the UnixFS directory
+// `nd` (e.g., a tree built externally), which is stored in the DAG service
+// if it isn't already (its descendants must be). All the cached entries
+// are dropped so any `File` or `Directory` obtained from the previous tree
+// must not be used afterwards. The republisher (if any) is notified of the
+// new root, there is nothing left to flush.
+func (kr *Root) ReplaceBase(ctx context.Context, nd ipld.Node) error {
+	return kr.replaceBase(ctx, nd, cid.Undef)
+}
+
+// replaceBase is `ReplaceBase` only replacing the tree if its root node is
+// still `base` (if defined), see `Directory.replaceNode`.
+func (kr *Root) replaceBase(ctx context.Context, nd ipld.Node, base cid.Cid) error {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return fmt.Errorf("%s is not a unixfs directory", nd.Cid())
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return err
+	}
+	if !fsn.IsDir() {
+		return fmt.Errorf("%s is not a unixfs directory (unixfs type: %s)", nd.Cid(), fsn.Type())
+	}
+
+	dir := kr.GetDirectory()
+	if err := dir.dagService.Add(ctx, nd); err != nil {
+		return err
+	}
+	if err := dir.replaceNode(nd, base); err != nil {
 		return err
 	}
+	dir.recordOp(OpBase, "", nd.Cid())
 
 	if kr.repub != nil {
 		kr.repub.Update(nd.Cid())
@@ -154,6 +543,562 @@ func (kr *Root) Flush() error {
 	return nil
 }
 
+// Rebase replaces the whole tree with the UnixFS directory `newRoot` like
+// `ReplaceBase` but keeps the `Directory` objects (and everything cached
+// under them) at `preservePaths` valid when the new tree has exactly the
+// same directory (same CID) at that path, so handles to deep directories
+// don't need to be resolved again after each base swap. Any other `File` or
+// `Directory` obtained from the previous tree, including the preserved
+// ones whose CID changed, must not be used afterwards. Preserved
+// directories are synced (flushing their local changes, if any, into their
+// node) before comparing them.
+func (kr *Root) Rebase(ctx context.Context, newRoot ipld.Node, preservePaths []string) error {
+	type preserved struct {
+		path string
+		dir  *Directory
+		c    cid.Cid
+	}
+	var keep []preserved
+	for _, p := range preservePaths {
+		p = gopath.Clean("/" + p)
+		if p == "/" {
+			// The root directory is always kept.
+			continue
+		}
+		d, err := lookupDir(kr, p)
+		if err != nil {
+			return err
+		}
+		nd, err := flushedNode(d)
+		if err != nil {
+			return err
+		}
+		keep = append(keep, preserved{p, d, nd.Cid()})
+	}
+	// Parents first, so nested preserved directories are reattached to
+	// their (preserved) parent.
+	sort.Slice(keep, func(i, j int) bool { return len(keep[i].path) < len(keep[j].path) })
+
+	if err := kr.ReplaceBase(ctx, newRoot); err != nil {
+		return err
+	}
+
+	for _, k := range keep {
+		dirPath, name := gopath.Split(k.path)
+		parent, err := lookupDir(kr, dirPath)
+		if err != nil {
+			// Not in the new tree (or not a directory there).
+			continue
+		}
+		if err := parent.reattach(name, k.dir, k.c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrBaseConflict is returned by `FollowBase` when the base changed but
+// the tree has local changes.
+var ErrBaseConflict = errors.New("base changed with local changes in the tree")
+
+// FollowBase turns the root into a mirror of an external tree (e.g., one
+// published under an IPNS name): every `interval` it calls `resolve` for
+// the current CID of that tree and, if it changed, replaces the base of
+// the root with it (see `ReplaceBase`). The tree is only replaced if it's
+// clean, that is, if the root node is still the last one followed (or the
+// one at the time of the call), which is checked again atomically with the
+// replacement; otherwise it stops returning `ErrBaseConflict`. Errors
+// resolving or fetching the new base are only logged (and retried in the
+// next interval). It blocks until `ctx` is done (returning its error) or
+// a conflict is found.
+func (kr *Root) FollowBase(ctx context.Context, resolve func(ctx context.Context) (cid.Cid, error), interval time.Duration) error {
+	dir := kr.GetDirectory()
+	nd, err := flushedNode(dir)
+	if err != nil {
+		return err
+	}
+	base := nd.Cid()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c, err := resolve(ctx)
+		if err != nil {
+			log.Warnf("failed to resolve the base to follow: %s", err)
+		} else if !c.Equals(base) {
+			nd, err := flushedNode(dir)
+			if err != nil {
+				return err
+			}
+			if !nd.Cid().Equals(base) {
+				return ErrBaseConflict
+			}
+
+			newBase, err := dir.dagService.Get(ctx, c)
+			if err != nil {
+				log.Warnf("failed to fetch the base %s to follow: %s", c, err)
+			} else if err := kr.replaceBase(ctx, newBase, base); err != nil {
+				// `ErrBaseConflict` if the tree changed since the check above.
+				return err
+			} else {
+				base = c
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CompactReport is returned by `Compact`.
+type CompactReport struct {
+	// Number of directories converted from HAMT shards to basic directories.
+	Compacted int
+	// Difference in bytes between the blocks of the removed shards and the
+	// basic directory nodes that replaced them.
+	BytesReclaimed int64
+}
+
+// Compact converts all the HAMT sharded directories in the tree whose
+// entries have fallen below the sharding threshold (e.g., after deleting
+// most of them) back to basic directories, and flushes the root. The
+// entries of the directories are left unchanged.
+func (kr *Root) Compact(ctx context.Context) (CompactReport, error) {
+	var report CompactReport
+	compact := func(d *Directory) error {
+		ok, reclaimed, err := d.unshard(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			report.Compacted++
+			report.BytesReclaimed += reclaimed
+		}
+		return nil
+	}
+
+	err := Walk(ctx, kr.GetDirectory(), func(path string, nd FSNode) error {
+		if dir, ok := nd.(*Directory); ok {
+			return compact(dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := compact(kr.GetDirectory()); err != nil {
+		return report, err
+	}
+
+	return report, kr.Flush()
+}
+
+// SetRootSharded converts the top-level directory to a HAMT shard
+// (`sharded`) or to a basic directory and fixes that representation: the
+// automatic conversions (driven by `uio.HAMTShardingSize`,
+// `WithShardHysteresis` or `WithShardingMode`) and `Compact` leave the
+// root alone afterwards, e.g., to start as a shard a root expected to grow
+// to millions of entries. A basic root then stays a single node whatever
+// its size. The subdirectories keep converting automatically. If the root
+// was converted the tree is flushed and the new root node published. A
+// `ReplaceBase` (or `Rebase`) takes the representation of the new node and
+// restores the automatic conversions.
+func (kr *Root) SetRootSharded(ctx context.Context, sharded bool) error {
+	converted, err := kr.GetDirectory().setSharded(ctx, sharded)
+	if err != nil || !converted {
+		return err
+	}
+	return kr.Flush()
+}
+
+// IsRootSharded reports if the top-level directory is currently a HAMT
+// shard.
+func (kr *Root) IsRootSharded() bool {
+	d := kr.GetDirectory()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.isShardedUnsync()
+}
+
+// DanglingLink is a directory entry pointing to a node missing from the
+// DAG service, reported by `FindDangling`.
+type DanglingLink struct {
+	// Path of the entry in the MFS.
+	Path string
+	// CID of the missing node.
+	Cid cid.Cid
+}
+
+// FindDangling walks the tree looking for directory entries whose nodes
+// are missing from the DAG service (e.g., after a partial garbage
+// collection of the blockstore). It only checks the entries themselves,
+// the internal nodes of the files aren't fetched.
+func (kr *Root) FindDangling(ctx context.Context) ([]DanglingLink, error) {
+	var dangling []DanglingLink
+	ancestors := make(ancestorSet)
+	leave, _, err := ancestors.enter(kr.GetDirectory())
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	err = findDangling(ctx, kr.GetDirectory(), "/", &dangling, ancestors)
+	return dangling, err
+}
+
+func findDangling(ctx context.Context, d *Directory, dirPath string, dangling *[]DanglingLink, ancestors ancestorSet) error {
+	d.lock.Lock()
+	var links []*ipld.Link
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if _, ok := d.entriesCache[l.Name]; !ok {
+			links = append(links, l)
+		}
+		return nil
+	})
+	var cached []*Directory
+	for _, entry := range d.entriesCache {
+		if dir, ok := entry.(*Directory); ok {
+			cached = append(cached, dir)
+		}
+	}
+	d.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range links {
+		nd, err := d.dagService.Get(ctx, l.Cid)
+		if err == ipld.ErrNotFound {
+			*dangling = append(*dangling, DanglingLink{
+				Path: gopath.Join(dirPath, l.Name),
+				Cid:  l.Cid,
+			})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only (fetched) directories need to be checked further, we don't
+		// cache them here to leave the state of the tree unchanged.
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			continue
+		}
+		fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+		if err != nil || !fsn.IsDir() {
+			continue
+		}
+		dir, err := NewDirectory(ctx, l.Name, nd, d, d.dagService)
+		if err != nil {
+			return err
+		}
+		cached = append(cached, dir)
+	}
+
+	for _, dir := range cached {
+		leave, skip, err := ancestors.enter(dir)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		err = findDangling(ctx, dir, gopath.Join(dirPath, dir.name), dangling, ancestors)
+		leave()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneDangling removes all the directory entries reported by
+// `FindDangling`, returning the number of entries removed.
+func (kr *Root) PruneDangling(ctx context.Context) (int, error) {
+	dangling, err := kr.FindDangling(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, dl := range dangling {
+		dirPath, name := gopath.Split(dl.Path)
+		dir, err := lookupDir(kr, dirPath)
+		if err != nil {
+			return i, err
+		}
+		if err := dir.Unlink(name); err != nil {
+			return i, err
+		}
+	}
+	return len(dangling), nil
+}
+
+// ReachableSet flushes the tree and returns the set of the CIDs of every
+// block reachable from the root node (including it), e.g., to be used as
+// the roots of a garbage collection of the blockstore behind the DAG
+// service. Blocks shared by different parts of the tree are included (and
+// traversed) only once.
+func (kr *Root) ReachableSet(ctx context.Context) (*cid.Set, error) {
+	set := cid.NewSet()
+	err := kr.walkReachable(ctx, func(c cid.Cid) (bool, error) {
+		return set.Visit(c), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// WalkReachable is the streaming version of `ReachableSet` for huge trees:
+// it calls `fn` for every block reachable from the (flushed) root node,
+// without keeping track of the blocks already visited. As a consequence a
+// block referenced more than once in the tree (and all of its descendants)
+// is passed to `fn` once for every reference to it.
+func (kr *Root) WalkReachable(ctx context.Context, fn func(cid.Cid) error) error {
+	return kr.walkReachable(ctx, func(c cid.Cid) (bool, error) {
+		return true, fn(c)
+	})
+}
+
+// PrefetchOption configures `Root.Prefetch`.
+type PrefetchOption func(*prefetchOptions)
+
+type prefetchOptions struct {
+	progress func(fetched int)
+}
+
+// WithPrefetchProgress makes `Root.Prefetch` call `fn` with the number of
+// blocks fetched so far after fetching each block (calls are serialized,
+// `fn` shouldn't block).
+func WithPrefetchProgress(fn func(fetched int)) PrefetchOption {
+	return func(o *prefetchOptions) {
+		o.progress = fn
+	}
+}
+
+// Prefetch flushes the tree and fetches every block reachable from the
+// root node (directories, shards, file nodes and leaves, each block once)
+// with up to `concurrency` fetches at the same time, e.g., to make the
+// whole tree available in the store of a DAG service backed by the
+// network so subsequent operations are local. It stops at the first error
+// fetching a block or when `ctx` is done.
+func (kr *Root) Prefetch(ctx context.Context, concurrency int, opts ...PrefetchOption) error {
+	var o prefetchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	nd, err := flushedNode(kr.GetDirectory())
+	if err != nil {
+		return err
+	}
+	ds := kr.GetDirectory().dagService
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		lock     sync.Mutex
+		cond     = sync.NewCond(&lock)
+		seen     = cid.NewSet()
+		queue    []cid.Cid
+		pending  int // Blocks queued or being fetched.
+		fetched  int
+		fetchErr error
+	)
+	push := func(nd ipld.Node) {
+		for _, l := range nd.Links() {
+			if seen.Visit(l.Cid) {
+				queue = append(queue, l.Cid)
+				pending++
+			}
+		}
+	}
+	seen.Add(nd.Cid())
+	push(nd)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock.Lock()
+			defer lock.Unlock()
+			for {
+				for len(queue) == 0 && pending > 0 && fetchErr == nil {
+					cond.Wait()
+				}
+				if len(queue) == 0 || fetchErr != nil {
+					return
+				}
+				c := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+
+				lock.Unlock()
+				child, err := ds.Get(ctx, c)
+				lock.Lock()
+
+				pending--
+				if err != nil {
+					if fetchErr == nil {
+						fetchErr = err
+						cancel()
+					}
+				} else {
+					fetched++
+					if o.progress != nil {
+						o.progress(fetched)
+					}
+					push(child)
+				}
+				cond.Broadcast()
+			}
+		}()
+	}
+	wg.Wait()
+	return fetchErr
+}
+
+// Clone copies every block reachable from the (flushed) root of `r` that
+// isn't already there into `to` and returns a new `Root` over the copy,
+// fully independent of `r`, with the same options and the republishing
+// function `pf`. The operation log (`WithOpLog`) and the history
+// (`WithHistory`) of `r` aren't carried over: they describe `r` alone.
+func Clone(ctx context.Context, r *Root, to ipld.DAGService, pf PubFunc) (*Root, error) {
+	from := r.GetDirectory().dagService
+	copied := cid.NewSet()
+	err := r.walkReachable(ctx, func(c cid.Cid) (bool, error) {
+		if !copied.Visit(c) {
+			return false, nil
+		}
+
+		_, err := to.Get(ctx, c)
+		if err == nil {
+			return true, nil
+		}
+		if err != ipld.ErrNotFound {
+			return false, err
+		}
+		nd, err := from.Get(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		return true, to.Add(ctx, nd)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nd, err := flushedNode(r.GetDirectory())
+	if err != nil {
+		return nil, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, dag.ErrNotProtobuf
+	}
+	opts := r.opts
+	opts.opLog = nil
+	opts.history = false
+	opts.historyHead = cid.Undef
+	return NewRoot(ctx, to, pbnd, pf, func(o *rootOptions) error {
+		*o = opts
+		return nil
+	})
+}
+
+// walkReachable flushes the tree and walks the DAG from the root node
+// (see `walkDAG`).
+func (kr *Root) walkReachable(ctx context.Context, visit func(cid.Cid) (bool, error)) error {
+	nd, err := flushedNode(kr.GetDirectory())
+	if err != nil {
+		return err
+	}
+	dir := kr.GetDirectory()
+	return walkDAG(ctx, dir.dagService, nd.Cid(), optionsOf(dir).skipCycles, visit)
+}
+
+// walkDAG walks the DAG under `root` depth first, `visit` returns whether
+// to descend into the block. A block linking to one of its ancestors in
+// the walk returns `ErrCycleDetected` (or is skipped with `skipCycles`).
+func walkDAG(ctx context.Context, ds ipld.DAGService, root cid.Cid, skipCycles bool, visit func(cid.Cid) (bool, error)) error {
+	ancestors := make(map[cid.Cid]struct{})
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if skip, err := ancestorBlock(ancestors, c, skipCycles); err != nil || skip {
+			return err
+		}
+		descend, err := visit(c)
+		if err != nil || !descend {
+			return err
+		}
+		// Raw blocks have no links, avoid fetching them.
+		if c.Type() == cid.Raw {
+			return nil
+		}
+		nd, err := ds.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		ancestors[c] = struct{}{}
+		defer delete(ancestors, c)
+		for _, l := range nd.Links() {
+			if err := walk(l.Cid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// ancestorBlock checks if the link to `c` points back to one of the
+// `ancestors` blocks of a walk of a DAG: it returns `ErrCycleDetected` or,
+// with `skipCycles`, logs a warning and reports that the link must be
+// skipped.
+func ancestorBlock(ancestors map[cid.Cid]struct{}, c cid.Cid, skipCycles bool) (bool, error) {
+	if _, ok := ancestors[c]; !ok {
+		return false, nil
+	}
+	if skipCycles {
+		log.Warnf("skipping link to an ancestor block (%s)", c)
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: link to an ancestor block (%s)", ErrCycleDetected, c)
+}
+
+// NewBlocks returns the set of the blocks reachable from `target` but not
+// from `base` (e.g., two successive roots of a tree), which is the minimal
+// set of blocks to transfer to update a copy of `base` to `target`. The
+// walk of `target` doesn't descend into the blocks reachable from `base`.
+func NewBlocks(ctx context.Context, ds ipld.DAGService, base, target cid.Cid) (*cid.Set, error) {
+	baseSet := cid.NewSet()
+	err := walkDAG(ctx, ds, base, false, func(c cid.Cid) (bool, error) {
+		return baseSet.Visit(c), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newSet := cid.NewSet()
+	err = walkDAG(ctx, ds, target, false, func(c cid.Cid) (bool, error) {
+		if baseSet.Has(c) {
+			return false, nil
+		}
+		return newSet.Visit(c), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newSet, nil
+}
+
 // FlushMemFree flushes the root directory and then uncaches all of its links.
 // This has the effect of clearing out potentially stale references and allows
 // them to be garbage collected.
@@ -165,6 +1110,9 @@ func (kr *Root) Flush() error {
 // TODO: Review the motivation behind this method once the cache system is
 // refactored.
 func (kr *Root) FlushMemFree(ctx context.Context) error {
+	kr.beginFlush()
+	defer kr.endFlush()
+
 	dir := kr.GetDirectory()
 
 	if err := dir.Flush(); err != nil {
@@ -182,6 +1130,36 @@ func (kr *Root) FlushMemFree(ctx context.Context) error {
 	return nil
 }
 
+// FlushAndCompactCache flushes the tree (as `Flush`) and returns the CID
+// of the new root, then drops from the cache of every directory the
+// entries that don't need to stay in memory: the files that aren't open
+// (and the entries that aren't UnixFS) whose node is the one linked in the
+// directory, which are loaded again from the DAG service when next
+// accessed. Cached directories are kept (with their cache compacted in
+// turn), as the changes to a directory only reach the root through the
+// cache of its parent. A dropped `File` previously obtained can still be
+// used. See `CachedNodeCount`.
+func (kr *Root) FlushAndCompactCache(ctx context.Context) (cid.Cid, error) {
+	if err := kr.Flush(); err != nil {
+		return cid.Undef, err
+	}
+	nd, err := flushedNode(kr.GetDirectory())
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := kr.GetDirectory().compactCache(ctx); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// CachedNodeCount returns the number of `File`, `Directory` and `Opaque`
+// objects currently cached in the tree (not including the root
+// directory).
+func (kr *Root) CachedNodeCount() int {
+	return kr.GetDirectory().cachedNodeCount()
+}
+
 // updateChildEntry implements the `parent` interface, and signals
 // to the publisher that there are changes ready to be published.
 // This is the only thing that separates a `Root` from a `Directory`.
@@ -197,6 +1175,12 @@ func (kr *Root) updateChildEntry(c child) error {
 	// TODO: Why are we not using the inner directory lock nor
 	// applying the same procedure as `Directory.updateChildEntry`?
 
+	if kr.history != nil {
+		if err := kr.history.record(context.TODO(), c.Node.Cid()); err != nil {
+			return err
+		}
+	}
+
 	if kr.repub != nil {
 		kr.repub.Update(c.Node.Cid())
 	}
@@ -204,7 +1188,9 @@ func (kr *Root) updateChildEntry(c child) error {
 }
 
 func (kr *Root) Close() error {
-	nd, err := kr.GetDirectory().GetNode()
+	kr.stopBackgroundFlush()
+
+	nd, err := flushedNode(kr.GetDirectory())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,38 @@
+package mfs
+
+import (
+	"net/http"
+	"os"
+	gopath "path"
+	"time"
+)
+
+// ServeFile replies to `req` with the contents of the file at 'path' using
+// `http.ServeContent`, which handles range requests (seeking the read
+// descriptor so only the blocks needed are fetched), conditional requests
+// and sets the content type from the file name extension or by sniffing
+// its first bytes. The UnixFS format currently supported has no
+// modification times so no `Last-Modified` header is set.
+//
+// If 'path' doesn't exist it replies with a 404 and returns
+// `os.ErrNotExist`; any other error (e.g., `ErrIsDirectory`) is returned
+// without writing a response, leaving it to the caller.
+func ServeFile(w http.ResponseWriter, req *http.Request, r *Root, path string) error {
+	fi, err := lookupFile(r, path)
+	if err == os.ErrNotExist {
+		http.NotFound(w, req)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	fd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	http.ServeContent(w, req, gopath.Base(path), time.Time{}, fd)
+	return nil
+}
@@ -0,0 +1,441 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"sort"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// SkipDir can be returned by a `WalkFunc` when called on a directory to
+// skip its contents (it is not returned as an error by `Walk`).
+var SkipDir = errors.New("skip this directory")
+
+// ErrCycleDetected is returned (wrapped) by the traversals of the tree
+// when a directory links (transitively) to one of its ancestors, which is
+// only possible in a DAG service that doesn't check the nodes it returns
+// against their CID (see `WithSkipCycles`).
+var ErrCycleDetected = errors.New("cycle detected")
+
+// WalkFunc is the function called by `Walk` for every node visited, with
+// the path of the node relative to the directory the walk started from.
+type WalkFunc func(path string, nd FSNode) error
+
+// Walk recursively visits all the files and directories under `d` (not
+// including `d` itself), calling `fn` for each of them. Entries of each
+// directory are visited in lexical order and a directory is always
+// visited before its contents.
+func Walk(ctx context.Context, d *Directory, fn WalkFunc) error {
+	ancestors := make(ancestorSet)
+	leave, _, err := ancestors.enter(d)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return walk(ctx, d, "", fn, ancestors)
+}
+
+// ancestorSet holds the CIDs of the directories from the one a traversal
+// of the tree started from to the one being traversed, to detect cycles
+// by. Only the directories that didn't change since they were loaded (or
+// stored) are tracked, the CID of the others may be stale (e.g., an empty
+// directory with new entries), and cycles can only come from loaded ones.
+type ancestorSet map[cid.Cid]struct{}
+
+// enter adds the directory `d` to the ancestors until `leave` is called.
+// If it's already one of them (one of its ancestors links back to it) it
+// returns `ErrCycleDetected` or, with `WithSkipCycles`, logs a warning and
+// reports that `d` must be skipped.
+func (a ancestorSet) enter(d *Directory) (leave func(), skip bool, err error) {
+	c, dirty := d.storedCid()
+	if dirty {
+		return func() {}, false, nil
+	}
+	if _, ok := a[c]; ok {
+		if optionsOf(d).skipCycles {
+			log.Warnf("skipping %s: links to an ancestor (%s)", d.Path(), c)
+			return nil, true, nil
+		}
+		return nil, false, fmt.Errorf("%w: %s links to an ancestor (%s)", ErrCycleDetected, d.Path(), c)
+	}
+	a[c] = struct{}{}
+	return func() { delete(a, c) }, false, nil
+}
+
+// walk is `Walk` with the directories from the one the walk started from
+// to `d` (included) in `ancestors`.
+func walk(ctx context.Context, d *Directory, dirPath string, fn WalkFunc, ancestors ancestorSet) error {
+	names, err := d.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		child, err := d.Child(name)
+		if err != nil {
+			return err
+		}
+
+		childPath := gopath.Join(dirPath, name)
+		if err := walkChild(ctx, childPath, child, fn, ancestors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkChild calls `fn` on `child` and walks it if it's a directory.
+func walkChild(ctx context.Context, childPath string, child FSNode, fn WalkFunc, ancestors ancestorSet) error {
+	dir, isDir := child.(*Directory)
+	if isDir {
+		leave, skip, err := ancestors.enter(dir)
+		if err != nil || skip {
+			return err
+		}
+		defer leave()
+	}
+
+	err := fn(childPath, child)
+	if err == SkipDir {
+		return nil
+	}
+	if err != nil || !isDir {
+		return err
+	}
+	return walk(ctx, dir, childPath, fn, ancestors)
+}
+
+// WalkSince walks the tree like `Walk` (with absolute MFS paths) but skips
+// the directories whose current CID matches the one found in `known` under
+// their path: they are neither visited nor descended into. This allows to
+// process (e.g., re-index) only the parts of the tree that changed since
+// the CIDs in `known` were recorded.
+func (kr *Root) WalkSince(ctx context.Context, known map[string]cid.Cid, fn WalkFunc) error {
+	unchanged := func(path string, nd FSNode) (bool, error) {
+		c, ok := known[path]
+		if !ok {
+			return false, nil
+		}
+		n, err := flushedNode(nd)
+		if err != nil {
+			return false, err
+		}
+		return n.Cid().Equals(c), nil
+	}
+
+	root := kr.GetDirectory()
+	skip, err := unchanged("/", root)
+	if err != nil || skip {
+		return err
+	}
+
+	return Walk(ctx, root, func(path string, nd FSNode) error {
+		path = "/" + path
+		if nd.Type() == TDir {
+			skip, err := unchanged(path, nd)
+			if err != nil {
+				return err
+			}
+			if skip {
+				return SkipDir
+			}
+		}
+		return fn(path, nd)
+	})
+}
+
+// WalkDirty calls `fn` (with absolute MFS paths, in the order of `Walk`)
+// for the files and directories changed in memory since the last flush of
+// their directory, skipping the clean subtrees entirely: a directory is
+// visited if it or anything under it changed, a file if it was added to
+// its directory, written (flushed or not to the directory) or is open for
+// writing. The root itself isn't visited. The walk is over the nodes
+// already loaded in memory, with the exception of the entries added to a
+// directory (e.g., with `AddChild`) but not loaded yet, which are loaded
+// from the DAG service they were added to. The nodes to visit are
+// collected before calling `fn`, which may then operate on them.
+func (kr *Root) WalkDirty(fn func(path string, nd FSNode) error) error {
+	type visit struct {
+		path string
+		nd   FSNode
+	}
+	var visits []visit
+	var collect func(d *Directory, dirPath string) (bool, error)
+	collect = func(d *Directory, dirPath string) (bool, error) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		names := make([]string, 0, len(d.entriesCache)+len(d.changed))
+		for name := range d.entriesCache {
+			names = append(names, name)
+		}
+		for name := range d.changed {
+			if _, ok := d.entriesCache[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		dirty := d.dirty
+		for _, name := range names {
+			_, changed := d.changed[name]
+			entry, ok := d.entriesCache[name]
+			if !ok {
+				var err error
+				if entry, err = d.childUnsync(name); err != nil {
+					return false, err
+				}
+			}
+
+			childPath := gopath.Join(dirPath, name)
+			switch entry := entry.(type) {
+			case *Directory:
+				i := len(visits)
+				visits = append(visits, visit{childPath, entry})
+				childDirty, err := collect(entry, childPath)
+				if err != nil {
+					return false, err
+				}
+				if !childDirty && !changed {
+					visits = visits[:i]
+					continue
+				}
+			case *File:
+				if !changed && !entry.unlinked() && !kr.hasWriter(entry) {
+					continue
+				}
+				visits = append(visits, visit{childPath, entry})
+			default:
+				if !changed {
+					continue
+				}
+				visits = append(visits, visit{childPath, entry})
+			}
+			dirty = true
+		}
+		return dirty, nil
+	}
+
+	if _, err := collect(kr.GetDirectory(), "/"); err != nil {
+		return err
+	}
+	for _, v := range visits {
+		if err := fn(v.path, v.nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SymlinkInfo is a symlink found by `ListSymlinks`.
+type SymlinkInfo struct {
+	// Path relative to the directory listed.
+	Path   string
+	Target string
+}
+
+// ListSymlinks walks the whole tree under `d` (as `Walk`) and returns all
+// the UnixFS symlinks found with their target, which is reported as stored
+// (not resolved nor validated), e.g., to find links pointing outside of
+// the tree.
+func (d *Directory) ListSymlinks(ctx context.Context) ([]SymlinkInfo, error) {
+	var links []SymlinkInfo
+	err := Walk(ctx, d, func(path string, nd FSNode) error {
+		fi, ok := nd.(*File)
+		if !ok {
+			return nil
+		}
+		target, ok, err := symlinkTarget(fi)
+		if err != nil {
+			return err
+		}
+		if ok {
+			links = append(links, SymlinkInfo{Path: path, Target: target})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// NodeInfo is the metadata of a node reported by `Inspect`.
+type NodeInfo struct {
+	Name string
+	Type NodeType
+	// Size of the file contents (zero for directories).
+	Size int64
+	Cid  cid.Cid
+	// The UnixFS format currently supported has no modification times nor
+	// modes: `ModTime` is always zero and `Mode` only has `os.ModeDir` set
+	// for directories.
+	ModTime time.Time
+	Mode    os.FileMode
+	// Number of entries of directories (zero for files).
+	Children int
+}
+
+// Inspect walks the whole tree (as `WalkSince` without known CIDs, the
+// root included with the path "/") calling `fn` with the metadata of
+// every node, collected from the node already loaded by the walk. `fn` may
+// return `SkipDir` to avoid descending into a directory.
+func (kr *Root) Inspect(ctx context.Context, fn func(path string, info NodeInfo) error) error {
+	inspect := func(path string, nd FSNode) error {
+		info, err := nodeInfo(ctx, gopath.Base(path), nd)
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	}
+
+	err := inspect("/", kr.GetDirectory())
+	if err == SkipDir {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return kr.WalkSince(ctx, nil, inspect)
+}
+
+func nodeInfo(ctx context.Context, name string, fsn FSNode) (NodeInfo, error) {
+	nd, err := flushedNode(fsn)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	info := NodeInfo{
+		Name: name,
+		Type: fsn.Type(),
+		Cid:  nd.Cid(),
+	}
+	switch fsn := fsn.(type) {
+	case *Directory:
+		info.Mode = os.ModeDir
+		names, err := fsn.ListNames(ctx)
+		if err != nil {
+			return NodeInfo{}, err
+		}
+		info.Children = len(names)
+	case *File:
+		info.Size, err = fsn.Size()
+		if err != nil {
+			return NodeInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// PathsFor returns all the (absolute) paths in the tree whose node has the
+// CID `c`, in walk order. The tree is flushed once and each directory is
+// then visited once per CID: the matches under a directory found before at
+// another path (e.g., a copy) are reused without walking it again, and a
+// node can't contain itself so matching directories aren't descended into.
+// No set of the blocks reachable from each directory is kept across calls,
+// so the walk can't rule out the subtrees that don't contain `c` without
+// visiting them once.
+func (kr *Root) PathsFor(ctx context.Context, c cid.Cid) ([]string, error) {
+	root := kr.GetDirectory()
+	nd, err := flushedNode(root)
+	if err != nil {
+		return nil, err
+	}
+	if nd.Cid().Equals(c) {
+		return []string{"/"}, nil
+	}
+
+	ancestors := make(ancestorSet)
+	leave, _, err := ancestors.enter(root)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	paths, err := pathsFor(ctx, root, "/", c, make(map[cid.Cid][]string), ancestors)
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// pathsFor returns the paths of the nodes under `d` (at `dirPath`) with
+// the CID `c`, recording in `memo` the ones relative to each directory
+// walked (by its CID) to reuse them for the other occurrences of the same
+// directory.
+func pathsFor(ctx context.Context, d *Directory, dirPath string, c cid.Cid, memo map[cid.Cid][]string, ancestors ancestorSet) ([]string, error) {
+	names, err := d.ListNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var paths []string
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		child, err := d.Child(name)
+		if err != nil {
+			return nil, err
+		}
+		childPath := gopath.Join(dirPath, name)
+
+		dir, isDir := child.(*Directory)
+		var childCid cid.Cid
+		dirty := true
+		if isDir {
+			// The tree was just flushed so the stored CID is current
+			// unless the directory changed since.
+			childCid, dirty = dir.storedCid()
+		}
+		if dirty {
+			n, err := flushedNode(child)
+			if err != nil {
+				return nil, err
+			}
+			childCid = n.Cid()
+		}
+		if childCid.Equals(c) {
+			paths = append(paths, childPath)
+			continue
+		}
+		if !isDir {
+			continue
+		}
+
+		rel, ok := memo[childCid]
+		if !ok {
+			leave, skip, err := ancestors.enter(dir)
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				continue
+			}
+			found, err := pathsFor(ctx, dir, childPath, c, memo, ancestors)
+			leave()
+			if err != nil {
+				return nil, err
+			}
+			rel = make([]string, len(found))
+			for i, p := range found {
+				rel[i] = p[len(childPath)+1:]
+			}
+			memo[childCid] = rel
+		}
+		for _, p := range rel {
+			paths = append(paths, gopath.Join(childPath, p))
+		}
+	}
+	return paths, nil
+}